@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Operations accepted in a batch
+const (
+	batchOpAdd      = "add"
+	batchOpComplete = "complete"
+	batchOpUpdate   = "update"
+	batchOpDelete   = "delete"
+)
+
+// maxBatchOps bounds the work a single request can ask for.
+const maxBatchOps = 1000
+
+// BatchOp is one operation of a batch. Version works as for single-task mutations:
+// the operation fails with ErrVersionMismatch if the task changed, and 0 skips the check.
+type BatchOp struct {
+	Op          string     `json:"op"`
+	ID          int        `json:"id,omitempty"`
+	Version     int        `json:"version,omitempty"`
+	Title       string     `json:"title,omitempty"`       // For add
+	Description string     `json:"description,omitempty"` // For add
+	Update      TaskUpdate `json:"update"`                // For update
+}
+
+type batchRequest struct {
+	Operations []BatchOp `json:"operations"`
+}
+
+type batchResponse struct {
+	Results []Task `json:"results"`
+}
+
+// BatchError reports which operation made a batch fail. It unwraps to the store
+// error, so errors.Is works as for single operations.
+type BatchError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("operation %d: %v", e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// validateBatch checks the shape of a batch before any store is touched.
+func validateBatch(ops []BatchOp) error {
+	if len(ops) == 0 {
+		return fmt.Errorf("a batch needs at least one operation")
+	}
+	if len(ops) > maxBatchOps {
+		return fmt.Errorf("a batch can have at most %d operations", maxBatchOps)
+	}
+
+	for i, op := range ops {
+		switch op.Op {
+		case batchOpAdd:
+			// An empty title is allowed, as for POST /tasks
+		case batchOpComplete, batchOpUpdate, batchOpDelete:
+			if op.ID <= 0 {
+				return &BatchError{Index: i, Err: fmt.Errorf("%s needs a task ID", op.Op)}
+			}
+		default:
+			return &BatchError{Index: i, Err: fmt.Errorf("unknown operation %q", op.Op)}
+		}
+	}
+	return nil
+}
+
+// cloneTasks copies a map of userName to tasks deeply enough to be changed freely.
+func cloneTasks(tasks map[string]map[int]Task) map[string]map[int]Task {
+	clone := make(map[string]map[int]Task, len(tasks))
+	for userName, userTasks := range tasks {
+		clone[userName] = make(map[int]Task, len(userTasks))
+		for id, task := range userTasks {
+			clone[userName][id] = task
+		}
+	}
+	return clone
+}
+
+// idAllocator hands out IDs for tasks added by a batch.
+type idAllocator interface {
+	nextID() (int, error)
+	releaseID(id int)
+}
+
+// gapIDAllocator allocates like AddTask does: gaps below the highest ID first.
+type gapIDAllocator struct {
+	idSeq       int
+	reusableIds []int
+}
+
+func newGapIDAllocator(tasks map[string]map[int]Task) *gapIDAllocator {
+	idSeq, reusableIds := idStateFromTasks(tasks)
+	return &gapIDAllocator{idSeq: idSeq, reusableIds: reusableIds}
+}
+
+func (ids *gapIDAllocator) nextID() (int, error) {
+	if len(ids.reusableIds) > 0 {
+		id := ids.reusableIds[0]
+		ids.reusableIds = ids.reusableIds[1:]
+		return id, nil
+	}
+	ids.idSeq++
+	return ids.idSeq, nil
+}
+
+func (ids *gapIDAllocator) releaseID(id int) {
+	ids.reusableIds = append(ids.reusableIds, id)
+	sort.Ints(ids.reusableIds)
+}
+
+// applyBatch runs ops for userName against tasks, changing it in place, and returns
+// the task each operation produced (for delete, the removed task). Stores pass a copy
+// so that a failing batch leaves their state untouched.
+func applyBatch(tasks map[string]map[int]Task, userName string, ops []BatchOp, ids idAllocator) ([]Task, error) {
+	results := make([]Task, 0, len(ops))
+
+	for i, op := range ops {
+		var task Task
+		var err error
+
+		switch op.Op {
+		case batchOpAdd:
+			var id int
+			if id, err = ids.nextID(); err == nil {
+				task = Task{ID: id, Title: op.Title, Description: op.Description, Version: 1, CreatedAt: time.Now().UTC()}
+				if tasks[userName] == nil {
+					tasks[userName] = make(map[int]Task)
+				}
+				tasks[userName][id] = task
+			}
+
+		case batchOpComplete, batchOpUpdate:
+			update := op.Update
+			if op.Op == batchOpComplete {
+				update = completeUpdate()
+			}
+
+			if task, err = lookupUserTask(tasks, userName, op.ID); err == nil {
+				if err = checkVersion(task, op.Version); err == nil {
+					task = update.apply(task)
+					tasks[userName][op.ID] = task
+				}
+			}
+
+		case batchOpDelete:
+			if task, err = lookupUserTask(tasks, userName, op.ID); err == nil {
+				if err = checkVersion(task, op.Version); err == nil {
+					delete(tasks[userName], op.ID)
+					if len(tasks[userName]) == 0 {
+						delete(tasks, userName)
+					}
+					ids.releaseID(op.ID)
+				}
+			}
+
+		default:
+			err = fmt.Errorf("unknown operation %q", op.Op)
+		}
+
+		if err != nil {
+			return nil, &BatchError{Index: i, Err: err}
+		}
+		results = append(results, task)
+	}
+
+	return results, nil
+}
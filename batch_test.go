@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStoresApplyBatchAtomically(t *testing.T) {
+	dir := t.TempDir()
+	stores := map[string]TaskStore{
+		"memory": localTaskStore(),
+		"json":   newTestJSONStore(t, filepath.Join(dir, "tasks.json")),
+		"wal":    newTestWALStore(t, dir, 0),
+		"sqlite": newTestSQLiteStore(t, filepath.Join(dir, "tasks.db")),
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			first := mustAddTask(t, store, "alice", "First", "")
+			second := mustAddTask(t, store, "alice", "Second", "")
+			other := mustAddTask(t, store, "bob", "Bob's", "")
+
+			// The last operation fails, so the completion before it must not stick
+			_, err := store.ApplyBatch(ctx, "alice", []BatchOp{
+				{Op: batchOpComplete, ID: first.ID},
+				{Op: batchOpDelete, ID: other.ID},
+			})
+			var batchErr *BatchError
+			if !errors.As(err, &batchErr) || batchErr.Index != 1 || !errors.Is(err, ErrForbidden) {
+				t.Fatalf("Expected operation 1 to fail with ErrForbidden, got %v", err)
+			}
+			if task, _ := store.GetTask(ctx, "alice", first.ID); task.Completed {
+				t.Errorf("Expected the failed batch to leave task %d open", first.ID)
+			}
+
+			results, err := store.ApplyBatch(ctx, "alice", []BatchOp{
+				{Op: batchOpComplete, ID: first.ID, Version: first.Version},
+				{Op: batchOpDelete, ID: second.ID},
+				{Op: batchOpAdd, Title: "Third"},
+			})
+			if err != nil || len(results) != 3 {
+				t.Fatalf("Expected the batch to succeed, got %v, %v", results, err)
+			}
+			if !results[0].Completed || results[0].Version != 2 {
+				t.Errorf("Expected task %d completed at version 2, got %+v", first.ID, results[0])
+			}
+			if results[2].ID != second.ID {
+				t.Errorf("Expected the added task to reuse deleted ID %d, got %d", second.ID, results[2].ID)
+			}
+
+			tasks := mustListTasks(t, store, "alice")
+			if len(tasks) != 2 {
+				t.Errorf("Expected 2 tasks for alice after the batch, got %d", len(tasks))
+			}
+		})
+	}
+}
+
+func TestWALBatchSurvivesReplay(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestWALStore(t, dir, 0)
+	task := mustAddTask(t, store, "alice", "First", "")
+	if _, err := store.ApplyBatch(context.Background(), "alice", []BatchOp{
+		{Op: batchOpComplete, ID: task.ID},
+		{Op: batchOpAdd, Title: "Second"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := mustListTasks(t, store, "alice")
+	crashWALStore(store)
+
+	reopened := newTestWALStore(t, dir, 0)
+	if got := mustListTasks(t, reopened, "alice"); digestTasks(got) != digestTasks(want) {
+		t.Errorf("Expected replay to restore %+v, got %+v", want, got)
+	}
+}
+
+func TestParseTaskIDs(t *testing.T) {
+	ids, err := parseTaskIDs([]string{"3", "5", "9", "4-6"})
+	if err != nil || !reflect.DeepEqual(ids, []int{3, 5, 9, 4, 6}) {
+		t.Errorf("Expected [3 5 9 4 6], got %v, %v", ids, err)
+	}
+
+	for _, args := range [][]string{{"x"}, {"0"}, {"20-10"}, {"-5"}, {"1-5000"}} {
+		if _, err := parseTaskIDs(args); err == nil {
+			t.Errorf("Expected %v to be rejected", args)
+		}
+	}
+}
+
+func TestBatchPathRefusesOtherMethods(t *testing.T) {
+	router := newRouter()
+
+	for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		for _, path := range []string{"/api/v1/tasks/batch", "/tasks/batch"} {
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(method, path+"?username=alice", nil))
+			if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "POST" {
+				t.Errorf("%s %s: expected 405 with Allow: POST, got %d %q", method, path, rec.Code, rec.Header().Get("Allow"))
+			}
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/tasks/7", nil))
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "DELETE, GET, HEAD, PATCH, PUT" {
+		t.Errorf("Expected the mux's own 405 for a task, got %d %q", rec.Code, rec.Header().Get("Allow"))
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	cacheTasks    = flag.Bool("cache-tasks", false, "Cache each user's task list in memory in front of the task store")
+	cacheMaxUsers = flag.Int("cache-max-users", 1000, "Number of users whose tasks the cache keeps; the least recently used are dropped first")
+)
+
+// cachingTaskStore serves ListTasks and GetTask from memory and passes everything else
+// to the wrapped store. Any mutation drops the user's cached tasks, whether or not it
+// succeeded, so the next read goes to the store again.
+//
+// Changes that do not go through the cache, such as edits merged from the JSON file
+// or another program writing the SQLite database, are not seen until the user's
+// next mutation.
+type cachingTaskStore struct {
+	next     TaskStore
+	maxUsers int
+
+	mutex   sync.Mutex
+	users   map[string]*taskCacheEntry
+	clock   uint64            // Incremented by every mutation
+	mutated map[string]uint64 // The clock after each user's last mutation; kept only while reads are in progress
+	reading int               // Reads from the wrapped store in progress
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type taskCacheEntry struct {
+	list     []Task // Valid when listed is set
+	listed   bool
+	tasks    map[int]Task
+	lastUsed time.Time
+}
+
+// TaskCacheStats reports how well the cache is doing.
+type TaskCacheStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+	Users  int    `json:"users"`
+}
+
+func newCachingTaskStore(next TaskStore, maxUsers int) *cachingTaskStore {
+	return &cachingTaskStore{
+		next:     next,
+		maxUsers: maxUsers,
+		users:    make(map[string]*taskCacheEntry),
+		mutated:  make(map[string]uint64),
+	}
+}
+
+func (store *cachingTaskStore) Stats() TaskCacheStats {
+	store.mutex.Lock()
+	users := len(store.users)
+	store.mutex.Unlock()
+
+	return TaskCacheStats{Hits: store.hits.Load(), Misses: store.misses.Load(), Users: users}
+}
+
+func (store *cachingTaskStore) ListTasks(ctx context.Context, userName string) ([]Task, error) {
+	store.mutex.Lock()
+	if entry, exists := store.users[userName]; exists && entry.listed {
+		entry.lastUsed = time.Now()
+		tasks := append([]Task(nil), entry.list...)
+		store.mutex.Unlock()
+		store.hits.Add(1)
+		return tasks, nil
+	}
+	start := store.clock
+	store.reading++
+	store.mutex.Unlock()
+	store.misses.Add(1)
+
+	tasks, err := store.next.ListTasks(ctx, userName)
+	if err != nil {
+		store.fill(userName, start, nil)
+		return nil, err
+	}
+
+	store.fill(userName, start, func(entry *taskCacheEntry) {
+		entry.list = append([]Task(nil), tasks...)
+		entry.listed = true
+		for _, task := range tasks {
+			entry.tasks[task.ID] = task
+		}
+	})
+	return tasks, nil
+}
+
+// QueryTasks runs the query over the cached list, so it is read from the store at
+// most once between changes.
+func (store *cachingTaskStore) QueryTasks(ctx context.Context, userName string, query TaskQuery) (TaskPage, error) {
+	tasks, err := store.ListTasks(ctx, userName)
+	if err != nil {
+		return TaskPage{}, err
+	}
+	return queryTaskList(tasks, query)
+}
+
+func (store *cachingTaskStore) GetTask(ctx context.Context, userName string, id int) (Task, error) {
+	store.mutex.Lock()
+	if entry, exists := store.users[userName]; exists {
+		if task, cached := entry.tasks[id]; cached {
+			entry.lastUsed = time.Now()
+			store.mutex.Unlock()
+			store.hits.Add(1)
+			return task, nil
+		}
+	}
+	start := store.clock
+	store.reading++
+	store.mutex.Unlock()
+	store.misses.Add(1)
+
+	// Errors are not cached: whether a missing task is not found or another user's
+	// is up to the store
+	task, err := store.next.GetTask(ctx, userName, id)
+	if err != nil {
+		store.fill(userName, start, nil)
+		return Task{}, err
+	}
+
+	store.fill(userName, start, func(entry *taskCacheEntry) {
+		entry.tasks[task.ID] = task
+	})
+	return task, nil
+}
+
+// fill ends a read that started at clock value start and stores what it returned,
+// unless the user's tasks changed since then and the result may already be out of
+// date. update is nil when the read failed.
+func (store *cachingTaskStore) fill(userName string, start uint64, update func(entry *taskCacheEntry)) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	stale := store.mutated[userName] > start
+	store.reading--
+	if store.reading == 0 {
+		clear(store.mutated) // Only reads in progress can be out of date
+	}
+	if update == nil || stale {
+		return
+	}
+
+	entry, exists := store.users[userName]
+	if !exists {
+		store.evictOldest()
+		entry = &taskCacheEntry{tasks: make(map[int]Task)}
+		store.users[userName] = entry
+	}
+
+	entry.lastUsed = time.Now()
+	update(entry)
+}
+
+// evictOldest makes room for one more user. Must be called with the mutex held.
+func (store *cachingTaskStore) evictOldest() {
+	if store.maxUsers <= 0 || len(store.users) < store.maxUsers {
+		return
+	}
+
+	var oldest string
+	var oldestUsed time.Time
+	for userName, entry := range store.users {
+		if oldest == "" || entry.lastUsed.Before(oldestUsed) {
+			oldest, oldestUsed = userName, entry.lastUsed
+		}
+	}
+	delete(store.users, oldest)
+}
+
+// invalidate drops userName's cached tasks after a mutation.
+func (store *cachingTaskStore) invalidate(userName string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.clock++
+	if store.reading > 0 {
+		store.mutated[userName] = store.clock
+	}
+	if entry, exists := store.users[userName]; exists {
+		entry.list, entry.listed = nil, false
+		entry.tasks = make(map[int]Task)
+	}
+}
+
+func (store *cachingTaskStore) AddTask(ctx context.Context, userName, title string, description string) (Task, error) {
+	defer store.invalidate(userName)
+	return store.next.AddTask(ctx, userName, title, description)
+}
+
+func (store *cachingTaskStore) RemoveTask(ctx context.Context, userName string, id int, version int) error {
+	defer store.invalidate(userName)
+	return store.next.RemoveTask(ctx, userName, id, version)
+}
+
+func (store *cachingTaskStore) CompleteTask(ctx context.Context, userName string, id int, version int) (Task, error) {
+	defer store.invalidate(userName)
+	return store.next.CompleteTask(ctx, userName, id, version)
+}
+
+func (store *cachingTaskStore) UpdateTask(ctx context.Context, userName string, id int, version int, update TaskUpdate) (Task, error) {
+	defer store.invalidate(userName)
+	return store.next.UpdateTask(ctx, userName, id, version, update)
+}
+
+func (store *cachingTaskStore) RemoveUserTasks(ctx context.Context, userName string) error {
+	defer store.invalidate(userName)
+	return store.next.RemoveUserTasks(ctx, userName)
+}
+
+func (store *cachingTaskStore) ImportTasks(ctx context.Context, userName string, tasks []Task) error {
+	defer store.invalidate(userName)
+	return store.next.ImportTasks(ctx, userName, tasks)
+}
+
+func (store *cachingTaskStore) ApplyBatch(ctx context.Context, userName string, ops []BatchOp) ([]Task, error) {
+	defer store.invalidate(userName)
+	return store.next.ApplyBatch(ctx, userName, ops)
+}
+
+func (store *cachingTaskStore) ListUserNames(ctx context.Context) ([]string, error) {
+	return store.next.ListUserNames(ctx)
+}
+
+func (store *cachingTaskStore) SnapshotTasks(ctx context.Context) (map[string]map[int]Task, error) {
+	return store.next.SnapshotTasks(ctx)
+}
+
+// Close closes the wrapped store.
+func (store *cachingTaskStore) Close() error {
+	if closer, ok := store.next.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
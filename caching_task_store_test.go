@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestCachingStoreServesReadsFromMemory(t *testing.T) {
+	store := newCachingTaskStore(newTestJSONStore(t, filepath.Join(t.TempDir(), "tasks.json")), 0)
+	first := mustAddTask(t, store, "alice", "First", "")
+
+	mustListTasks(t, store, "alice")
+	mustListTasks(t, store, "alice")
+	if _, err := store.GetTask(context.Background(), "alice", first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if stats := store.Stats(); stats.Hits != 2 || stats.Misses != 1 || stats.Users != 1 {
+		t.Errorf("Expected 2 hits and 1 miss, got %+v", stats)
+	}
+
+	if _, err := store.CompleteTask(context.Background(), "alice", first.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	tasks := mustListTasks(t, store, "alice")
+	if len(tasks) != 1 || !tasks[0].Completed {
+		t.Errorf("Expected the completed task after a mutation, got %+v", tasks)
+	}
+	if stats := store.Stats(); stats.Misses != 2 {
+		t.Errorf("Expected the mutation to cause a miss, got %+v", stats)
+	}
+}
+
+// readDuringWriteStore lets a mutation run while a ListTasks call is in progress.
+type readDuringWriteStore struct {
+	TaskStore
+	duringList func()
+}
+
+func (store *readDuringWriteStore) ListTasks(ctx context.Context, userName string) ([]Task, error) {
+	tasks, err := store.TaskStore.ListTasks(ctx, userName)
+	if store.duringList != nil {
+		store.duringList()
+		store.duringList = nil
+	}
+	return tasks, err
+}
+
+func TestCachingStoreDropsReadsOverlappingMutation(t *testing.T) {
+	backend := &readDuringWriteStore{TaskStore: localTaskStore()}
+	store := newCachingTaskStore(backend, 0)
+	mustAddTask(t, store, "alice", "First", "")
+	mustListTasks(t, store, "alice")
+	mustAddTask(t, store, "alice", "Second", "")
+
+	// The list read before the third task was added must not end up in the cache
+	backend.duringList = func() { mustAddTask(t, store, "alice", "Third", "") }
+	mustListTasks(t, store, "alice")
+
+	if tasks := mustListTasks(t, store, "alice"); len(tasks) != 3 {
+		t.Errorf("Expected all 3 tasks, got %+v", tasks)
+	}
+}
+
+func TestCachingStoreEvictsLeastRecentlyUsedUser(t *testing.T) {
+	store := newCachingTaskStore(localTaskStore(), 2)
+	for _, userName := range []string{"alice", "bob"} {
+		mustAddTask(t, store, userName, "Task", "")
+		mustListTasks(t, store, userName)
+	}
+	mustListTasks(t, store, "alice")
+	mustListTasks(t, store, "carol")
+
+	store.mutex.Lock()
+	_, keptAlice := store.users["alice"]
+	_, keptBob := store.users["bob"]
+	store.mutex.Unlock()
+	if !keptAlice || keptBob || store.Stats().Users != 2 {
+		t.Errorf("Expected bob to be evicted, got alice %v, bob %v, %+v", keptAlice, keptBob, store.Stats())
+	}
+}
+
+func TestCachingStoreFillsDespiteOtherUsersMutations(t *testing.T) {
+	backend := &readDuringWriteStore{TaskStore: localTaskStore()}
+	store := newCachingTaskStore(backend, 0)
+	mustAddTask(t, store, "alice", "First", "")
+
+	// Bob's change while alice's tasks are read says nothing about hers
+	backend.duringList = func() { mustAddTask(t, store, "bob", "Other", "") }
+	mustListTasks(t, store, "alice")
+
+	mustListTasks(t, store, "alice")
+	if stats := store.Stats(); stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("Expected alice's tasks to be cached after the first read, got %+v", stats)
+	}
+}
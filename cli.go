@@ -2,12 +2,19 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	neturl "net/url"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func runCLI() {
@@ -47,13 +54,35 @@ func runCLI() {
 		case "add":
 			handleAdd(args)
 		case "list":
-			handleList()
+			handleList(args)
 		case "get":
 			handleGetTaskByID(args)
+		case "search":
+			handleSearch(args)
+		case "views":
+			handleViews()
+		case "save-view":
+			handleSaveView(args)
+		case "delete-view":
+			handleDeleteView(args)
 		case "complete":
 			handleComplete(args)
 		case "delete":
 			handleDelete(args)
+		case "enable-2fa":
+			handleEnable2FA(scanner)
+		case "snapshot":
+			handleSnapshot(args)
+		case "passwd":
+			handlePasswd(scanner)
+		case "delete-account":
+			handleDeleteAccount(scanner)
+			if !isLoggedIn {
+				for !isLoggedIn {
+					loginOrRegister(scanner)
+				}
+				printHelp()
+			}
 		case "help":
 			printHelp()
 		case "exit":
@@ -94,7 +123,7 @@ func handleAdd(args []string) {
 		Title:       title,
 		Description: description,
 	}
-	resp, err := http.Post(fmt.Sprintf("http://localhost:8080/tasks?username=%s", userName), "application/json", toJSON(task))
+	resp, err := http.Post(apiURL("/tasks", userName), "application/json", toJSON(task))
 	if err != nil {
 		logger.Error("Failed to add task", "error", err)
 		return
@@ -108,7 +137,9 @@ func handleAdd(args []string) {
 	}
 }
 
-func handleList() {
+// handleList lists the user's tasks, or those matching a filter such as status:open.
+// A first argument such as @today uses that saved view.
+func handleList(args []string) {
 	// Use the stored logged-in username
 	userName := loggedInUsername
 
@@ -117,13 +148,31 @@ func handleList() {
 		return
 	}
 
-	resp, err := http.Get(fmt.Sprintf("http://localhost:8080/tasks?username=%s", userName))
+	params := neturl.Values{}
+	if len(args) > 0 && strings.HasPrefix(args[0], "@") {
+		params.Set("view", strings.TrimPrefix(args[0], "@"))
+		args = args[1:]
+	}
+	if len(args) > 0 {
+		params.Set("q", strings.Join(args, " "))
+	}
+	url := apiURL("/tasks", userName)
+	if len(params) > 0 {
+		url += "&" + params.Encode()
+	}
+	resp, err := http.Get(url)
 	if err != nil {
 		logger.Error("Failed to list tasks", "error", err)
 		return
 	}
 	defer safeClose(resp.Body)
 
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusNotFound {
+		body, _ := io.ReadAll(resp.Body)
+		fmt.Println(strings.TrimSpace(string(body)))
+		return
+	}
+
 	var tasks []Task
 	if err := json.NewDecoder(resp.Body).Decode(&tasks); err != nil {
 		logger.Error("Failed to decode tasks response", "error", err)
@@ -136,10 +185,161 @@ func handleList() {
 	}
 
 	for _, task := range tasks {
+		rememberTaskVersion(task.ID, task.Version)
 		logger.Info("Task found", "taskID", task.ID, "title", task.Title, "description", task.Description, "completed", task.Completed)
 	}
 }
 
+func handleViews() {
+	if loggedInUsername == "" {
+		logger.Info("You must be logged in to list views.")
+		return
+	}
+
+	resp, err := http.Get(apiURL("/views", loggedInUsername))
+	if err != nil {
+		logger.Error("Failed to list views", "error", err)
+		return
+	}
+	defer safeClose(resp.Body)
+
+	var views []SavedView
+	if err := json.NewDecoder(resp.Body).Decode(&views); err != nil {
+		logger.Error("Failed to decode views response", "error", err)
+		return
+	}
+	if len(views) == 0 {
+		fmt.Println("No saved views. Save one with: save-view \"Today\" status:open created:<1d")
+		return
+	}
+	for _, view := range views {
+		fmt.Printf("@%s (%s): %s\n", view.Key, view.Name, view.Filter)
+	}
+}
+
+// handleSaveView saves a filter under a name, given in quotes when it has spaces.
+func handleSaveView(args []string) {
+	usage := "Usage: save-view \"<name>\" <filter>, e.g. save-view \"Waiting on others\" status:open waiting"
+	if len(args) == 0 {
+		logger.Info(usage)
+		return
+	}
+	if loggedInUsername == "" {
+		logger.Info("You must be logged in to save a view.")
+		return
+	}
+
+	line := strings.Join(args, " ")
+	name, filter, _ := strings.Cut(line, " ")
+	if strings.HasPrefix(line, `"`) {
+		var found bool
+		if name, filter, found = strings.Cut(line[1:], `"`); !found {
+			logger.Info(usage)
+			return
+		}
+	}
+
+	body, _ := json.Marshal(SavedView{Name: name, Filter: strings.TrimSpace(filter)})
+	resp, err := http.Post(apiURL("/views", loggedInUsername), "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.Error("Failed to save view", "error", err)
+		return
+	}
+	defer safeClose(resp.Body)
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		var failure errorResponse
+		_ = json.NewDecoder(resp.Body).Decode(&failure)
+		for _, detail := range failure.Details {
+			fmt.Println(detail.Message)
+		}
+		if len(failure.Details) == 0 {
+			fmt.Println("Failed to save view:", resp.Status)
+		}
+		return
+	}
+
+	var view SavedView
+	if err := json.NewDecoder(resp.Body).Decode(&view); err != nil {
+		logger.Error("Failed to decode view response", "error", err)
+		return
+	}
+	fmt.Printf("Saved view @%s. List its tasks with: list @%s\n", view.Key, view.Key)
+}
+
+func handleDeleteView(args []string) {
+	if len(args) != 1 {
+		logger.Info("Usage: delete-view @<view>")
+		return
+	}
+	if loggedInUsername == "" {
+		logger.Info("You must be logged in to delete a view.")
+		return
+	}
+
+	key := strings.TrimPrefix(args[0], "@")
+	req, err := http.NewRequest(http.MethodDelete, apiURL("/views/"+neturl.PathEscape(key), loggedInUsername), nil)
+	if err != nil {
+		logger.Error("Failed to create request", "error", err)
+		return
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		logger.Error("Failed to delete view", "error", err)
+		return
+	}
+	defer safeClose(resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		fmt.Printf("Deleted view @%s.\n", key)
+	case http.StatusNotFound:
+		fmt.Printf("No view @%s.\n", key)
+	default:
+		fmt.Printf("Unexpected error: %s\n", resp.Status)
+	}
+}
+
+func handleSearch(args []string) {
+	if len(args) == 0 {
+		logger.Info("Usage: search <words>, e.g. search \"pay rent\" report*")
+		return
+	}
+	if loggedInUsername == "" {
+		logger.Info("You must be logged in to search tasks.")
+		return
+	}
+
+	url := apiURL("/search", loggedInUsername) + "&" + neturl.Values{"q": {strings.Join(args, " ")}}.Encode()
+	resp, err := http.Get(url)
+	if err != nil {
+		logger.Error("Failed to search tasks", "error", err)
+		return
+	}
+	defer safeClose(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		fmt.Printf("Search failed: %s\n", strings.TrimSpace(string(body)))
+		return
+	}
+
+	var results []SearchResult
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		logger.Error("Failed to decode search response", "error", err)
+		return
+	}
+	if len(results) == 0 {
+		fmt.Println("No tasks match.")
+		return
+	}
+	for _, result := range results {
+		rememberTaskVersion(result.Task.ID, result.Task.Version)
+		fmt.Printf("ID: %d, Title: %s, Description: %s, Completed: %v (score %.2f)\n",
+			result.Task.ID, result.Task.Title, result.Task.Description, result.Task.Completed, result.Score)
+	}
+}
+
 func handleGetTaskByID(args []string) {
 	if len(args) != 2 {
 		logger.Info("Usage: get <username> <id>")
@@ -148,7 +348,7 @@ func handleGetTaskByID(args []string) {
 
 	userName := args[0]
 	id := args[1]
-	url := fmt.Sprintf("http://localhost:8080/tasks/%s?username=%s", id, userName)
+	url := apiURL("/tasks/"+neturl.PathEscape(id), userName)
 
 	resp, err := http.Get(url)
 	if err != nil {
@@ -163,6 +363,7 @@ func handleGetTaskByID(args []string) {
 			logger.Error("Error decoding response:", "error", err)
 			return
 		}
+		rememberTaskVersion(task.ID, task.Version)
 		fmt.Printf("ID: %d, Title: %s, Description: %s, Completed: %v\n",
 			task.ID, task.Title, task.Description, task.Completed)
 	} else if resp.StatusCode == http.StatusNotFound {
@@ -174,7 +375,7 @@ func handleGetTaskByID(args []string) {
 
 func handleComplete(args []string) {
 	if len(args) < 1 {
-		logger.Info("Usage: complete <id>")
+		logger.Info("Usage: complete <id>... (ranges like 10-20 are allowed)")
 		return
 	}
 
@@ -186,14 +387,25 @@ func handleComplete(args []string) {
 		return
 	}
 
-	id := args[0]
-	url := fmt.Sprintf("http://localhost:8080/tasks/%s?username=%s", id, userName)
+	ids, err := parseTaskIDs(args)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if len(ids) > 1 {
+		runTaskBatch(batchOpComplete, ids, userName)
+		return
+	}
+
+	id := strconv.Itoa(ids[0])
+	url := apiURL("/tasks/"+neturl.PathEscape(id), userName)
 
 	req, err := http.NewRequest(http.MethodPut, url, nil)
 	if err != nil {
 		logger.Error("Error creating request:", "error", err)
 		return
 	}
+	req.Header.Set("If-Match", seenTaskETag(ids[0]))
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
@@ -204,7 +416,10 @@ func handleComplete(args []string) {
 	defer safeClose(resp.Body)
 
 	if resp.StatusCode == http.StatusOK {
+		rememberTaskETag(ids[0], resp.Header.Get("ETag"))
 		logger.Info("Task completed successfully", "id", id, "userName", userName)
+	} else if resp.StatusCode == http.StatusPreconditionFailed {
+		fmt.Printf("Task %s was changed by someone else; check it with 'get %s' and try again.\n", id, id)
 	} else {
 		logger.Error("Failed to complete task", "id", id, "error", resp.Status)
 	}
@@ -212,7 +427,7 @@ func handleComplete(args []string) {
 
 func handleDelete(args []string) {
 	if len(args) < 1 {
-		logger.Info("Usage: delete <id>")
+		logger.Info("Usage: delete <id>... (ranges like 10-20 are allowed)")
 		return
 	}
 
@@ -224,14 +439,25 @@ func handleDelete(args []string) {
 		return
 	}
 
-	id := args[0]
-	url := fmt.Sprintf("http://localhost:8080/tasks/%s?username=%s", id, userName) // Use the stored username
+	ids, err := parseTaskIDs(args)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if len(ids) > 1 {
+		runTaskBatch(batchOpDelete, ids, userName)
+		return
+	}
+
+	id := strconv.Itoa(ids[0])
+	url := apiURL("/tasks/"+neturl.PathEscape(id), userName) // Use the stored username
 
 	req, err := http.NewRequest(http.MethodDelete, url, nil)
 	if err != nil {
 		logger.Error("Error creating request:", "error", err)
 		return
 	}
+	req.Header.Set("If-Match", seenTaskETag(ids[0]))
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
@@ -242,23 +468,196 @@ func handleDelete(args []string) {
 	defer safeClose(resp.Body)
 
 	if resp.StatusCode == http.StatusOK {
+		delete(seenTaskVersions, ids[0])
 		fmt.Printf("Task %s deleted successfully for user %s.\n", id, userName)
+	} else if resp.StatusCode == http.StatusPreconditionFailed {
+		fmt.Printf("Task %s was changed by someone else; check it with 'get %s' and try again.\n", id, id)
 	} else {
 		fmt.Printf("Failed to delete task %s: %s\n", id, resp.Status)
 	}
 }
 
+// parseTaskIDs reads task IDs given as single numbers or inclusive ranges such as
+// "10-20", dropping duplicates while keeping their order.
+func parseTaskIDs(args []string) ([]int, error) {
+	var ids []int
+	seen := make(map[int]bool)
+
+	for _, arg := range args {
+		first, last := arg, arg
+		if from, to, isRange := strings.Cut(arg, "-"); isRange {
+			first, last = from, to
+		}
+
+		start, err := strconv.Atoi(first)
+		if err != nil || start <= 0 {
+			return nil, fmt.Errorf("invalid task ID %q", arg)
+		}
+		end, err := strconv.Atoi(last)
+		if err != nil || end < start {
+			return nil, fmt.Errorf("invalid task ID range %q", arg)
+		}
+		if end-start >= maxBatchOps {
+			return nil, fmt.Errorf("range %q is too large; at most %d tasks can be changed at once", arg, maxBatchOps)
+		}
+
+		for id := start; id <= end; id++ {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	if len(ids) > maxBatchOps {
+		return nil, fmt.Errorf("at most %d tasks can be changed at once", maxBatchOps)
+	}
+	return ids, nil
+}
+
+// runTaskBatch completes or deletes several tasks in one request. It sends the
+// versions from a fresh task list, so nothing changed in the meantime is overwritten.
+func runTaskBatch(op string, ids []int, userName string) {
+	req := batchRequest{Operations: make([]BatchOp, len(ids))}
+	for i, id := range ids {
+		req.Operations[i] = BatchOp{Op: op, ID: id, Version: seenTaskVersions[id]} // 0 skips the check
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		logger.Error("Failed to encode batch", "error", err)
+		return
+	}
+
+	resp, err := http.Post(apiURL("/tasks/batch", userName), "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.Error("Failed to send batch", "error", err)
+		return
+	}
+	defer safeClose(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		var errResp errorResponse
+		if json.NewDecoder(resp.Body).Decode(&errResp) != nil || errResp.Error == "" {
+			errResp.Error = resp.Status
+		}
+		fmt.Printf("Nothing was changed: %s\n", errResp.Error)
+		return
+	}
+
+	var result batchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err == nil {
+		for _, task := range result.Results {
+			rememberTaskVersion(task.ID, task.Version)
+		}
+	}
+
+	verb := "Completed"
+	if op == batchOpDelete {
+		verb = "Deleted"
+		for _, id := range ids {
+			delete(seenTaskVersions, id)
+		}
+	}
+	fmt.Printf("%s %d tasks for user %s.\n", verb, len(ids), userName)
+}
+
+// seenTaskVersions holds the version of each task as the CLI last showed it with list,
+// get or search. complete and delete send it back in If-Match, so they fail instead of
+// overwriting a change the user has not seen. Tasks not shown yet are changed as they are.
+var seenTaskVersions = make(map[int]int)
+
+func rememberTaskVersion(id, version int) {
+	seenTaskVersions[id] = version
+}
+
+// rememberTaskETag records the version in an ETag returned for a change made by the CLI.
+func rememberTaskETag(id int, etag string) {
+	if version, err := strconv.Atoi(strings.Trim(etag, `"`)); err == nil {
+		rememberTaskVersion(id, version)
+	}
+}
+
+// seenTaskETag returns the If-Match value for a task: its version as last shown, or *.
+func seenTaskETag(id int) string {
+	if version, ok := seenTaskVersions[id]; ok && version > 0 {
+		return taskETag(Task{Version: version})
+	}
+	return "*"
+}
+
+// handleSnapshot downloads a snapshot of all data through the admin API and saves it.
+func handleSnapshot(args []string) {
+	if len(args) > 1 {
+		fmt.Println("Usage: snapshot [file]")
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodGet, apiBaseURL+"/admin/snapshot", nil)
+	if err != nil {
+		logger.Error("Failed to create snapshot request", "error", err)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("TODO_ADMIN_TOKEN"))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		logger.Error("Failed to take snapshot", "error", err)
+		return
+	}
+	defer safeClose(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		fmt.Printf("Snapshot failed: %s\n", strings.TrimSpace(string(body)))
+		return
+	}
+
+	fileName := snapshotFileName(time.Now())
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		fileName = filepath.Base(params["filename"])
+	}
+	if len(args) == 1 {
+		fileName = args[0]
+	}
+
+	err = writeFileAtomic(fileName, 0, func(w io.Writer) error {
+		_, err := io.Copy(w, resp.Body)
+		return err
+	})
+	if err != nil {
+		fmt.Println("Failed to save snapshot:", err)
+		return
+	}
+	fmt.Printf("Snapshot saved to %s.\n", fileName)
+}
+
 func printHelp() {
 	fmt.Println("Commands:")
 	fmt.Println("  add \"<title>\" \"<description>\"    Add a new task for the logged-in user")
-	fmt.Println("  list                                 List all tasks for the logged-in user")
-	fmt.Println("  complete <id>                       Mark a task as completed for the logged-in user")
-	fmt.Println("  delete <id>                         Delete a task for the logged-in user")
+	fmt.Println("  list [@view] [filter]                List tasks for the logged-in user, e.g. list @today or list status:open created:<7d")
+	fmt.Println("  views                                List your saved views")
+	fmt.Println("  save-view \"<name>\" <filter>          Save a filter as a view, e.g. save-view \"Today\" status:open created:<1d")
+	fmt.Println("  delete-view @<view>                  Delete a saved view")
+	fmt.Println("  search <words>                       Search tasks; \"quoted phrases\" and prefixes like rep* work")
+	fmt.Println("  complete <id>...                     Mark tasks as completed, e.g. complete 3 5 9")
+	fmt.Println("  delete <id>...                       Delete tasks, e.g. delete 10-20")
+	fmt.Println("  snapshot [file]                      Save a backup of all tasks and users (needs TODO_ADMIN_TOKEN)")
+	fmt.Println("  passwd                               Change the password of the logged-in user")
+	fmt.Println("  enable-2fa                           Enable two-factor authentication for the logged-in user")
+	fmt.Println("  delete-account                       Delete the logged-in user and all of their tasks")
 	fmt.Println("  help                                 Show this help message")
 	fmt.Println("  exit                                 Exit the program")
 	fmt.Println("  listUsers                            List all users")
 }
 
+const apiBaseURL = "http://localhost:8080" + apiPrefix
+
+// apiURL builds a REST API URL for path with the username passed as an escaped query parameter.
+func apiURL(path, userName string) string {
+	return apiBaseURL + path + "?" + neturl.Values{"username": {userName}}.Encode()
+}
+
 func toJSON(task Task) *strings.Reader {
 	data, _ := json.Marshal(task)
 	return strings.NewReader(string(data))
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Environment variables holding base64-encoded 256-bit keys
+const (
+	encryptionKeyEnv    = "TODO_ENCRYPTION_KEY"
+	newEncryptionKeyEnv = "TODO_NEW_ENCRYPTION_KEY" // Only read by rotate-key
+)
+
+var encryptionKeyFile = flag.String("encryption-key-file", "", "File with the base64 key used to encrypt data files (instead of $"+encryptionKeyEnv+")")
+
+// encryptionMagic starts every encrypted file and WAL record. It is followed by the
+// key ID, the nonce and the AES-GCM ciphertext.
+const encryptionMagic = "TODOENC1"
+
+const keyIDSize = 8
+
+var (
+	errNoEncryptionKey    = errors.New("data is encrypted, but no encryption key is configured")
+	errWrongEncryptionKey = errors.New("data was encrypted with a different key")
+	errDecryptionFailed   = errors.New("encrypted data failed authentication, it is corrupt or was modified")
+)
+
+// dataKey encrypts data files with AES-256-GCM. Its ID, a prefix of the key's hash,
+// is stored with the data so that a wrong key can be told apart from a damaged file.
+type dataKey struct {
+	aead cipher.AEAD
+	id   [keyIDSize]byte
+}
+
+// activeKey encrypts everything the stores write. When it is nil, files are written
+// in plain text. Plain-text files can always be read, so encryption can be turned on
+// for existing data.
+var activeKey *dataKey
+
+func initializeEncryption() {
+	key, err := loadEncryptionKey(*encryptionKeyFile, os.Getenv(encryptionKeyEnv))
+	if err != nil {
+		logger.Error("Failed to load encryption key", "error", err)
+		os.Exit(1)
+	}
+	activeKey = key
+
+	if key != nil {
+		logger.Info("Data files are encrypted", "key", key.ID())
+	}
+}
+
+// loadEncryptionKey reads a key from keyFile or, if no file is given, from envValue.
+// It returns nil when neither is set.
+func loadEncryptionKey(keyFile, envValue string) (*dataKey, error) {
+	if keyFile != "" {
+		raw, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		key, err := parseEncryptionKey(string(raw))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", keyFile, err)
+		}
+		return key, nil
+	}
+
+	if envValue == "" {
+		return nil, nil
+	}
+	return parseEncryptionKey(envValue)
+}
+
+func parseEncryptionKey(text string) (*dataKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(text))
+	if err != nil {
+		return nil, fmt.Errorf("encryption key is not valid base64: %w", err)
+	}
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("encryption key must be 32 bytes, got %d", len(raw))
+	}
+
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &dataKey{aead: aead}
+	sum := sha256.Sum256(raw)
+	copy(key.id[:], sum[:])
+	return key, nil
+}
+
+// ID identifies the key in logs and error messages without revealing it.
+func (key *dataKey) ID() string {
+	return hex.EncodeToString(key.id[:])
+}
+
+// sealData encrypts plain with key. A nil key returns plain unchanged.
+func sealData(key *dataKey, plain []byte) ([]byte, error) {
+	if key == nil {
+		return plain, nil
+	}
+
+	header := append([]byte(encryptionMagic), key.id[:]...)
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := append(header, nonce...)
+	return key.aead.Seal(sealed, nonce, plain, header), nil
+}
+
+// openData decrypts data sealed by sealData. Data that is not encrypted is returned
+// unchanged, whatever the key.
+func openData(key *dataKey, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(encryptionMagic)) {
+		return data, nil
+	}
+	if key == nil {
+		return nil, errNoEncryptionKey
+	}
+
+	headerSize := len(encryptionMagic) + keyIDSize
+	if len(data) < headerSize+key.aead.NonceSize() {
+		return nil, errDecryptionFailed
+	}
+
+	header := data[:headerSize]
+	if fileKeyID := header[len(encryptionMagic):]; !bytes.Equal(fileKeyID, key.id[:]) {
+		return nil, fmt.Errorf("%w (data key %s, configured key %s)", errWrongEncryptionKey, hex.EncodeToString(fileKeyID), key.ID())
+	}
+
+	nonce := data[headerSize : headerSize+key.aead.NonceSize()]
+	plain, err := key.aead.Open(nil, nonce, data[headerSize+key.aead.NonceSize():], header)
+	if err != nil {
+		return nil, errDecryptionFailed
+	}
+	return plain, nil
+}
+
+// isKeyError reports whether err means the configured key cannot read the data, as
+// opposed to the data being damaged.
+func isKeyError(err error) bool {
+	return errors.Is(err, errNoEncryptionKey) || errors.Is(err, errWrongEncryptionKey)
+}
+
+// readDataFile reads filePath and decrypts it with the active key.
+func readDataFile(filePath string) ([]byte, error) {
+	raw, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err := openData(activeKey, raw)
+	if isKeyError(err) {
+		return nil, fmt.Errorf("%s: %w; set $%s or -encryption-key-file to the key it was written with", filePath, err, encryptionKeyEnv)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filePath, err)
+	}
+	return plain, nil
+}
+
+// encryptWith wraps a writer function for writeFileAtomic so that its output is
+// encrypted with key.
+func encryptWith(key *dataKey, write func(w io.Writer) error) func(w io.Writer) error {
+	if key == nil {
+		return write
+	}
+
+	return func(w io.Writer) error {
+		var plain bytes.Buffer
+		if err := write(&plain); err != nil {
+			return err
+		}
+		sealed, err := sealData(key, plain.Bytes())
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(sealed)
+		return err
+	}
+}
+
+// sealLine encrypts one line of a line-based file such as the WAL. The result is
+// base64, so it never contains a newline. A nil key returns line unchanged.
+func sealLine(key *dataKey, line []byte) ([]byte, error) {
+	if key == nil {
+		return line, nil
+	}
+
+	sealed, err := sealData(key, line)
+	if err != nil {
+		return nil, err
+	}
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(sealed)))
+	base64.StdEncoding.Encode(encoded, sealed)
+	return encoded, nil
+}
+
+// openLine reverses sealLine. Plain JSON lines are returned unchanged.
+func openLine(key *dataKey, line []byte) ([]byte, error) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 || line[0] == '{' {
+		return line, nil
+	}
+
+	sealed := make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+	n, err := base64.StdEncoding.Decode(sealed, line)
+	if err != nil || !bytes.HasPrefix(sealed[:n], []byte(encryptionMagic)) {
+		return nil, errDecryptionFailed
+	}
+	return openData(key, sealed[:n])
+}
+
+// defaultDataFiles are the files rotate-key handles when none are named.
+var defaultDataFiles = []string{"users.json", "tasks.json", "tasks.wal", "tasks.snapshot.json", "tasks.d"}
+
+// expandDataFiles lists the existing files behind paths: each file with its backups,
+// and for a directory of the sharded store, every user file with its backups.
+func expandDataFiles(paths []string) ([]string, error) {
+	var files []string
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		bases := []string{path}
+		if info.IsDir() {
+			if bases, err = filepath.Glob(filepath.Join(path, "users", "*.json")); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, base := range bases {
+			files = append(files, base)
+			related, err := filepath.Glob(base + ".*")
+			if err != nil {
+				return nil, err
+			}
+			sort.Strings(related)
+			for _, file := range related {
+				// Leftovers of interrupted writes, corrupt files and locks are not data
+				if !strings.Contains(file, ".tmp-") && !strings.Contains(file, ".corrupt-") && !strings.HasSuffix(file, ".lock") {
+					files = append(files, file)
+				}
+			}
+		}
+	}
+
+	return files, nil
+}
+
+// reencryptFile decrypts data read from filePath with oldKey and encrypts it with
+// newKey. WAL files are handled line by line; an incomplete last line is kept as is,
+// since replay discards it anyway.
+func reencryptFile(filePath string, data []byte, oldKey, newKey *dataKey) ([]byte, error) {
+	if !strings.HasSuffix(filePath, ".wal") {
+		plain, err := openData(oldKey, data)
+		if err != nil {
+			return nil, err
+		}
+		return sealData(newKey, plain)
+	}
+
+	var out bytes.Buffer
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n')
+		if end < 0 {
+			out.Write(data)
+			break
+		}
+
+		plain, err := openLine(oldKey, data[:end])
+		if err != nil {
+			return nil, err
+		}
+		line, err := sealLine(newKey, plain)
+		if err != nil {
+			return nil, err
+		}
+		out.Write(line)
+		out.WriteByte('\n')
+		data = data[end+1:]
+	}
+	return out.Bytes(), nil
+}
+
+// rotateKeys re-encrypts files from oldKey to newKey. Every file is decrypted before
+// the first one is written, so a wrong key or a damaged file changes nothing. A nil
+// oldKey reads plain-text files; a nil newKey writes them in plain text.
+func rotateKeys(files []string, oldKey, newKey *dataKey) error {
+	rewritten := make([][]byte, len(files))
+	for i, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if rewritten[i], err = reencryptFile(file, data, oldKey, newKey); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	}
+
+	for i, file := range files {
+		data := rewritten[i]
+		err := writeFileAtomic(file, 0, func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w (files before it already use the new key)", file, err)
+		}
+	}
+	return nil
+}
+
+// lockDataFiles takes the lock a running server holds on each of the files and
+// sharded store directories among paths, so keys are not rotated under it. It fails
+// without holding any lock if one is taken.
+func lockDataFiles(paths []string) ([]*dataFileLock, error) {
+	var locks []*dataFileLock
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		var lock *dataFileLock
+		if err == nil && info.IsDir() {
+			lock, err = lockDataDir(path)
+		} else {
+			lock, err = lockDataFile(path)
+		}
+		if err != nil {
+			unlockDataFiles(locks)
+			return nil, err
+		}
+		locks = append(locks, lock)
+	}
+	return locks, nil
+}
+
+func unlockDataFiles(locks []*dataFileLock) {
+	for _, lock := range locks {
+		_ = lock.Unlock()
+	}
+}
+
+// runRotateKey implements the "rotate-key" subcommand and returns the process exit code.
+func runRotateKey(args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("rotate-key", flag.ContinueOnError)
+	flags.SetOutput(out)
+	keyFile := flags.String("key-file", "", "File with the current key (defaults to $"+encryptionKeyEnv+"; none for plain-text files)")
+	newKeyFile := flags.String("new-key-file", "", "File with the new key (defaults to $"+newEncryptionKeyEnv+")")
+	decrypt := flags.Bool("decrypt", false, "Write the files in plain text instead of encrypting them with a new key")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	oldKey, err := loadEncryptionKey(*keyFile, os.Getenv(encryptionKeyEnv))
+	if err != nil {
+		_, _ = fmt.Fprintln(out, "Current key:", err)
+		return 2
+	}
+
+	var newKey *dataKey
+	if !*decrypt {
+		if newKey, err = loadEncryptionKey(*newKeyFile, os.Getenv(newEncryptionKeyEnv)); err != nil {
+			_, _ = fmt.Fprintln(out, "New key:", err)
+			return 2
+		}
+		if newKey == nil {
+			_, _ = fmt.Fprintln(out, "Usage: rotate-key [-key-file=...] (-new-key-file=... | -decrypt) [files...]")
+			return 2
+		}
+	}
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = defaultDataFiles
+	}
+	locks, err := lockDataFiles(paths)
+	if err != nil {
+		_, _ = fmt.Fprintln(out, err)
+		return 1
+	}
+	defer unlockDataFiles(locks)
+
+	files, err := expandDataFiles(paths)
+	if err != nil {
+		_, _ = fmt.Fprintln(out, err)
+		return 1
+	}
+	if len(files) == 0 {
+		_, _ = fmt.Fprintln(out, "No data files found.")
+		return 1
+	}
+
+	if err := rotateKeys(files, oldKey, newKey); err != nil {
+		_, _ = fmt.Fprintln(out, "Key rotation failed:", err)
+		return 1
+	}
+
+	if newKey == nil {
+		_, _ = fmt.Fprintf(out, "Decrypted %d files.\n", len(files))
+	} else {
+		_, _ = fmt.Fprintf(out, "Encrypted %d files with key %s. Set the new key before starting the server.\n", len(files), newKey.ID())
+	}
+	return 0
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestKey(t *testing.T) *dataKey {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		t.Fatal(err)
+	}
+	key, err := parseEncryptionKey(base64.StdEncoding.EncodeToString(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// useKey makes key the active key for the rest of the test.
+func useKey(t *testing.T, key *dataKey) {
+	previous := activeKey
+	activeKey = key
+	t.Cleanup(func() { activeKey = previous })
+}
+
+func TestEncryptedStoresKeepNoPlainText(t *testing.T) {
+	dir := t.TempDir()
+	useKey(t, newTestKey(t))
+
+	jsonStore := newTestJSONStore(t, filepath.Join(dir, "tasks.json"))
+	mustAddTask(t, jsonStore, "alice", "Call ACME Corp", "")
+	walStore := newTestWALStore(t, dir, 0)
+	mustAddTask(t, walStore, "alice", "Call ACME Corp", "")
+
+	for _, file := range []string{"tasks.json", "tasks.wal"} {
+		raw, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(raw, []byte("ACME")) {
+			t.Errorf("Expected %s to be encrypted, got %s", file, raw)
+		}
+	}
+
+	closeTaskStore(jsonStore)
+	crashWALStore(walStore)
+	if tasks := mustListTasks(t, newTestJSONStore(t, filepath.Join(dir, "tasks.json")), "alice"); len(tasks) != 1 {
+		t.Errorf("Expected the JSON store to read its encrypted file, got %d tasks", len(tasks))
+	}
+	if tasks := mustListTasks(t, newTestWALStore(t, dir, 0), "alice"); len(tasks) != 1 {
+		t.Errorf("Expected the WAL store to replay its encrypted log, got %d tasks", len(tasks))
+	}
+}
+
+func TestWrongKeyIsReportedAndFileIsKept(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "tasks.json")
+	useKey(t, newTestKey(t))
+	if err := writeDataFile(filePath, schemaKindTasks, 3, map[string]map[int]Task{}); err != nil {
+		t.Fatal(err)
+	}
+
+	activeKey = newTestKey(t)
+	var tasks map[string]map[int]Task
+	if err := loadJSONFileWithRecovery(filePath, schemaKindTasks, 3, &tasks); !errors.Is(err, errWrongEncryptionKey) {
+		t.Errorf("Expected a wrong key error, got %v", err)
+	}
+
+	activeKey = nil
+	if err := loadJSONFileWithRecovery(filePath, schemaKindTasks, 3, &tasks); !errors.Is(err, errNoEncryptionKey) {
+		t.Errorf("Expected a missing key error, got %v", err)
+	}
+
+	if matches, _ := filepath.Glob(filePath + ".corrupt-*"); len(matches) > 0 {
+		t.Errorf("Expected a file with another key not to be treated as corrupt, found %v", matches)
+	}
+}
+
+func TestTamperedEncryptedFileIsRecoveredFromBackup(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "users.json")
+	useKey(t, newTestKey(t))
+	for _, name := range []string{"alice", "bob"} {
+		if err := writeDataFile(filePath, schemaKindUsers, 3, map[string]User{name: {Username: name}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	raw, _ := os.ReadFile(filePath)
+	raw[len(raw)-1] ^= 0xff
+	if err := os.WriteFile(filePath, raw, 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	var users map[string]User
+	if err := loadJSONFileWithRecovery(filePath, schemaKindUsers, 3, &users); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := users["alice"]; !exists {
+		t.Errorf("Expected the previous version to be restored from backup, got %v", users)
+	}
+}
+
+func TestRotateKeysReencryptsDataFiles(t *testing.T) {
+	dir := t.TempDir()
+	oldKey, newKey := newTestKey(t), newTestKey(t)
+	useKey(t, oldKey)
+
+	jsonStore := newTestJSONStore(t, filepath.Join(dir, "tasks.json"))
+	mustAddTask(t, jsonStore, "alice", "First", "")
+	closeTaskStore(jsonStore)
+	walStore := newTestWALStore(t, dir, 0)
+	mustAddTask(t, walStore, "bob", "Second", "")
+	crashWALStore(walStore)
+
+	files, err := expandDataFiles([]string{filepath.Join(dir, "tasks.json"), filepath.Join(dir, "tasks.wal")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rotateKeys(files, newKey, newTestKey(t)); !errors.Is(err, errWrongEncryptionKey) {
+		t.Fatalf("Expected rotation with the wrong current key to fail, got %v", err)
+	}
+	if err := rotateKeys(files, oldKey, newKey); err != nil {
+		t.Fatal(err)
+	}
+
+	activeKey = newKey
+	if tasks := mustListTasks(t, newTestJSONStore(t, filepath.Join(dir, "tasks.json")), "alice"); len(tasks) != 1 {
+		t.Errorf("Expected alice's task to be readable with the new key, got %d", len(tasks))
+	}
+	if tasks := mustListTasks(t, newTestWALStore(t, dir, 0), "bob"); len(tasks) != 1 {
+		t.Errorf("Expected bob's task to be readable with the new key, got %d", len(tasks))
+	}
+}
+
+func TestRotateKeyRefusesFilesInUse(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(encryptionKeyEnv, "")
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "new.key")
+	if err := os.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(raw)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tasksPath := filepath.Join(dir, "tasks.json")
+	args := []string{"-new-key-file=" + keyFile, tasksPath}
+
+	store := newTestJSONStore(t, tasksPath)
+	mustAddTask(t, store, "alice", "First", "")
+	before, err := os.ReadFile(tasksPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if code := runRotateKey(args, &out); code != 1 || !bytes.Contains(out.Bytes(), []byte("stop it first")) {
+		t.Errorf("Expected rotation to be refused while the store is open, got %d %q", code, out.String())
+	}
+	if after, _ := os.ReadFile(tasksPath); !bytes.Equal(before, after) {
+		t.Error("Expected the file in use to be left alone")
+	}
+
+	for _, backend := range []string{"wal", "sharded"} {
+		path := filepath.Join(dir, taskStoreBackends[backend].defaultPath)
+		open, err := openTaskStoreAt(backend, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mustAddTask(t, open, "alice", "First", "")
+		out.Reset()
+		if code := runRotateKey([]string{"-new-key-file=" + keyFile, path}, &out); code != 1 || !bytes.Contains(out.Bytes(), []byte("stop it first")) {
+			t.Errorf("Expected rotation to be refused while the %s store is open, got %d %q", backend, code, out.String())
+		}
+		closeTaskStore(open)
+	}
+
+	closeTaskStore(store)
+	out.Reset()
+	if code := runRotateKey(args, &out); code != 0 {
+		t.Errorf("Expected rotation to work once the store is closed, got %d %q", code, out.String())
+	}
+}
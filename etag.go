@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var errPreconditionRequired = errors.New("If-Match header is required")
+
+// taskETag returns the entity tag for one task, which is its version.
+func taskETag(task Task) string {
+	return `"` + strconv.Itoa(task.Version) + `"`
+}
+
+// listETag returns an entity tag for a task list. It changes whenever a task is added,
+// removed or modified, because every change bumps the task's version.
+func listETag(tasks []Task) string {
+	return `"` + digestTasks(tasks).Checksum[:32] + `"`
+}
+
+// ifMatchVersion reads the task version a client expects from the If-Match header.
+// "*" matches any version and is returned as 0. A tag that is not a task version can
+// never match and is returned as -1.
+func ifMatchVersion(r *http.Request) (int, error) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" {
+		return 0, errPreconditionRequired
+	}
+	if header == "*" {
+		return 0, nil
+	}
+
+	version, err := strconv.Atoi(strings.Trim(header, `"`))
+	if err != nil || version <= 0 || !strings.HasPrefix(header, `"`) || !strings.HasSuffix(header, `"`) {
+		return -1, nil
+	}
+	return version, nil
+}
+
+// noneMatch reports whether an If-None-Match header lets the request proceed, i.e.
+// none of the listed tags (compared weakly, as RFC 9110 requires) equals etag.
+func noneMatch(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return true
+	}
+
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return false
+		}
+	}
+	return true
+}
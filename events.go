@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Task events published after a mutation succeeded
+const (
+	TaskAdded     = "task.added"
+	TaskCompleted = "task.completed"
+	TaskUpdated   = "task.updated"
+	TaskDeleted   = "task.deleted"
+)
+
+// TaskEvent describes one change to a task. Before is nil for TaskAdded and After
+// is nil for TaskDeleted. Before is also nil while no subscriber needs it, see
+// SubscribeAfter.
+type TaskEvent struct {
+	Type     string    `json:"type"`
+	UserName string    `json:"username"`
+	TaskID   int       `json:"task_id"`
+	Before   *Task     `json:"before,omitempty"`
+	After    *Task     `json:"after,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// taskEvents carries the events of the task store the program runs with.
+var taskEvents = newEventBus()
+
+// EventBus delivers task events to every subscriber, each in the order they were
+// published. Publishing never waits for a subscriber: events for a subscriber
+// whose buffer is full are dropped and logged.
+type EventBus struct {
+	mutex       sync.Mutex
+	subscribers map[*Subscription]struct{}
+}
+
+// Subscription receives events from an EventBus until it is closed.
+type Subscription struct {
+	bus     *EventBus
+	events  chan TaskEvent
+	before  bool // Needs the state before each change
+	closed  sync.Once
+	dropped atomic.Uint64
+}
+
+func newEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[*Subscription]struct{})}
+}
+
+// Subscribe starts receiving events, buffering up to buffer of them.
+func (bus *EventBus) Subscribe(buffer int) *Subscription {
+	return bus.subscribe(buffer, true)
+}
+
+// SubscribeAfter is Subscribe for subscribers that only need the state after each
+// change. While all subscribers are like that, events have no Before, which spares
+// the task store a read before every change.
+func (bus *EventBus) SubscribeAfter(buffer int) *Subscription {
+	return bus.subscribe(buffer, false)
+}
+
+func (bus *EventBus) subscribe(buffer int, before bool) *Subscription {
+	sub := &Subscription{bus: bus, events: make(chan TaskEvent, buffer), before: before}
+
+	bus.mutex.Lock()
+	bus.subscribers[sub] = struct{}{}
+	bus.mutex.Unlock()
+
+	return sub
+}
+
+// wants reports whether anyone subscribes, and whether anyone needs Before.
+func (bus *EventBus) wants() (events, before bool) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	for sub := range bus.subscribers {
+		if sub.before {
+			return true, true
+		}
+		events = true
+	}
+	return events, false
+}
+
+// Publish hands event to every subscriber.
+func (bus *EventBus) Publish(event TaskEvent) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	for sub := range bus.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+			sub.dropped.Add(1)
+			logger.Warn("Dropping task event for a slow subscriber", "type", event.Type, "user", event.UserName, "taskID", event.TaskID)
+		}
+	}
+}
+
+// Events returns the channel events arrive on. It is closed by Close.
+func (sub *Subscription) Events() <-chan TaskEvent {
+	return sub.events
+}
+
+// Dropped returns how many events the subscription missed because its buffer was full.
+func (sub *Subscription) Dropped() uint64 {
+	return sub.dropped.Load()
+}
+
+// Close stops the subscription; events still buffered can be read until the channel ends.
+func (sub *Subscription) Close() {
+	sub.closed.Do(func() {
+		sub.bus.mutex.Lock()
+		delete(sub.bus.subscribers, sub)
+		sub.bus.mutex.Unlock()
+		close(sub.events)
+	})
+}
+
+// eventTaskStoreStripes bounds the number of locks used to order each user's mutations.
+const eventTaskStoreStripes = 64
+
+// eventTaskStore publishes an event for every successful mutation of the wrapped
+// store. Mutations of the same user are serialized, so Before is exactly the state
+// the mutation changed and events arrive in the order the changes were made.
+//
+// Changes that do not go through the store, such as edits merged from the JSON
+// file, publish no events.
+type eventTaskStore struct {
+	next    TaskStore
+	bus     *EventBus
+	now     func() time.Time
+	stripes [eventTaskStoreStripes]sync.Mutex
+}
+
+func newEventTaskStore(next TaskStore, bus *EventBus) *eventTaskStore {
+	return &eventTaskStore{next: next, bus: bus, now: time.Now}
+}
+
+// lockUser serializes the mutations of userName and returns the unlock function.
+func (store *eventTaskStore) lockUser(userName string) func() {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(userName))
+	stripe := &store.stripes[hash.Sum32()%eventTaskStoreStripes]
+	stripe.Lock()
+	return stripe.Unlock
+}
+
+func (store *eventTaskStore) publish(eventType, userName string, id int, before, after *Task) {
+	store.bus.Publish(TaskEvent{Type: eventType, UserName: userName, TaskID: id, Before: before, After: after, Time: store.now()})
+}
+
+// previous reads a task before it is changed, if a subscriber needs the state before
+// the change.
+func (store *eventTaskStore) previous(ctx context.Context, userName string, id int) *Task {
+	if _, before := store.bus.wants(); !before {
+		return nil
+	}
+	task, err := store.next.GetTask(ctx, userName, id)
+	if err != nil {
+		return nil // The change fails as well and publishes nothing
+	}
+	return &task
+}
+
+func (store *eventTaskStore) AddTask(ctx context.Context, userName, title string, description string) (Task, error) {
+	defer store.lockUser(userName)()
+
+	task, err := store.next.AddTask(ctx, userName, title, description)
+	if err != nil {
+		return Task{}, err
+	}
+	store.publish(TaskAdded, userName, task.ID, nil, &task)
+	return task, nil
+}
+
+func (store *eventTaskStore) RemoveTask(ctx context.Context, userName string, id int, version int) error {
+	defer store.lockUser(userName)()
+
+	before := store.previous(ctx, userName, id)
+	if err := store.next.RemoveTask(ctx, userName, id, version); err != nil {
+		return err
+	}
+	store.publish(TaskDeleted, userName, id, before, nil)
+	return nil
+}
+
+func (store *eventTaskStore) CompleteTask(ctx context.Context, userName string, id int, version int) (Task, error) {
+	defer store.lockUser(userName)()
+
+	before := store.previous(ctx, userName, id)
+	after, err := store.next.CompleteTask(ctx, userName, id, version)
+	if err != nil {
+		return Task{}, err
+	}
+	store.publish(TaskCompleted, userName, id, before, &after)
+	return after, nil
+}
+
+func (store *eventTaskStore) UpdateTask(ctx context.Context, userName string, id int, version int, update TaskUpdate) (Task, error) {
+	defer store.lockUser(userName)()
+
+	before := store.previous(ctx, userName, id)
+	after, err := store.next.UpdateTask(ctx, userName, id, version, update)
+	if err != nil {
+		return Task{}, err
+	}
+	store.publish(TaskUpdated, userName, id, before, &after)
+	return after, nil
+}
+
+func (store *eventTaskStore) RemoveUserTasks(ctx context.Context, userName string) error {
+	defer store.lockUser(userName)()
+
+	if events, _ := store.bus.wants(); !events {
+		return store.next.RemoveUserTasks(ctx, userName)
+	}
+
+	tasks, err := store.next.ListTasks(ctx, userName)
+	if err != nil {
+		return err
+	}
+	if err := store.next.RemoveUserTasks(ctx, userName); err != nil {
+		return err
+	}
+	for i := range tasks {
+		store.publish(TaskDeleted, userName, tasks[i].ID, &tasks[i], nil)
+	}
+	return nil
+}
+
+func (store *eventTaskStore) ImportTasks(ctx context.Context, userName string, tasks []Task) error {
+	defer store.lockUser(userName)()
+
+	if err := store.next.ImportTasks(ctx, userName, tasks); err != nil {
+		return err
+	}
+	for _, task := range importedTasks(tasks) {
+		store.publish(TaskAdded, userName, task.ID, nil, &task)
+	}
+	return nil
+}
+
+// ApplyBatch publishes one event per operation, in the order of the batch, once
+// the whole batch has been applied.
+func (store *eventTaskStore) ApplyBatch(ctx context.Context, userName string, ops []BatchOp) ([]Task, error) {
+	defer store.lockUser(userName)()
+
+	// The state each operation starts from: the store's for the first operation on a
+	// task, the previous operation's result after that
+	current := make(map[int]Task)
+	_, wantBefore := store.bus.wants()
+	for _, op := range ops {
+		if op.Op == batchOpAdd || !wantBefore {
+			continue
+		}
+		if _, seen := current[op.ID]; seen {
+			continue
+		}
+		if task, err := store.next.GetTask(ctx, userName, op.ID); err == nil {
+			current[op.ID] = task
+		}
+	}
+
+	results, err := store.next.ApplyBatch(ctx, userName, ops)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, op := range ops {
+		result := results[i]
+		before, known := current[result.ID]
+		switch op.Op {
+		case batchOpAdd:
+			store.publish(TaskAdded, userName, result.ID, nil, &result)
+		case batchOpComplete, batchOpUpdate:
+			eventType := TaskUpdated
+			if op.Op == batchOpComplete {
+				eventType = TaskCompleted
+			}
+			if known && wantBefore {
+				store.publish(eventType, userName, result.ID, &before, &result)
+			} else {
+				store.publish(eventType, userName, result.ID, nil, &result)
+			}
+		case batchOpDelete:
+			store.publish(TaskDeleted, userName, result.ID, &result, nil)
+		}
+		if op.Op == batchOpDelete {
+			delete(current, result.ID)
+		} else {
+			current[result.ID] = result
+		}
+	}
+	return results, nil
+}
+
+func (store *eventTaskStore) ListTasks(ctx context.Context, userName string) ([]Task, error) {
+	return store.next.ListTasks(ctx, userName)
+}
+
+func (store *eventTaskStore) QueryTasks(ctx context.Context, userName string, query TaskQuery) (TaskPage, error) {
+	return store.next.QueryTasks(ctx, userName, query)
+}
+
+func (store *eventTaskStore) GetTask(ctx context.Context, userName string, id int) (Task, error) {
+	return store.next.GetTask(ctx, userName, id)
+}
+
+func (store *eventTaskStore) ListUserNames(ctx context.Context) ([]string, error) {
+	return store.next.ListUserNames(ctx)
+}
+
+func (store *eventTaskStore) SnapshotTasks(ctx context.Context) (map[string]map[int]Task, error) {
+	return store.next.SnapshotTasks(ctx)
+}
+
+// Close closes the wrapped store.
+func (store *eventTaskStore) Close() error {
+	if closer, ok := store.next.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
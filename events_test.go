@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// receiveEvents reads the n events expected to be buffered on sub.
+func receiveEvents(t *testing.T, sub *Subscription, n int) []TaskEvent {
+	t.Helper()
+	events := make([]TaskEvent, 0, n)
+	for len(events) < n {
+		select {
+		case event := <-sub.Events():
+			events = append(events, event)
+		default:
+			t.Fatalf("Expected %d events, got %+v", n, events)
+		}
+	}
+	return events
+}
+
+func TestEventStorePublishesMutations(t *testing.T) {
+	bus := newEventBus()
+	sub := bus.Subscribe(10)
+	defer sub.Close()
+	store := newEventTaskStore(localTaskStore(), bus)
+	ctx := context.Background()
+
+	task := mustAddTask(t, store, "alice", "First", "")
+	title := "Renamed"
+	if _, err := store.UpdateTask(ctx, "alice", task.ID, 0, TaskUpdate{Title: &title}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.CompleteTask(ctx, "alice", task.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RemoveTask(ctx, "alice", task.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RemoveTask(ctx, "alice", task.ID, 0); err == nil {
+		t.Fatal("Expected removing a missing task to fail")
+	}
+
+	events := receiveEvents(t, sub, 4)
+	for i, eventType := range []string{TaskAdded, TaskUpdated, TaskCompleted, TaskDeleted} {
+		if events[i].Type != eventType || events[i].UserName != "alice" || events[i].TaskID != task.ID {
+			t.Errorf("Event %d: expected %s for alice's task, got %+v", i, eventType, events[i])
+		}
+	}
+	if events[1].Before.Title != "First" || events[1].After.Title != "Renamed" {
+		t.Errorf("Expected the update's before and after, got %+v and %+v", events[1].Before, events[1].After)
+	}
+	if events[2].Before.Completed || !events[2].After.Completed {
+		t.Errorf("Expected completion to change the task, got %+v and %+v", events[2].Before, events[2].After)
+	}
+	if events[3].Before.Version != 3 || events[3].After != nil {
+		t.Errorf("Expected the deleted task as it was, got %+v", events[3])
+	}
+	if len(sub.Events()) != 0 {
+		t.Error("Expected no event for the failed removal")
+	}
+}
+
+func TestEventStorePublishesBatchInOrder(t *testing.T) {
+	bus := newEventBus()
+	sub := bus.Subscribe(10)
+	defer sub.Close()
+	store := newEventTaskStore(localTaskStore(), bus)
+	existing := mustAddTask(t, store, "alice", "Existing", "")
+	receiveEvents(t, sub, 1)
+
+	title := "Changed"
+	ops := []BatchOp{
+		{Op: batchOpAdd, Title: "New"},
+		{Op: batchOpUpdate, ID: existing.ID, Update: TaskUpdate{Title: &title}},
+		{Op: batchOpComplete, ID: existing.ID},
+		{Op: batchOpDelete, ID: existing.ID},
+	}
+	if _, err := store.ApplyBatch(context.Background(), "alice", ops); err != nil {
+		t.Fatal(err)
+	}
+
+	events := receiveEvents(t, sub, 4)
+	for i, eventType := range []string{TaskAdded, TaskUpdated, TaskCompleted, TaskDeleted} {
+		if events[i].Type != eventType {
+			t.Errorf("Event %d: expected %s, got %s", i, eventType, events[i].Type)
+		}
+	}
+	if events[2].Before.Title != "Changed" || events[2].Before.Completed {
+		t.Errorf("Expected completion to start from the batch's update, got %+v", events[2].Before)
+	}
+	if !events[3].Before.Completed {
+		t.Errorf("Expected the deleted task as the batch left it, got %+v", events[3].Before)
+	}
+}
+
+func TestEventBusDropsEventsForFullSubscriber(t *testing.T) {
+	bus := newEventBus()
+	slow := bus.Subscribe(1)
+	fast := bus.Subscribe(2)
+
+	bus.Publish(TaskEvent{Type: TaskAdded, TaskID: 1})
+	bus.Publish(TaskEvent{Type: TaskAdded, TaskID: 2})
+
+	if len(slow.Events()) != 1 || len(fast.Events()) != 2 {
+		t.Errorf("Expected 1 and 2 buffered events, got %d and %d", len(slow.Events()), len(fast.Events()))
+	}
+	if slow.Dropped() != 1 || fast.Dropped() != 0 {
+		t.Errorf("Expected only the slow subscriber to count a dropped event, got %d and %d", slow.Dropped(), fast.Dropped())
+	}
+
+	fast.Close()
+	bus.Publish(TaskEvent{Type: TaskAdded, TaskID: 3})
+	if count := len(receiveEvents(t, fast, 2)); count != 2 {
+		t.Errorf("Expected the buffered events after closing, got %d", count)
+	}
+	if _, open := <-fast.Events(); open {
+		t.Error("Expected the channel to be closed")
+	}
+}
+
+// readCountingStore counts the tasks read through GetTask and ListTasks.
+type readCountingStore struct {
+	TaskStore
+	reads int
+}
+
+func (store *readCountingStore) GetTask(ctx context.Context, userName string, id int) (Task, error) {
+	store.reads++
+	return store.TaskStore.GetTask(ctx, userName, id)
+}
+
+func (store *readCountingStore) ListTasks(ctx context.Context, userName string) ([]Task, error) {
+	store.reads++
+	return store.TaskStore.ListTasks(ctx, userName)
+}
+
+func TestEventStoreReadsBeforeOnlyWhenNeeded(t *testing.T) {
+	bus := newEventBus()
+	counting := &readCountingStore{TaskStore: localTaskStore()}
+	store := newEventTaskStore(counting, bus)
+	ctx := context.Background()
+
+	task := mustAddTask(t, store, "alice", "First", "")
+	if _, err := store.CompleteTask(ctx, "alice", task.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RemoveUserTasks(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if counting.reads != 0 {
+		t.Errorf("Expected no reads without subscribers, got %d", counting.reads)
+	}
+
+	sub := bus.SubscribeAfter(10)
+	defer sub.Close()
+	task = mustAddTask(t, store, "alice", "Second", "")
+	if err := store.RemoveTask(ctx, "alice", task.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if counting.reads != 0 {
+		t.Errorf("Expected no reads for a subscriber without Before, got %d", counting.reads)
+	}
+	events := receiveEvents(t, sub, 2)
+	if events[1].Type != TaskDeleted || events[1].TaskID != task.ID || events[1].Before != nil {
+		t.Errorf("Expected the deletion without Before, got %+v", events[1])
+	}
+
+	full := bus.Subscribe(10)
+	defer full.Close()
+	task = mustAddTask(t, store, "alice", "Third", "")
+	if _, err := store.CompleteTask(ctx, "alice", task.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if counting.reads != 1 {
+		t.Errorf("Expected one read for a subscriber with Before, got %d", counting.reads)
+	}
+	events = receiveEvents(t, full, 2)
+	if events[1].Before == nil || events[1].Before.Completed {
+		t.Errorf("Expected the task before completion, got %+v", events[1].Before)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var errFileLocked = errors.New("data file is in use by another process")
+
+// dataFileLock is an advisory lock that makes a process the only writer of a data
+// file. It lives in a separate filePath.lock file, because the data file itself is
+// replaced by a rename on every save.
+type dataFileLock struct {
+	file *os.File
+}
+
+// lockDataFile locks filePath for this process. It fails at once, naming the other
+// process, if the file is already locked.
+func lockDataFile(filePath string) (*dataFileLock, error) {
+	return lockPath(filePath, filePath+".lock")
+}
+
+// lockDataDir locks a directory of data files, such as the sharded store's, through
+// the file .lock inside it.
+func lockDataDir(dir string) (*dataFileLock, error) {
+	return lockPath(dir, filepath.Join(dir, ".lock"))
+}
+
+// lockPath locks the data at path through the lock file lockPath.
+func lockPath(path, lockPath string) (*dataFileLock, error) {
+	file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0664)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := flockExclusive(file); err != nil {
+		safeClose(file)
+		if errors.Is(err, errFileLocked) {
+			return nil, fmt.Errorf("%s: %w%s; stop it first", path, errFileLocked, lockHolder(lockPath))
+		}
+		return nil, err
+	}
+
+	// Record who holds the lock for the error message above
+	if err := file.Truncate(0); err == nil {
+		_, _ = file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return &dataFileLock{file: file}, nil
+}
+
+// lockHolder describes the process recorded in a lock file, if any.
+func lockHolder(lockPath string) string {
+	raw, err := os.ReadFile(lockPath)
+	if err != nil {
+		return ""
+	}
+	if pid := strings.TrimSpace(string(raw)); pid != "" {
+		return " (pid " + pid + ")"
+	}
+	return ""
+}
+
+// Unlock releases the lock. The lock file stays, so the next process can lock it.
+func (lock *dataFileLock) Unlock() error {
+	if err := funlock(lock.file); err != nil {
+		safeClose(lock.file)
+		return err
+	}
+	return lock.file.Close()
+}
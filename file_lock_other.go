@@ -0,0 +1,23 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+	"sync"
+)
+
+var warnNoFileLocks sync.Once
+
+// flockExclusive does nothing where flock is not available; the lock file is still
+// created, but a second process is not kept out.
+func flockExclusive(file *os.File) error {
+	warnNoFileLocks.Do(func() {
+		logger.Warn("File locking is not supported on this platform; do not run two instances on the same data files")
+	})
+	return nil
+}
+
+func funlock(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"reflect"
+	"sort"
+	"time"
+)
+
+var jsonWatchInterval = flag.Duration("json-watch-interval", 0, "How often the JSON store checks its file for changes made by other programs and merges them (0 disables watching)")
+
+// startWatching makes the store pick up changes other programs make to its file.
+// The file is checked every interval and before every change the store makes, and
+// edits are merged with the store's own state instead of replacing it.
+func (store *jsonTaskStore) startWatching(interval time.Duration) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	info, err := os.Stat(store.filePath)
+	if err != nil {
+		return err
+	}
+	store.watching = true
+	store.fileInfo = info
+	store.base = cloneTasks(store.tasks)
+
+	if interval > 0 {
+		go store.watchLoop(interval)
+	}
+	return nil
+}
+
+func (store *jsonTaskStore) watchLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-store.stop:
+			return
+		case <-ticker.C:
+			store.mutex.Lock()
+			store.mergeExternalChanges()
+			store.mutex.Unlock()
+		}
+	}
+}
+
+// mergeExternalChanges reloads the file if someone else changed it since the store
+// last read or wrote it. The caller holds the mutex. A file that cannot be read, for
+// example because an editor is halfway through saving it, is left for the next check.
+func (store *jsonTaskStore) mergeExternalChanges() {
+	if !store.watching {
+		return
+	}
+
+	info, err := os.Stat(store.filePath)
+	if err != nil {
+		logger.Warn("Cannot check task file for external changes", "file", store.filePath, "error", err)
+		return
+	}
+	if os.SameFile(info, store.fileInfo) && info.ModTime().Equal(store.fileInfo.ModTime()) && info.Size() == store.fileInfo.Size() {
+		return
+	}
+
+	theirs := make(map[string]map[int]Task)
+	if _, err := decodeDataFile(store.filePath, schemaKindTasks, &theirs); err != nil {
+		logger.Warn("Task file was changed externally but cannot be read, keeping the current tasks", "file", store.filePath, "error", err)
+		store.fileInfo = info
+		return
+	}
+	if theirs == nil {
+		theirs = make(map[string]map[int]Task)
+	}
+
+	merged := mergeTasks(store.base, store.tasks, theirs)
+	store.tasks = merged
+	store.idSeq, store.reusableIds = idStateFromTasks(merged)
+
+	if reflect.DeepEqual(merged, theirs) {
+		store.fileInfo = info
+		store.base = cloneTasks(merged)
+	} else if err := store.saveToFile(); err != nil {
+		// The merged state is only in memory until the next successful save
+		logger.Error("Failed to save merged task file", "file", store.filePath, "error", err)
+	}
+
+	logger.Info("Merged external changes to task file", "file", store.filePath)
+}
+
+// recordWrite remembers what the store last wrote, which is the base for merging
+// the next external change. The caller holds the mutex.
+func (store *jsonTaskStore) recordWrite(tasks map[string]map[int]Task) {
+	if !store.watching {
+		return
+	}
+
+	info, err := os.Stat(store.filePath)
+	if err != nil {
+		logger.Warn("Cannot check task file after saving", "file", store.filePath, "error", err)
+		return
+	}
+	store.fileInfo = info
+	store.base = cloneTasks(tasks)
+}
+
+// mergeTasks combines two copies of base that were changed independently. A task
+// changed on one side only takes that side's state. A task changed on both sides
+// keeps the higher version, preferring ours on a tie, and a deletion loses against
+// a change on the other side. If both sides added a task with the same ID for
+// different users, their task is given a new ID.
+func mergeTasks(base, ours, theirs map[string]map[int]Task) map[string]map[int]Task {
+	type taskKey struct {
+		userName string
+		id       int
+	}
+
+	var keys []taskKey
+	seen := make(map[taskKey]bool)
+	for _, side := range []map[string]map[int]Task{ours, theirs, base} {
+		for userName, userTasks := range side {
+			for id := range userTasks {
+				if key := (taskKey{userName, id}); !seen[key] {
+					seen[key] = true
+					keys = append(keys, key)
+				}
+			}
+		}
+	}
+
+	// Our tasks come first, so that on an ID clash it is theirs that moves
+	sort.Slice(keys, func(i, j int) bool {
+		_, iOurs := ours[keys[i].userName][keys[i].id]
+		_, jOurs := ours[keys[j].userName][keys[j].id]
+		if iOurs != jOurs {
+			return iOurs
+		}
+		if keys[i].id != keys[j].id {
+			return keys[i].id < keys[j].id
+		}
+		return keys[i].userName < keys[j].userName
+	})
+
+	merged := make(map[string]map[int]Task)
+	owners := make(map[int]string)
+	highestID := 0
+	var renumber []taskKey
+
+	for _, key := range keys {
+		baseTask, inBase := base[key.userName][key.id]
+		ourTask, inOurs := ours[key.userName][key.id]
+		theirTask, inTheirs := theirs[key.userName][key.id]
+
+		task, keep := ourTask, inOurs
+		switch {
+		case inOurs == inTheirs && ourTask == theirTask:
+		case inOurs == inBase && ourTask == baseTask:
+			task, keep = theirTask, inTheirs
+		case inTheirs == inBase && theirTask == baseTask:
+		case !inOurs || (inTheirs && theirTask.Version > ourTask.Version):
+			task, keep = theirTask, inTheirs
+		}
+		if !keep {
+			continue
+		}
+
+		if owner, taken := owners[key.id]; taken && owner != key.userName {
+			renumber = append(renumber, key)
+			continue
+		}
+
+		owners[key.id] = key.userName
+		if key.id > highestID {
+			highestID = key.id
+		}
+		if merged[key.userName] == nil {
+			merged[key.userName] = make(map[int]Task)
+		}
+		merged[key.userName][key.id] = task
+	}
+
+	for _, key := range renumber {
+		task := theirs[key.userName][key.id]
+		highestID++
+		task.ID = highestID
+		if merged[key.userName] == nil {
+			merged[key.userName] = make(map[int]Task)
+		}
+		merged[key.userName][task.ID] = task
+		logger.Warn("Task ID from external change is already used, assigning a new ID", "userName", key.userName, "id", key.id, "newID", task.ID)
+	}
+
+	return merged
+}
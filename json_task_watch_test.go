@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJSONStoreLocksItsFile(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "tasks.json")
+	store := newTestJSONStore(t, filePath)
+
+	if _, err := lockDataFile(filePath); !errors.Is(err, errFileLocked) {
+		t.Fatalf("Expected a second writer to be refused, got %v", err)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lock, err := lockDataFile(filePath)
+	if err != nil {
+		t.Fatalf("Expected the lock to be free after closing the store, got %v", err)
+	}
+	_ = lock.Unlock()
+}
+
+func TestMergeTasks(t *testing.T) {
+	base := map[string]map[int]Task{
+		"alice": {
+			1: {ID: 1, Title: "Unchanged", Version: 1},
+			2: {ID: 2, Title: "Edited by us", Version: 1},
+			3: {ID: 3, Title: "Edited by them", Version: 1},
+			4: {ID: 4, Title: "Deleted by them", Version: 1},
+			5: {ID: 5, Title: "Deleted by us, edited by them", Version: 1},
+		},
+	}
+	ours := map[string]map[int]Task{
+		"alice": {
+			1: {ID: 1, Title: "Unchanged", Version: 1},
+			2: {ID: 2, Title: "Ours", Version: 2},
+			3: {ID: 3, Title: "Edited by them", Version: 1},
+			4: {ID: 4, Title: "Deleted by them", Version: 1},
+			6: {ID: 6, Title: "Added by us", Version: 1},
+		},
+	}
+	theirs := map[string]map[int]Task{
+		"alice": {
+			1: {ID: 1, Title: "Unchanged", Version: 1},
+			2: {ID: 2, Title: "Edited by us", Version: 1},
+			3: {ID: 3, Title: "Theirs", Version: 2},
+			5: {ID: 5, Title: "Theirs", Version: 2},
+		},
+		"bob": {
+			6: {ID: 6, Title: "Added by them", Version: 1},
+		},
+	}
+
+	merged := mergeTasks(base, ours, theirs)
+
+	want := map[int]string{1: "Unchanged", 2: "Ours", 3: "Theirs", 5: "Theirs", 6: "Added by us"}
+	if len(merged["alice"]) != len(want) {
+		t.Errorf("Expected alice's tasks %v, got %+v", want, merged["alice"])
+	}
+	for id, title := range want {
+		if merged["alice"][id].Title != title {
+			t.Errorf("Expected task %d to be %q, got %+v", id, title, merged["alice"][id])
+		}
+	}
+	if task := merged["bob"][7]; task.Title != "Added by them" {
+		t.Errorf("Expected bob's task to move to a free ID, got %+v", merged["bob"])
+	}
+}
+
+func TestJSONStoreMergesExternalChanges(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "tasks.json")
+	store := newTestJSONStore(t, filePath)
+	first := mustAddTask(t, store, "alice", "First", "")
+	if err := store.startWatching(time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another program marks the task done and adds one for bob
+	external := map[string]map[int]Task{
+		"alice": {first.ID: {ID: first.ID, Title: "First", Completed: true, Version: 2}},
+		"bob":   {2: {ID: 2, Title: "Added by hand", Version: 1}},
+	}
+	if err := writeDataFile(filePath, schemaKindTasks, 0, external); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(mustListTasks(t, store, "bob")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the external change to be picked up")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if task, err := store.GetTask(context.Background(), "alice", first.ID); err != nil || !task.Completed {
+		t.Errorf("Expected alice's task to be completed by the external change, got %+v, %v", task, err)
+	}
+	if task := mustAddTask(t, store, "alice", "Second", ""); task.ID != 3 {
+		t.Errorf("Expected new IDs to account for external tasks, got %d", task.ID)
+	}
+
+	raw, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved map[string]map[int]Task
+	if _, err := decodeDataFile(filePath, schemaKindTasks, &saved); err != nil || len(saved["bob"]) != 1 || len(saved["alice"]) != 2 {
+		t.Errorf("Expected the file to keep the external and the new task, got %s", raw)
+	}
+}
@@ -11,3 +11,6 @@ var logger = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level:
 func InitializeLogger() {
 	logger.Info("Logger initialized")
 }
+
+// Audit logger for security-relevant events such as account lockouts
+var auditLogger = logger.With("log", "audit")
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	loginMaxUserFailures = flag.Int("login-max-attempts", 5, "Failed logins per username before a temporary lockout")
+	loginMaxIPFailures   = flag.Int("login-max-attempts-ip", 20, "Failed logins per client IP before a temporary lockout")
+	loginBaseDelay       = flag.Duration("login-backoff", time.Second, "Initial delay after a failed login, doubled on each further failure")
+	loginLockout         = flag.Duration("login-lockout", 15*time.Minute, "How long a username or IP stays locked out")
+)
+
+var loginLimiter = newLoginLimiter(defaultLoginLimiterConfig())
+
+type loginLimiterConfig struct {
+	MaxUserFailures int
+	MaxIPFailures   int
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutDuration time.Duration
+	ResetAfter      time.Duration // Failures older than this are forgotten
+	MaxEntries      int           // Usernames and IPs tracked each; the oldest are dropped beyond it
+}
+
+// loginPruneInterval is how often expired usernames and IPs are swept from the limiter.
+const loginPruneInterval = time.Minute
+
+func defaultLoginLimiterConfig() loginLimiterConfig {
+	return loginLimiterConfig{
+		MaxUserFailures: 5,
+		MaxIPFailures:   20,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Minute,
+		LockoutDuration: 15 * time.Minute,
+		ResetAfter:      time.Hour,
+		MaxEntries:      100000,
+	}
+}
+
+func initializeLoginLimiter() {
+	config := defaultLoginLimiterConfig()
+	config.MaxUserFailures = *loginMaxUserFailures
+	config.MaxIPFailures = *loginMaxIPFailures
+	config.BaseDelay = *loginBaseDelay
+	config.LockoutDuration = *loginLockout
+
+	loginLimiter = newLoginLimiter(config)
+}
+
+// loginThrottledError is returned while a username or client IP is backing off or locked out.
+type loginThrottledError struct {
+	RetryAfter time.Duration
+	Locked     bool
+}
+
+func (e *loginThrottledError) Error() string {
+	if e.Locked {
+		return fmt.Sprintf("too many failed login attempts, locked for %s", e.RetryAfter.Round(time.Second))
+	}
+	return fmt.Sprintf("too many failed login attempts, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+type loginAttempts struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+type LoginLimiter struct {
+	config    loginLimiterConfig
+	mutex     sync.Mutex
+	users     map[string]*loginAttempts
+	ips       map[string]*loginAttempts
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+func newLoginLimiter(config loginLimiterConfig) *LoginLimiter {
+	return &LoginLimiter{
+		config: config,
+		users:  make(map[string]*loginAttempts),
+		ips:    make(map[string]*loginAttempts),
+		now:    time.Now,
+	}
+}
+
+// Allow reports whether a login attempt may proceed for the given username and client IP.
+func (limiter *LoginLimiter) Allow(username, ip string) error {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := limiter.now()
+	var throttled *loginThrottledError
+
+	for _, wait := range []*loginThrottledError{
+		limiter.check(limiter.users, username, now),
+		limiter.check(limiter.ips, ip, now),
+	} {
+		if wait != nil && (throttled == nil || wait.RetryAfter > throttled.RetryAfter) {
+			throttled = wait
+		}
+	}
+
+	if throttled != nil {
+		return throttled
+	}
+	return nil
+}
+
+func (limiter *LoginLimiter) check(entries map[string]*loginAttempts, key string, now time.Time) *loginThrottledError {
+	entry, exists := entries[key]
+	if !exists {
+		return nil
+	}
+
+	if limiter.expired(entry, now) {
+		delete(entries, key)
+		return nil
+	}
+	if !entry.lockedUntil.IsZero() {
+		return &loginThrottledError{RetryAfter: entry.lockedUntil.Sub(now), Locked: true}
+	}
+
+	if retryAt := entry.lastFailure.Add(limiter.backoff(entry.failures)); now.Before(retryAt) {
+		return &loginThrottledError{RetryAfter: retryAt.Sub(now)}
+	}
+	return nil
+}
+
+// backoff doubles the base delay for every failure after the first, up to MaxDelay.
+func (limiter *LoginLimiter) backoff(failures int) time.Duration {
+	delay := limiter.config.BaseDelay
+	for i := 1; i < failures && delay < limiter.config.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > limiter.config.MaxDelay {
+		delay = limiter.config.MaxDelay
+	}
+	return delay
+}
+
+// expired reports whether an entry no longer limits anything: its lockout was served,
+// or its failures are old enough to be forgotten.
+func (limiter *LoginLimiter) expired(entry *loginAttempts, now time.Time) bool {
+	if !entry.lockedUntil.IsZero() {
+		return !now.Before(entry.lockedUntil)
+	}
+	return now.Sub(entry.lastFailure) > limiter.config.ResetAfter
+}
+
+// prune drops expired entries, so usernames and IPs that are not seen again do not
+// stay in memory.
+func (limiter *LoginLimiter) prune(now time.Time) {
+	for _, entries := range []map[string]*loginAttempts{limiter.users, limiter.ips} {
+		for key, entry := range entries {
+			if limiter.expired(entry, now) {
+				delete(entries, key)
+			}
+		}
+	}
+	limiter.lastPrune = now
+}
+
+// dropOldest removes the entry whose last failure is the oldest.
+func dropOldest(entries map[string]*loginAttempts) {
+	oldestKey := ""
+	var oldest *loginAttempts
+	for key, entry := range entries {
+		if oldest == nil || entry.lastFailure.Before(oldest.lastFailure) {
+			oldestKey, oldest = key, entry
+		}
+	}
+	delete(entries, oldestKey)
+}
+
+func (limiter *LoginLimiter) RecordFailure(username, ip string) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := limiter.now()
+	if now.Sub(limiter.lastPrune) >= loginPruneInterval {
+		limiter.prune(now)
+	}
+	limiter.fail(limiter.users, "username", username, limiter.config.MaxUserFailures, now)
+	limiter.fail(limiter.ips, "ip", ip, limiter.config.MaxIPFailures, now)
+}
+
+func (limiter *LoginLimiter) fail(entries map[string]*loginAttempts, kind, key string, maxFailures int, now time.Time) {
+	entry, exists := entries[key]
+	if !exists {
+		if limiter.config.MaxEntries > 0 && len(entries) >= limiter.config.MaxEntries {
+			limiter.prune(now)
+			if len(entries) >= limiter.config.MaxEntries {
+				dropOldest(entries)
+			}
+		}
+		entry = &loginAttempts{}
+		entries[key] = entry
+	}
+
+	entry.failures++
+	entry.lastFailure = now
+
+	if maxFailures > 0 && entry.failures >= maxFailures && entry.lockedUntil.IsZero() {
+		entry.lockedUntil = now.Add(limiter.config.LockoutDuration)
+		auditLogger.Warn("Login lockout", kind, key, "failures", entry.failures, "lockedUntil", entry.lockedUntil)
+	}
+}
+
+// RecordSuccess clears the username's failures. The IP counter is kept so a valid
+// account cannot be used to reset an attacker's budget.
+func (limiter *LoginLimiter) RecordSuccess(username string) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	delete(limiter.users, username)
+}
+
+// authenticate checks a password through the login limiter.
+func authenticate(username, password, ip string) error {
+	if err := loginLimiter.Allow(username, ip); err != nil {
+		logger.Warn("Login throttled", "userName", username, "ip", ip, "error", err)
+		return err
+	}
+
+	if err := userStore.CheckPassword(username, password); err != nil {
+		loginLimiter.RecordFailure(username, ip)
+		return err
+	}
+
+	// With two-factor enabled the login is not complete yet, so keep counting failures
+	// until the second factor succeeds.
+	if !userStore.TOTPEnabled(username) {
+		loginLimiter.RecordSuccess(username)
+	}
+	return nil
+}
+
+// loginFailureMessage hides the reason a password was rejected unless the caller is throttled.
+func loginFailureMessage(err error, fallback string) string {
+	var throttled *loginThrottledError
+	if errors.As(err, &throttled) {
+		return "Too many failed attempts. Please try again later."
+	}
+	if errors.Is(err, ErrNoPassword) {
+		return "This account signs in with single sign-on and has no password."
+	}
+	if errors.Is(err, ErrSSOLoginRequired) {
+		return "Sign in again with single sign-on to confirm, then retry within 5 minutes."
+	}
+	return fallback
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// writeAuthenticationError answers a request whose password was not accepted: 429 when
+// throttled, 403 for single sign-on accounts and 401 otherwise.
+func writeAuthenticationError(w http.ResponseWriter, err error) {
+	var throttled *loginThrottledError
+	switch {
+	case errors.As(err, &throttled):
+		writeThrottledResponse(w, throttled)
+	case errors.Is(err, ErrNoPassword), errors.Is(err, ErrSSOLoginRequired):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+	}
+}
+
+// writeThrottledResponse sets Retry-After and a 429 status for a throttled login.
+func writeThrottledResponse(w http.ResponseWriter, err *loginThrottledError) {
+	setRetryAfter(w, err.RetryAfter)
+	http.Error(w, err.Error(), http.StatusTooManyRequests)
+}
+
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
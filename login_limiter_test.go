@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestLoginLimiter(now *time.Time) *LoginLimiter {
+	limiter := newLoginLimiter(loginLimiterConfig{
+		MaxUserFailures: 3,
+		MaxIPFailures:   5,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Minute,
+		LockoutDuration: 10 * time.Minute,
+		ResetAfter:      time.Hour,
+	})
+	limiter.now = func() time.Time { return *now }
+	return limiter
+}
+
+func TestLoginLimiterBackoffAndLockout(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	limiter := newTestLoginLimiter(&now)
+
+	limiter.RecordFailure("alice", "10.0.0.1")
+	if err := limiter.Allow("alice", "10.0.0.1"); err == nil {
+		t.Fatal("Expected backoff immediately after a failure")
+	}
+
+	now = now.Add(time.Second)
+	if err := limiter.Allow("alice", "10.0.0.1"); err != nil {
+		t.Fatalf("Expected attempt to be allowed after 1s, got %v", err)
+	}
+
+	limiter.RecordFailure("alice", "10.0.0.1")
+	now = now.Add(time.Second)
+	if err := limiter.Allow("alice", "10.0.0.1"); err == nil {
+		t.Fatal("Expected backoff to double after the second failure")
+	}
+
+	now = now.Add(time.Second)
+	limiter.RecordFailure("alice", "10.0.0.1")
+
+	var throttled *loginThrottledError
+	err := limiter.Allow("alice", "10.0.0.2")
+	if !errors.As(err, &throttled) || !throttled.Locked {
+		t.Fatalf("Expected username lockout from any IP, got %v", err)
+	}
+
+	if err := limiter.Allow("bob", "10.0.0.1"); err != nil && errors.As(err, &throttled) && throttled.Locked {
+		t.Fatalf("IP should not be locked after 3 failures, got %v", err)
+	}
+
+	now = now.Add(10 * time.Minute)
+	if err := limiter.Allow("alice", "10.0.0.2"); err != nil {
+		t.Fatalf("Expected lockout to expire, got %v", err)
+	}
+}
+
+func TestLoginLimiterPerIPLockout(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	limiter := newTestLoginLimiter(&now)
+
+	for _, user := range []string{"a", "b", "c", "d", "e"} {
+		limiter.RecordFailure(user, "10.0.0.1")
+	}
+
+	var throttled *loginThrottledError
+	if err := limiter.Allow("f", "10.0.0.1"); !errors.As(err, &throttled) || !throttled.Locked {
+		t.Fatalf("Expected IP lockout, got %v", err)
+	}
+
+	limiter.RecordSuccess("f")
+	if err := limiter.Allow("f", "10.0.0.1"); err == nil {
+		t.Fatal("A successful login must not clear the IP lockout")
+	}
+
+	if err := limiter.Allow("f", "10.0.0.9"); err != nil {
+		t.Fatalf("Other IPs should be unaffected, got %v", err)
+	}
+}
+
+func TestLoginLimiterForgetsOldEntries(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	limiter := newTestLoginLimiter(&now)
+	limiter.config.MaxEntries = 3
+
+	for _, username := range []string{"alice", "bob", "carol"} {
+		limiter.RecordFailure(username, "10.0.0.1")
+		now = now.Add(time.Second)
+	}
+	limiter.RecordFailure("dave", "10.0.0.2")
+	if _, kept := limiter.users["alice"]; kept || len(limiter.users) != 3 {
+		t.Errorf("Expected the oldest username to make room, got %d entries", len(limiter.users))
+	}
+
+	now = now.Add(2 * time.Hour)
+	limiter.RecordFailure("erin", "10.0.0.3")
+	if len(limiter.users) != 1 || len(limiter.ips) != 1 {
+		t.Errorf("Expected expired entries to be swept, got %d usernames and %d IPs", len(limiter.users), len(limiter.ips))
+	}
+}
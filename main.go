@@ -1,5 +1,7 @@
 package main
 
+import "os"
+
 var isLoggedIn bool
 var loggedInUsername string
 var taskStore TaskStore
@@ -8,11 +10,32 @@ var userStore UserStore
 func main() {
 	InitializeLogger()
 
-	initializeUserStore()
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(os.Args[2:], os.Stdout))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "rotate-key" {
+		os.Exit(runRotateKey(os.Args[2:], os.Stdout))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		os.Exit(runRestore(os.Args[2:], os.Stdout))
+	}
+
+	taskDSN, userDSN := parseStoreFlags()
+
+	// The key must be known before the first data file is read
+	initializeEncryption()
+
+	initializeUserStore(userDSN)
+
+	initializeLoginLimiter()
+
+	initializePasswordPolicy()
+
+	initializeOIDC()
 
-	storeType := parseStoreType()
+	initializeTaskStore(taskDSN)
 
-	initializeTaskStore(storeType)
+	initializeSearch()
 
 	go startServer()
 	runCLI()
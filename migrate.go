@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// storeDigest summarizes the tasks of one user so two backends can be compared.
+type storeDigest struct {
+	Count    int
+	Checksum string
+}
+
+// digestTasks hashes the tasks in ID order, so the result does not depend on the
+// order a backend returns them in.
+func digestTasks(tasks []Task) storeDigest {
+	sorted := append([]Task(nil), tasks...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+
+	hash := sha256.New()
+	encoder := json.NewEncoder(hash)
+	for _, task := range sorted {
+		_ = encoder.Encode(task) // Writing to a hash cannot fail
+	}
+
+	return storeDigest{Count: len(sorted), Checksum: hex.EncodeToString(hash.Sum(nil))}
+}
+
+type migrationReport struct {
+	Users      int
+	Tasks      int
+	Mismatches []string
+}
+
+// migrateTasks copies every user's tasks from source to target one user at a time.
+// With dryRun set nothing is written.
+func migrateTasks(ctx context.Context, source, target TaskStore, dryRun bool, out io.Writer) (migrationReport, error) {
+	var report migrationReport
+
+	sourceNames, err := source.ListUserNames(ctx)
+	if err != nil {
+		return report, fmt.Errorf("listing users: %w", err)
+	}
+
+	for _, userName := range sourceNames {
+		tasks, err := source.ListTasks(ctx, userName)
+		if err != nil {
+			return report, fmt.Errorf("reading tasks for %s: %w", userName, err)
+		}
+		digest := digestTasks(tasks)
+
+		if dryRun {
+			_, _ = fmt.Fprintf(out, "would copy %d tasks for %s (checksum %s)\n", digest.Count, userName, digest.Checksum[:12])
+		} else {
+			if err := target.ImportTasks(ctx, userName, tasks); err != nil {
+				return report, fmt.Errorf("importing tasks for %s: %w", userName, err)
+			}
+			_, _ = fmt.Fprintf(out, "copied %d tasks for %s\n", digest.Count, userName)
+		}
+
+		report.Users++
+		report.Tasks += digest.Count
+	}
+
+	return report, nil
+}
+
+// verifyMigration compares task counts and checksums for every user in either store.
+func verifyMigration(ctx context.Context, source, target TaskStore) (migrationReport, error) {
+	var report migrationReport
+
+	userNames := make(map[string]bool)
+	for _, store := range []TaskStore{source, target} {
+		names, err := store.ListUserNames(ctx)
+		if err != nil {
+			return report, fmt.Errorf("listing users: %w", err)
+		}
+		for _, userName := range names {
+			userNames[userName] = true
+		}
+	}
+
+	sortedNames := make([]string, 0, len(userNames))
+	for userName := range userNames {
+		sortedNames = append(sortedNames, userName)
+	}
+	sort.Strings(sortedNames)
+
+	for _, userName := range sortedNames {
+		sourceTasks, err := source.ListTasks(ctx, userName)
+		if err != nil {
+			return report, fmt.Errorf("reading source tasks for %s: %w", userName, err)
+		}
+		targetTasks, err := target.ListTasks(ctx, userName)
+		if err != nil {
+			return report, fmt.Errorf("reading target tasks for %s: %w", userName, err)
+		}
+
+		want := digestTasks(sourceTasks)
+		got := digestTasks(targetTasks)
+
+		report.Users++
+		report.Tasks += want.Count
+
+		if want != got {
+			report.Mismatches = append(report.Mismatches,
+				fmt.Sprintf("%s: source has %d tasks (%s), target has %d tasks (%s)", userName, want.Count, want.Checksum[:12], got.Count, got.Checksum[:12]))
+		}
+	}
+
+	return report, nil
+}
+
+// runMigrate implements the "migrate" subcommand and returns the process exit code.
+func runMigrate(args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.SetOutput(out)
+	from := flags.String("from", "", "Source task store: a backend name or a DSN such as json:///var/lib/todo/tasks.json")
+	fromPath := flags.String("from-path", "", "Source data file (defaults to the backend's usual file)")
+	to := flags.String("to", "", "Target task store: a backend name or a DSN such as sqlite:///var/lib/todo/tasks.db")
+	toPath := flags.String("to-path", "", "Target data file (defaults to the backend's usual file)")
+	dryRun := flags.Bool("dry-run", false, "Report what would be copied without writing anything")
+	verifyOnly := flags.Bool("verify", false, "Only compare source and target, do not copy")
+	keyFile := flags.String("encryption-key-file", "", "File with the key of encrypted data files (instead of $"+encryptionKeyEnv+")")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	key, err := loadEncryptionKey(*keyFile, os.Getenv(encryptionKeyEnv))
+	if err != nil {
+		_, _ = fmt.Fprintln(out, err)
+		return 2
+	}
+	activeKey = key
+
+	if *from == "" || *to == "" {
+		_, _ = fmt.Fprintln(out, "Usage: migrate -from=<store> -to=<store> [-from-path=...] [-to-path=...] [-dry-run | -verify]")
+		return 2
+	}
+
+	if *dryRun && *verifyOnly {
+		_, _ = fmt.Fprintln(out, "Use either -dry-run or -verify, not both.")
+		return 2
+	}
+
+	sourceDSN, targetDSN := storeDSN(*from, *fromPath), storeDSN(*to, *toPath)
+	if sourceDSN == targetDSN {
+		_, _ = fmt.Fprintln(out, "Source and target are the same store.")
+		return 2
+	}
+
+	// Opening a store creates its files, so a mistyped source would migrate nothing
+	sourcePath, err := taskStorePath(*from, *fromPath)
+	if err != nil {
+		_, _ = fmt.Fprintln(out, err)
+		return 2
+	}
+	if sourcePath != "" {
+		if _, err := os.Stat(sourcePath); err != nil {
+			_, _ = fmt.Fprintln(out, "Source store not found:", err)
+			return 2
+		}
+	}
+
+	source, err := openTaskStoreAt(*from, *fromPath)
+	if err != nil {
+		_, _ = fmt.Fprintln(out, err)
+		return 2
+	}
+	defer closeTaskStore(source)
+
+	var target TaskStore
+	if !*dryRun {
+		target, err = openTaskStoreAt(*to, *toPath)
+		if err != nil {
+			_, _ = fmt.Fprintln(out, err)
+			return 2
+		}
+		defer closeTaskStore(target)
+	}
+
+	ctx := context.Background()
+
+	if !*verifyOnly {
+		report, err := migrateTasks(ctx, source, target, *dryRun, out)
+		if err != nil {
+			_, _ = fmt.Fprintln(out, "Migration failed:", err)
+			return 1
+		}
+		if *dryRun {
+			_, _ = fmt.Fprintf(out, "Dry run: %d tasks for %d users would be copied from %s to %s.\n", report.Tasks, report.Users, *from, *to)
+			return 0
+		}
+		_, _ = fmt.Fprintf(out, "Copied %d tasks for %d users from %s to %s.\n", report.Tasks, report.Users, *from, *to)
+	}
+
+	report, err := verifyMigration(ctx, source, target)
+	if err != nil {
+		_, _ = fmt.Fprintln(out, "Verification failed:", err)
+		return 1
+	}
+	for _, mismatch := range report.Mismatches {
+		_, _ = fmt.Fprintln(out, "MISMATCH", mismatch)
+	}
+	if len(report.Mismatches) > 0 {
+		_, _ = fmt.Fprintf(out, "Verification failed for %d of %d users.\n", len(report.Mismatches), report.Users)
+		return 1
+	}
+
+	_, _ = fmt.Fprintf(out, "Verified %d tasks for %d users: counts and checksums match.\n", report.Tasks, report.Users)
+	return 0
+}
+
+// closeTaskStore flushes and closes stores that hold open files.
+func closeTaskStore(store TaskStore) {
+	if closer, ok := store.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logger.Error("Failed to close task store", "error", err)
+		}
+	}
+}
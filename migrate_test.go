@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrateJSONToSQLitePreservesTasks(t *testing.T) {
+	dir := t.TempDir()
+	jsonPath := filepath.Join(dir, "tasks.json")
+	sqlitePath := filepath.Join(dir, "tasks.db")
+
+	source := newTestJSONStore(t, jsonPath)
+	mustAddTask(t, source, "alice", "First", "one")
+	gap := mustAddTask(t, source, "alice", "Gap", "")
+	done := mustAddTask(t, source, "bob", "Done", "two")
+	if _, err := source.CompleteTask(context.Background(), "bob", done.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.RemoveTask(context.Background(), "alice", gap.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	closeTaskStore(source) // The migration opens the file itself
+
+	var out bytes.Buffer
+	if code := runMigrate([]string{"-from=json", "-from-path=" + jsonPath, "-to=sqlite", "-to-path=" + sqlitePath, "-dry-run"}, &out); code != 0 {
+		t.Fatalf("Dry run failed with code %d: %s", code, out.String())
+	}
+
+	target := newTestSQLiteStore(t, sqlitePath)
+	if users := mustListUserNames(t, target); len(users) != 0 {
+		t.Fatalf("Dry run must not write, found users %v", users)
+	}
+	_ = target.Close()
+
+	out.Reset()
+	if code := runMigrate([]string{"-from=json", "-from-path=" + jsonPath, "-to=sqlite", "-to-path=" + sqlitePath}, &out); code != 0 {
+		t.Fatalf("Migration failed with code %d: %s", code, out.String())
+	}
+	if !strings.Contains(out.String(), "counts and checksums match") {
+		t.Errorf("Expected successful verification, got: %s", out.String())
+	}
+
+	target = newTestSQLiteStore(t, sqlitePath)
+	task, err := target.GetTask(context.Background(), "bob", done.ID)
+	if err != nil || !task.Completed || task.Title != "Done" {
+		t.Errorf("Expected completed task %d for bob, got %+v, %v", done.ID, task, err)
+	}
+
+	if task := mustAddTask(t, target, "carol", "New", ""); task.ID != gap.ID {
+		t.Errorf("Expected migrated gap %d to be reused, got %d", gap.ID, task.ID)
+	}
+
+	out.Reset()
+	if code := runMigrate([]string{"-from=json", "-from-path=" + jsonPath, "-to=sqlite", "-to-path=" + sqlitePath, "-verify"}, &out); code != 1 {
+		t.Errorf("Expected verification to fail after the target changed, got code %d: %s", code, out.String())
+	}
+}
+
+func TestMigrateRefusesMissingSource(t *testing.T) {
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "taks.json")
+
+	var out bytes.Buffer
+	args := []string{"-from=json", "-from-path=" + missing, "-to=sqlite", "-to-path=" + filepath.Join(dir, "tasks.db")}
+	if code := runMigrate(args, &out); code != 2 || !strings.Contains(out.String(), "Source store not found") {
+		t.Errorf("Expected a missing source to be refused, got %d: %s", code, out.String())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Expected no files to be created, found %d", len(entries))
+	}
+}
+
+func TestDigestTasksIgnoresOrder(t *testing.T) {
+	a := []Task{{ID: 1, Title: "a"}, {ID: 2, Title: "b"}}
+	b := []Task{{ID: 2, Title: "b"}, {ID: 1, Title: "a"}}
+	if digestTasks(a) != digestTasks(b) {
+		t.Error("Expected the same digest regardless of order")
+	}
+
+	b[0].Completed = true
+	if digestTasks(a) == digestTasks(b) {
+		t.Error("Expected a different digest when a task changes")
+	}
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	oidcIssuerFlag      = flag.String("oidc-issuer", "", "OpenID Connect issuer URL; enables single sign-on when set")
+	oidcClientIDFlag    = flag.String("oidc-client-id", "", "OpenID Connect client ID")
+	oidcRedirectURLFlag = flag.String("oidc-redirect-url", "http://localhost:8080/login/oidc/callback", "OpenID Connect redirect URL registered with the identity provider")
+)
+
+// oidcProvider is nil unless single sign-on is configured.
+var oidcProvider *OIDCProvider
+
+const (
+	oidcLoginTimeout = 10 * time.Minute // How long a started login may take to come back
+	oidcClockSkew    = time.Minute
+	jwksRefreshDelay = time.Minute     // Least time between fetches of the JWKS for unknown keys
+	oidcReauthWindow = 5 * time.Minute // How long a login stands in for the password when deleting the account
+)
+
+// ErrSSOLoginRequired is returned when a single sign-on account is to be deleted
+// without a recent single sign-on login, which takes the place of the password.
+var ErrSSOLoginRequired = errors.New("sign in again with single sign-on to confirm, then retry within 5 minutes")
+
+type oidcConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcPendingLogin struct {
+	nonce    string
+	verifier string
+	expires  time.Time
+}
+
+type OIDCProvider struct {
+	config     oidcConfig
+	discovery  oidcDiscovery
+	httpClient *http.Client
+	now        func() time.Time
+
+	mutex         sync.Mutex
+	keys          map[string]*rsa.PublicKey
+	keysRefreshed time.Time                   // When key last fetched the JWKS
+	pending       map[string]oidcPendingLogin // Keyed by state
+	logins        map[string]time.Time        // Username to the time of their last login
+}
+
+type idTokenClaims struct {
+	Issuer            string   `json:"iss"`
+	Subject           string   `json:"sub"`
+	Audience          audience `json:"aud"`
+	AuthorizedParty   string   `json:"azp"`
+	Expiry            int64    `json:"exp"`
+	IssuedAt          int64    `json:"iat"`
+	Nonce             string   `json:"nonce"`
+	PreferredUsername string   `json:"preferred_username"`
+	Email             string   `json:"email"`
+}
+
+// audience accepts both the single string and the array form of the aud claim.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+	*a = multiple
+	return nil
+}
+
+func (a audience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+func initializeOIDC() {
+	if *oidcIssuerFlag == "" {
+		return
+	}
+
+	provider, err := discoverOIDCProvider(oidcConfig{
+		Issuer:       *oidcIssuerFlag,
+		ClientID:     *oidcClientIDFlag,
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  *oidcRedirectURLFlag,
+	}, &http.Client{Timeout: 10 * time.Second})
+	if err != nil {
+		logger.Error("Failed to initialize OpenID Connect", "issuer", *oidcIssuerFlag, "error", err)
+		os.Exit(1)
+	}
+
+	oidcProvider = provider
+	logger.Info("OpenID Connect login enabled", "issuer", provider.discovery.Issuer)
+}
+
+func discoverOIDCProvider(config oidcConfig, httpClient *http.Client) (*OIDCProvider, error) {
+	if config.ClientID == "" {
+		return nil, errors.New("client ID is required")
+	}
+
+	provider := &OIDCProvider{
+		config:     config,
+		httpClient: httpClient,
+		now:        time.Now,
+		keys:       make(map[string]*rsa.PublicKey),
+		pending:    make(map[string]oidcPendingLogin),
+		logins:     make(map[string]time.Time),
+	}
+
+	wellKnown := strings.TrimSuffix(config.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := provider.getJSON(wellKnown, &provider.discovery); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+
+	if provider.discovery.Issuer != config.Issuer {
+		return nil, fmt.Errorf("discovery issuer %q does not match %q", provider.discovery.Issuer, config.Issuer)
+	}
+
+	if provider.discovery.AuthorizationEndpoint == "" || provider.discovery.TokenEndpoint == "" || provider.discovery.JWKSURI == "" {
+		return nil, errors.New("discovery document is missing required endpoints")
+	}
+
+	if err := provider.refreshKeys(); err != nil {
+		return nil, err
+	}
+
+	return provider, nil
+}
+
+func (provider *OIDCProvider) getJSON(endpoint string, v interface{}) error {
+	resp, err := provider.httpClient.Get(endpoint)
+	if err != nil {
+		return err
+	}
+	defer safeClose(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", endpoint, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func randomURLString(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL starts a login and returns the identity provider URL to redirect to.
+func (provider *OIDCProvider) AuthCodeURL() (string, error) {
+	state, err := randomURLString(24)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := randomURLString(24)
+	if err != nil {
+		return "", err
+	}
+	verifier, err := randomURLString(32)
+	if err != nil {
+		return "", err
+	}
+
+	provider.mutex.Lock()
+	now := provider.now()
+	for key, login := range provider.pending {
+		if now.After(login.expires) {
+			delete(provider.pending, key)
+		}
+	}
+	provider.pending[state] = oidcPendingLogin{nonce: nonce, verifier: verifier, expires: now.Add(oidcLoginTimeout)}
+	provider.mutex.Unlock()
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", provider.config.ClientID)
+	params.Set("redirect_uri", provider.config.RedirectURL)
+	params.Set("scope", "openid profile email")
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", pkceChallenge(verifier))
+	params.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(provider.discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return provider.discovery.AuthorizationEndpoint + separator + params.Encode(), nil
+}
+
+// RecordLogin notes that username just signed in through the identity provider.
+func (provider *OIDCProvider) RecordLogin(username string) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	now := provider.now()
+	for name, at := range provider.logins {
+		if now.Sub(at) > oidcReauthWindow {
+			delete(provider.logins, name)
+		}
+	}
+	provider.logins[username] = now
+}
+
+// RecentLogin reports whether username signed in through the identity provider within
+// oidcReauthWindow.
+func (provider *OIDCProvider) RecentLogin(username string) bool {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	at, exists := provider.logins[username]
+	return exists && provider.now().Sub(at) <= oidcReauthWindow
+}
+
+// Exchange completes a login started by AuthCodeURL and returns the verified ID token claims.
+func (provider *OIDCProvider) Exchange(state, code string) (*idTokenClaims, error) {
+	provider.mutex.Lock()
+	login, exists := provider.pending[state]
+	delete(provider.pending, state) // A state can only be used once
+	provider.mutex.Unlock()
+
+	if !exists || provider.now().After(login.expires) {
+		return nil, errors.New("unknown or expired login state")
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", provider.config.RedirectURL)
+	form.Set("client_id", provider.config.ClientID)
+	form.Set("code_verifier", login.verifier)
+	if provider.config.ClientSecret != "" {
+		form.Set("client_secret", provider.config.ClientSecret)
+	}
+
+	resp, err := provider.httpClient.PostForm(provider.discovery.TokenEndpoint, form)
+	if err != nil {
+		return nil, err
+	}
+	defer safeClose(resp.Body)
+
+	var token struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, fmt.Errorf("decoding token response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK || token.Error != "" {
+		return nil, fmt.Errorf("token endpoint: %s %s %s", resp.Status, token.Error, token.ErrorDescription)
+	}
+
+	if token.IDToken == "" {
+		return nil, errors.New("token response has no id_token")
+	}
+
+	return provider.verifyIDToken(token.IDToken, login.nonce)
+}
+
+func (provider *OIDCProvider) verifyIDToken(raw, nonce string) (*idTokenClaims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("ID token header: %w", err)
+	}
+
+	if header.Algorithm != "RS256" {
+		return nil, fmt.Errorf("unsupported ID token algorithm %q", header.Algorithm)
+	}
+
+	key, err := provider.key(header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("ID token signature: %w", err)
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, errors.New("invalid ID token signature")
+	}
+
+	var claims idTokenClaims
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("ID token claims: %w", err)
+	}
+
+	now := provider.now()
+	switch {
+	case claims.Issuer != provider.discovery.Issuer:
+		return nil, fmt.Errorf("unexpected ID token issuer %q", claims.Issuer)
+	case !claims.Audience.contains(provider.config.ClientID):
+		return nil, errors.New("ID token is not intended for this client")
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != provider.config.ClientID:
+		return nil, errors.New("ID token authorized party does not match this client")
+	case now.After(time.Unix(claims.Expiry, 0).Add(oidcClockSkew)):
+		return nil, errors.New("ID token has expired")
+	case time.Unix(claims.IssuedAt, 0).After(now.Add(oidcClockSkew)):
+		return nil, errors.New("ID token issued in the future")
+	case claims.Nonce != nonce:
+		return nil, errors.New("ID token nonce mismatch")
+	case claims.Subject == "":
+		return nil, errors.New("ID token has no subject")
+	}
+
+	return &claims, nil
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// key returns the signing key for kid, refreshing the JWKS when the identity provider
+// has rotated to a key we have not seen yet. Refreshes are at least jwksRefreshDelay
+// apart, so tokens with made-up key IDs cannot make us flood the identity provider.
+func (provider *OIDCProvider) key(kid string) (*rsa.PublicKey, error) {
+	provider.mutex.Lock()
+	key, exists := provider.keys[kid]
+	now := provider.now()
+	refresh := !exists && now.Sub(provider.keysRefreshed) >= jwksRefreshDelay
+	if refresh {
+		provider.keysRefreshed = now
+	}
+	provider.mutex.Unlock()
+	if exists {
+		return key, nil
+	}
+	if !refresh {
+		return nil, fmt.Errorf("unknown ID token signing key %q", kid)
+	}
+
+	if err := provider.refreshKeys(); err != nil {
+		return nil, err
+	}
+
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	if key, exists := provider.keys[kid]; exists {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown ID token signing key %q", kid)
+}
+
+func (provider *OIDCProvider) refreshKeys() error {
+	var jwks struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			KeyID   string `json:"kid"`
+			Use     string `json:"use"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := provider.getJSON(provider.discovery.JWKSURI, &jwks); err != nil {
+		return fmt.Errorf("fetching JWKS: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.KeyType != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return fmt.Errorf("JWKS key %q: %w", jwk.KeyID, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return fmt.Errorf("JWKS key %q: %w", jwk.KeyID, err)
+		}
+
+		keys[jwk.KeyID] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	provider.mutex.Lock()
+	provider.keys = keys
+	provider.mutex.Unlock()
+	return nil
+}
+
+// oidcUsername picks the local username for a new single sign-on user: the first of
+// the preferred username, the local part of the email address and the subject that
+// is a valid username once normalized.
+func oidcUsername(claims *idTokenClaims) (string, error) {
+	localPart, _, _ := strings.Cut(claims.Email, "@")
+	for _, candidate := range []string{claims.PreferredUsername, localPart, claims.Subject} {
+		username := normalizeUsername(candidate)
+		if username != "" && len(validateUsername(username)) == 0 {
+			return username, nil
+		}
+	}
+	return "", fmt.Errorf("the identity provider gave no usable username for subject %q", claims.Subject)
+}
+
+// ProvisionOIDCUser returns the local user linked to the issuer and subject, creating
+// one on first login. An existing password account is never taken over.
+func (store *jsonUserStore) ProvisionOIDCUser(issuer string, claims *idTokenClaims) (User, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for _, user := range store.users {
+		if user.OIDCIssuer == issuer && user.OIDCSubject == claims.Subject {
+			return user, nil
+		}
+	}
+
+	username, err := oidcUsername(claims)
+	if err != nil {
+		return User{}, err
+	}
+	if store.nameTaken(username) {
+		return User{}, fmt.Errorf("username %q is already used by a local account", username)
+	}
+
+	if store.users == nil {
+		store.users = make(map[string]User)
+	}
+
+	user := User{Username: username, OIDCIssuer: issuer, OIDCSubject: claims.Subject}
+	store.users[username] = user
+
+	if err := store.saveUsersToFile(); err != nil {
+		return User{}, err
+	}
+
+	auditLogger.Info("Provisioned single sign-on user", "userName", username, "issuer", issuer, "subject", claims.Subject)
+	return user, nil
+}
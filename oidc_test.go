@@ -0,0 +1,339 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeIdP is a minimal in-process OpenID Connect provider. Its authorize endpoint
+// immediately redirects back with a code, as if the user had signed in.
+type fakeIdP struct {
+	server   *httptest.Server
+	key      *rsa.PrivateKey
+	kid      string
+	clientID string
+
+	mutex       sync.Mutex
+	codes       map[string]fakeAuthorization
+	jwksFetches int
+
+	// Hooks for tests to tamper with issued tokens
+	claims   func(claims map[string]interface{})
+	tokenKid string // Signs with this key ID instead of kid when set
+}
+
+type fakeAuthorization struct {
+	challenge string
+	nonce     string
+}
+
+func newFakeIdP(t *testing.T, clientID string) *fakeIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &fakeIdP{key: key, kid: "test-key", clientID: clientID, codes: make(map[string]fakeAuthorization)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSONResponse(w, http.StatusOK, map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		idp.mutex.Lock()
+		idp.jwksFetches++
+		idp.mutex.Unlock()
+		writeJSONResponse(w, http.StatusOK, map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": idp.kid,
+				"use": "sig",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("code_challenge_method") != "S256" || query.Get("client_id") != idp.clientID {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		code := "code-" + query.Get("state")
+		idp.mutex.Lock()
+		idp.codes[code] = fakeAuthorization{challenge: query.Get("code_challenge"), nonce: query.Get("nonce")}
+		idp.mutex.Unlock()
+
+		http.Redirect(w, r, query.Get("redirect_uri")+"?state="+url.QueryEscape(query.Get("state"))+"&code="+url.QueryEscape(code), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		idp.mutex.Lock()
+		authorization, ok := idp.codes[r.FormValue("code")]
+		delete(idp.codes, r.FormValue("code"))
+		idp.mutex.Unlock()
+
+		if !ok || pkceChallenge(r.FormValue("code_verifier")) != authorization.challenge {
+			writeJSONResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		claims := map[string]interface{}{
+			"iss":                idp.server.URL,
+			"sub":                "subject-42",
+			"aud":                idp.clientID,
+			"exp":                time.Now().Add(time.Hour).Unix(),
+			"iat":                time.Now().Unix(),
+			"nonce":              authorization.nonce,
+			"preferred_username": "alice",
+		}
+		if idp.claims != nil {
+			idp.claims(claims)
+		}
+
+		writeJSONResponse(w, http.StatusOK, map[string]string{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     idp.sign(t, claims),
+		})
+	})
+
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *fakeIdP) sign(t *testing.T, claims map[string]interface{}) string {
+	kid := idp.kid
+	if idp.tokenKid != "" {
+		kid = idp.tokenKid
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// login runs the browser side of the flow and returns the callback state and code.
+func (idp *fakeIdP) login(t *testing.T, provider *OIDCProvider) (string, string) {
+	authURL, err := provider.AuthCodeURL()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(resp.Body)
+
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.StatusCode != http.StatusFound {
+		t.Fatalf("Expected redirect from authorize endpoint, got %s", resp.Status)
+	}
+	return callback.Query().Get("state"), callback.Query().Get("code")
+}
+
+func newTestOIDCProvider(t *testing.T, idp *fakeIdP) *OIDCProvider {
+	provider, err := discoverOIDCProvider(oidcConfig{
+		Issuer:      idp.server.URL,
+		ClientID:    idp.clientID,
+		RedirectURL: "http://localhost:8080/login/oidc/callback",
+	}, idp.server.Client())
+	if err != nil {
+		t.Fatalf("Discovery failed: %v", err)
+	}
+	return provider
+}
+
+func TestOIDCAuthorizationCodeFlow(t *testing.T) {
+	idp := newFakeIdP(t, "todo-app")
+	provider := newTestOIDCProvider(t, idp)
+
+	state, code := idp.login(t, provider)
+	claims, err := provider.Exchange(state, code)
+	if err != nil {
+		t.Fatalf("Exchange failed: %v", err)
+	}
+
+	if username, err := oidcUsername(claims); claims.Subject != "subject-42" || err != nil || username != "alice" {
+		t.Errorf("Unexpected claims: %+v", claims)
+	}
+
+	if _, err := provider.Exchange(state, code); err == nil {
+		t.Error("Expected a state to be usable only once")
+	}
+}
+
+func TestOIDCRejectsInvalidIDTokens(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(claims map[string]interface{})
+	}{
+		{"wrong audience", func(c map[string]interface{}) { c["aud"] = "someone-else" }},
+		{"wrong issuer", func(c map[string]interface{}) { c["iss"] = "https://evil.example" }},
+		{"expired", func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{"wrong nonce", func(c map[string]interface{}) { c["nonce"] = "replayed" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := newFakeIdP(t, "todo-app")
+			idp.claims = tt.tamper
+			provider := newTestOIDCProvider(t, idp)
+
+			state, code := idp.login(t, provider)
+			if _, err := provider.Exchange(state, code); err == nil {
+				t.Error("Expected ID token to be rejected")
+			}
+		})
+	}
+}
+
+func TestOIDCRejectsForeignSignature(t *testing.T) {
+	idp := newFakeIdP(t, "todo-app")
+	provider := newTestOIDCProvider(t, idp)
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.key = other // Same kid, but not the key the provider fetched from the JWKS
+
+	raw := idp.sign(t, map[string]interface{}{"iss": idp.server.URL, "sub": "x", "aud": "todo-app"})
+	if _, err := provider.verifyIDToken(raw, ""); err == nil {
+		t.Error("Expected signature from unknown key to be rejected")
+	}
+}
+
+func TestOIDCRejectsWrongPKCEVerifier(t *testing.T) {
+	idp := newFakeIdP(t, "todo-app")
+	provider := newTestOIDCProvider(t, idp)
+
+	state, code := idp.login(t, provider)
+
+	provider.mutex.Lock()
+	login := provider.pending[state]
+	login.verifier = "not-the-original-verifier"
+	provider.pending[state] = login
+	provider.mutex.Unlock()
+
+	if _, err := provider.Exchange(state, code); err == nil {
+		t.Error("Expected token exchange with a wrong code verifier to fail")
+	}
+}
+
+func TestOIDCLimitsJWKSRefreshes(t *testing.T) {
+	idp := newFakeIdP(t, "todo-app")
+	provider := newTestOIDCProvider(t, idp)
+	now := time.Now()
+	provider.now = func() time.Time { return now }
+	claims := map[string]interface{}{"iss": idp.server.URL, "sub": "x", "aud": "todo-app", "exp": now.Add(time.Hour).Unix()}
+
+	for _, kid := range []string{"forged-1", "forged-2", "forged-3"} {
+		idp.tokenKid = kid
+		if _, err := provider.verifyIDToken(idp.sign(t, claims), ""); err == nil {
+			t.Errorf("%s: expected an unknown key to be rejected", kid)
+		}
+	}
+	idp.mutex.Lock()
+	fetches := idp.jwksFetches
+	idp.mutex.Unlock()
+	if fetches != 2 {
+		t.Errorf("Expected one refresh after the initial fetch, got %d fetches", fetches)
+	}
+
+	// A key the identity provider rotated to is picked up once the delay has passed
+	now = now.Add(jwksRefreshDelay)
+	idp.kid = "rotated"
+	if _, err := provider.key("rotated"); err != nil {
+		t.Errorf("Expected the rotated key to be fetched, got %v", err)
+	}
+}
+
+func TestOIDCAccountsHaveNoPassword(t *testing.T) {
+	previous := userStore
+	userStore = newMemoryUserStore()
+	defer func() { userStore = previous }()
+
+	user, err := userStore.ProvisionOIDCUser("https://idp.example.com", &idTokenClaims{Subject: "42", PreferredUsername: "carol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := userStore.ChangePassword(user.Username, "", "NewPassword1"); !errors.Is(err, ErrNoPassword) {
+		t.Errorf("Expected a password change to be refused, got %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	changePasswordHandler(rec, httptest.NewRequest(http.MethodPost, "/users/me/password?username=carol", strings.NewReader(`{"old_password": "", "new_password": "NewPassword1"}`)))
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "single sign-on") {
+		t.Errorf("Expected 403 explaining single sign-on, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestOIDCAccountCanBeDeletedAfterFreshLogin(t *testing.T) {
+	previousUsers, previousTasks, previousProvider, previousLimiter := userStore, taskStore, oidcProvider, loginLimiter
+	defer func() {
+		userStore, taskStore, oidcProvider, loginLimiter = previousUsers, previousTasks, previousProvider, previousLimiter
+	}()
+	userStore = newMemoryUserStore()
+	taskStore = localTaskStore()
+	loginLimiter = newLoginLimiter(defaultLoginLimiterConfig())
+	oidcProvider = newTestOIDCProvider(t, newFakeIdP(t, "todo-app"))
+	now := time.Now()
+	oidcProvider.now = func() time.Time { return now }
+
+	if _, err := userStore.ProvisionOIDCUser("https://idp.example.com", &idTokenClaims{Subject: "42", PreferredUsername: "carol"}); err != nil {
+		t.Fatal(err)
+	}
+	mustAddTask(t, taskStore, "carol", "First", "")
+	deleteCarol := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		currentUserHandler(rec, httptest.NewRequest(http.MethodDelete, "/users/me?username=carol", strings.NewReader(`{"password": ""}`)))
+		return rec
+	}
+
+	if rec := deleteCarol(); rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "sign in again") {
+		t.Errorf("Expected 403 asking to sign in again, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	oidcProvider.RecordLogin("carol")
+	now = now.Add(oidcReauthWindow + time.Second)
+	if oidcProvider.RecentLogin("carol") {
+		t.Error("Expected an old login not to confirm the deletion")
+	}
+
+	oidcProvider.RecordLogin("carol")
+	if rec := deleteCarol(); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the deletion to succeed after a fresh login, got %d %q", rec.Code, rec.Body.String())
+	}
+	if len(userStore.ListUsers()) != 0 || len(mustListTasks(t, taskStore, "carol")) != 0 {
+		t.Error("Expected the account and its tasks to be gone")
+	}
+}
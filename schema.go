@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Kinds of versioned data files
+const (
+	schemaKindTasks = "tasks"
+	schemaKindUsers = "users"
+
+	schemaKindUserTasks = "user-tasks" // One user's tasks in the sharded store
+)
+
+// schemaUpgrade converts the data of a file from one version to the next.
+type schemaUpgrade func(data json.RawMessage) (json.RawMessage, error)
+
+// schemaUpgrades lists, per kind, the steps from each version to the next: entry i
+// upgrades version i to i+1. The current version of a kind is the number of steps.
+// To change a file format, append a step; never edit a released one.
+var schemaUpgrades = map[string][]schemaUpgrade{
+	schemaKindTasks: {upgradeLegacyFile, upgradeTaskVersions},
+	schemaKindUsers: {upgradeLegacyFile},
+
+	schemaKindUserTasks: {upgradeLegacyFile},
+}
+
+// upgradeLegacyFile handles version 0, the bare map written before files had an
+// envelope. The data itself is unchanged.
+func upgradeLegacyFile(data json.RawMessage) (json.RawMessage, error) {
+	return data, nil
+}
+
+// upgradeTaskVersions (version 1 to 2) gives every task the version counter used for
+// optimistic concurrency, starting at 1.
+func upgradeTaskVersions(data json.RawMessage) (json.RawMessage, error) {
+	var tasks map[string]map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(data, &tasks); err != nil {
+		return nil, err
+	}
+
+	for _, userTasks := range tasks {
+		for _, task := range userTasks {
+			if _, exists := task["version"]; !exists {
+				task["version"] = json.RawMessage("1")
+			}
+		}
+	}
+
+	return json.Marshal(tasks)
+}
+
+func currentSchemaVersion(kind string) int {
+	return len(schemaUpgrades[kind])
+}
+
+// dataFileEnvelope wraps the contents of a versioned data file.
+type dataFileEnvelope struct {
+	Version int             `json:"version"`
+	Kind    string          `json:"kind"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// schemaVersionError is returned for files written by a newer version of the program.
+// Such files are not corrupt and must not be replaced by a backup.
+type schemaVersionError struct {
+	File      string
+	Version   int
+	Supported int
+}
+
+func (e *schemaVersionError) Error() string {
+	return fmt.Sprintf("%s has format version %d, but this program only understands up to version %d; upgrade the program", e.File, e.Version, e.Supported)
+}
+
+// decodeDataFile reads a versioned data file of the given kind into v, applying any
+// upgrade steps in memory. It returns the version found on disk. An empty kind reads
+// a plain JSON file.
+func decodeDataFile(filePath, kind string, v interface{}) (int, error) {
+	raw, err := readDataFile(filePath)
+	if err != nil {
+		return 0, err
+	}
+	return decodeData(filePath, raw, kind, v)
+}
+
+// decodeData does the work of decodeDataFile for data that has already been read and
+// decrypted. filePath is only used in error messages.
+func decodeData(filePath string, raw []byte, kind string, v interface{}) (int, error) {
+	if kind == "" {
+		return 0, json.Unmarshal(raw, v)
+	}
+
+	version, data, err := unwrapDataFile(raw, kind)
+	if err != nil {
+		return 0, err
+	}
+
+	if current := currentSchemaVersion(kind); version > current {
+		return version, &schemaVersionError{File: filePath, Version: version, Supported: current}
+	}
+
+	for step := version; step < currentSchemaVersion(kind); step++ {
+		if data, err = schemaUpgrades[kind][step](data); err != nil {
+			return version, fmt.Errorf("upgrading %s from version %d: %w", filePath, step, err)
+		}
+	}
+
+	return version, json.Unmarshal(data, v)
+}
+
+// unwrapDataFile splits a file into its version and data. Files without an envelope
+// are version 0.
+func unwrapDataFile(raw []byte, kind string) (int, json.RawMessage, error) {
+	var probe interface{}
+	if err := json.Unmarshal(raw, &probe); err != nil {
+		return 0, nil, err
+	}
+
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(raw, &fields) != nil {
+		return 0, raw, nil // Valid JSON, but not an object
+	}
+
+	_, hasVersion := fields["version"]
+	_, hasData := fields["data"]
+	var fileKind string
+	if !hasVersion || !hasData || json.Unmarshal(fields["kind"], &fileKind) != nil || fileKind != kind {
+		return 0, raw, nil
+	}
+
+	var envelope dataFileEnvelope
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		return 0, nil, err
+	}
+	return envelope.Version, envelope.Data, nil
+}
+
+// writeDataFile atomically writes v to filePath in the current format for kind,
+// encrypted if a key is configured.
+func writeDataFile(filePath, kind string, backups int, v interface{}) error {
+	return writeFileAtomic(filePath, backups, encryptWith(activeKey, func(w io.Writer) error {
+		return encodeData(w, kind, v)
+	}))
+}
+
+// encodeData writes v in the current format for kind, without encrypting it.
+func encodeData(w io.Writer, kind string, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if kind == "" {
+		return encoder.Encode(v)
+	}
+	return encoder.Encode(struct {
+		Version int         `json:"version"`
+		Kind    string      `json:"kind"`
+		Data    interface{} `json:"data"`
+	}{currentSchemaVersion(kind), kind, v})
+}
+
+// upgradeDataFile rewrites a file that was loaded from an older version in the current
+// format, keeping a copy of the original as filePath.v<version>.
+func upgradeDataFile(filePath, kind string, version, backups int, v interface{}) error {
+	if kind == "" || version >= currentSchemaVersion(kind) {
+		return nil
+	}
+
+	backup := fmt.Sprintf("%s.v%d", filePath, version)
+	if err := copyFile(filePath, backup); err != nil {
+		return fmt.Errorf("backing up %s before upgrade: %w", filePath, err)
+	}
+
+	if err := writeDataFile(filePath, kind, backups, v); err != nil {
+		return err
+	}
+
+	logger.Info("Upgraded data file", "file", filePath, "from", version, "to", currentSchemaVersion(kind), "backup", backup)
+	return nil
+}
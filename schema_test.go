@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLegacyTasksFileIsUpgraded(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "tasks.json")
+	legacy := `{"alice": {"1": {"id": 1, "title": "Old", "description": "", "completed": true}}}`
+	if err := os.WriteFile(filePath, []byte(legacy), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	store := newTestJSONStore(t, filePath)
+	if task, err := store.GetTask(context.Background(), "alice", 1); err != nil || !task.Completed || task.Version != 1 {
+		t.Fatalf("Expected legacy task to load, got %+v, %v", task, err)
+	}
+
+	backup, err := os.ReadFile(filePath + ".v0")
+	if err != nil || string(backup) != legacy {
+		t.Errorf("Expected the original file to be backed up before upgrading, got %q, %v", backup, err)
+	}
+
+	var envelope dataFileEnvelope
+	raw, _ := os.ReadFile(filePath)
+	if err := json.Unmarshal(raw, &envelope); err != nil || envelope.Version != currentSchemaVersion(schemaKindTasks) || envelope.Kind != schemaKindTasks {
+		t.Errorf("Expected the file to be rewritten in the current format, got %s", raw)
+	}
+}
+
+func TestNewerDataFileIsRefused(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "users.json")
+	if err := os.WriteFile(filePath, []byte(`{"version": 99, "kind": "users", "data": {}}`), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	users := make(map[string]User)
+	err := loadJSONFileWithRecovery(filePath, schemaKindUsers, 3, &users)
+
+	var newer *schemaVersionError
+	if !errors.As(err, &newer) || newer.Version != 99 {
+		t.Fatalf("Expected a schema version error, got %v", err)
+	}
+
+	if raw, _ := os.ReadFile(filePath); !strings.Contains(string(raw), `"version": 99`) {
+		t.Error("A newer file must be left untouched")
+	}
+}
+
+func TestUpgradeStepsRunInOrder(t *testing.T) {
+	schemaUpgrades["test"] = []schemaUpgrade{
+		upgradeLegacyFile,
+		func(data json.RawMessage) (json.RawMessage, error) {
+			// Version 1 stored a bare list of names, version 2 stores objects
+			var names []string
+			if err := json.Unmarshal(data, &names); err != nil {
+				return nil, err
+			}
+			items := make([]map[string]string, 0, len(names))
+			for _, name := range names {
+				items = append(items, map[string]string{"name": name})
+			}
+			return json.Marshal(items)
+		},
+	}
+	defer delete(schemaUpgrades, "test")
+
+	filePath := filepath.Join(t.TempDir(), "test.json")
+	if err := os.WriteFile(filePath, []byte(`["a", "b"]`), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	var items []map[string]string
+	version, err := decodeDataFile(filePath, "test", &items)
+	if err != nil || version != 0 {
+		t.Fatalf("Expected version 0 to decode, got %d, %v", version, err)
+	}
+	if len(items) != 2 || items[1]["name"] != "b" {
+		t.Errorf("Expected upgraded items, got %v", items)
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// ErrInvalidSearch is returned for a search query without any words.
+var ErrInvalidSearch = errors.New("invalid search query")
+
+// Fields of a task that are searched, with how much a match in each counts
+const (
+	searchFieldTitle = iota
+	searchFieldDescription
+	searchFieldCount
+)
+
+var searchFieldWeights = [searchFieldCount]float64{2, 1}
+
+// BM25 parameters: how quickly repeated words stop adding to the score, and how much
+// long fields are penalized.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// Search results returned when no limit is asked for, and the most returned at once
+const (
+	defaultSearchResults = 20
+	maxSearchResults     = 100
+)
+
+// searchEventBuffer is how many task events may wait for the index before some are
+// dropped and the index is rebuilt from the store.
+const searchEventBuffer = 4096
+
+// taskSearch is the index of the task store the program runs with.
+var taskSearch = newSearchIndex()
+
+// SearchResult is a matching task with its relevance; higher scores rank first.
+type SearchResult struct {
+	Task  Task    `json:"task"`
+	Score float64 `json:"score"`
+}
+
+// searchIndex is an inverted index from word stems to the tasks containing them,
+// kept separately for each user.
+type searchIndex struct {
+	mutex sync.RWMutex
+	users map[string]*userSearchIndex
+}
+
+type userSearchIndex struct {
+	docs        map[int]*searchDoc
+	postings    map[string]map[int]*searchPosting // Stem to task ID
+	words       map[string]map[int]int            // Unstemmed word to task ID and count, for prefixes
+	fieldLength [searchFieldCount]int             // Total tokens per field, for the average
+}
+
+type searchDoc struct {
+	task   Task
+	stems  [searchFieldCount][]string
+	words  []string
+	length [searchFieldCount]int
+}
+
+// searchPosting lists where a stem occurs in one task, by field.
+type searchPosting struct {
+	positions [searchFieldCount][]int
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{users: make(map[string]*userSearchIndex)}
+}
+
+// tokenize splits text into lower-case words of letters and digits.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// initializeSearch indexes the tasks in the task store and keeps the index up to date
+// from the events of taskEvents.
+func initializeSearch() {
+	// Subscribe first, so no change made while the store is read is missed
+	sub := taskEvents.SubscribeAfter(searchEventBuffer)
+	if err := taskSearch.rebuildFrom(context.Background(), taskStore); err != nil {
+		fmt.Println("Error indexing tasks for search:", err)
+		os.Exit(1)
+	}
+	go taskSearch.follow(sub, taskStore)
+}
+
+// follow applies events to the index until sub is closed. Events are applied in the
+// order they happened, so replaying a gapless run of changes the index already holds
+// ends in the current state. When events were dropped there is a gap: the buffered
+// events are discarded and the index is rebuilt from store. Replaying them after the
+// rebuild could bring back content older than the snapshot.
+func (index *searchIndex) follow(sub *Subscription, store TaskStore) {
+	var dropped uint64
+	for event := range sub.Events() {
+		if missed := sub.Dropped(); missed != dropped {
+			dropped = missed
+			logger.Warn("Rebuilding the search index after missing task events", "missed", missed)
+			// Events are published after the change is stored, so the snapshot holds
+			// every discarded one
+			discardEvents(sub.Events())
+			if err := index.rebuildFrom(context.Background(), store); err != nil {
+				logger.Error("Error rebuilding the search index", "error", err)
+			}
+			continue
+		}
+		index.apply(event)
+	}
+}
+
+// discardEvents empties the buffer of events without waiting for more.
+func discardEvents(events <-chan TaskEvent) {
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (index *searchIndex) rebuildFrom(ctx context.Context, store TaskStore) error {
+	tasks, err := store.SnapshotTasks(ctx)
+	if err != nil {
+		return err
+	}
+	index.Rebuild(tasks)
+	return nil
+}
+
+// Rebuild replaces the whole index with tasks, keyed by userName and ID.
+func (index *searchIndex) Rebuild(tasks map[string]map[int]Task) {
+	users := make(map[string]*userSearchIndex, len(tasks))
+	for userName, userTasks := range tasks {
+		user := newUserSearchIndex()
+		for _, task := range userTasks {
+			user.add(task)
+		}
+		users[userName] = user
+	}
+
+	index.mutex.Lock()
+	index.users = users
+	index.mutex.Unlock()
+}
+
+// Index adds task, replacing any earlier version of it.
+func (index *searchIndex) Index(userName string, task Task) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	user, exists := index.users[userName]
+	if !exists {
+		user = newUserSearchIndex()
+		index.users[userName] = user
+	}
+	user.remove(task.ID)
+	user.add(task)
+}
+
+// Remove drops a task from the index.
+func (index *searchIndex) Remove(userName string, id int) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	if user, exists := index.users[userName]; exists {
+		user.remove(id)
+		if len(user.docs) == 0 {
+			delete(index.users, userName)
+		}
+	}
+}
+
+// apply updates the index for a change published by the task store.
+func (index *searchIndex) apply(event TaskEvent) {
+	if event.After != nil {
+		index.Index(event.UserName, *event.After)
+	} else {
+		index.Remove(event.UserName, event.TaskID)
+	}
+}
+
+func newUserSearchIndex() *userSearchIndex {
+	return &userSearchIndex{
+		docs:     make(map[int]*searchDoc),
+		postings: make(map[string]map[int]*searchPosting),
+		words:    make(map[string]map[int]int),
+	}
+}
+
+func (user *userSearchIndex) add(task Task) {
+	doc := &searchDoc{task: task}
+	for field, text := range [searchFieldCount]string{task.Title, task.Description} {
+		words := tokenize(text)
+		doc.length[field] = len(words)
+		user.fieldLength[field] += len(words)
+
+		for position, word := range words {
+			stem := stemEnglish(word)
+			doc.stems[field] = append(doc.stems[field], stem)
+			doc.words = append(doc.words, word)
+
+			if user.postings[stem] == nil {
+				user.postings[stem] = make(map[int]*searchPosting)
+			}
+			posting := user.postings[stem][task.ID]
+			if posting == nil {
+				posting = &searchPosting{}
+				user.postings[stem][task.ID] = posting
+			}
+			posting.positions[field] = append(posting.positions[field], position)
+
+			if user.words[word] == nil {
+				user.words[word] = make(map[int]int)
+			}
+			user.words[word][task.ID]++
+		}
+	}
+	user.docs[task.ID] = doc
+}
+
+func (user *userSearchIndex) remove(id int) {
+	doc, exists := user.docs[id]
+	if !exists {
+		return
+	}
+
+	for field := range doc.stems {
+		user.fieldLength[field] -= doc.length[field]
+		for _, stem := range doc.stems[field] {
+			delete(user.postings[stem], id)
+			if len(user.postings[stem]) == 0 {
+				delete(user.postings, stem)
+			}
+		}
+	}
+	for _, word := range doc.words {
+		delete(user.words[word], id)
+		if len(user.words[word]) == 0 {
+			delete(user.words, word)
+		}
+	}
+	delete(user.docs, id)
+}
+
+// Search queries: words must all occur (in any form: "deploy" finds "deployed"),
+// "quoted phrases" must occur as written, and a trailing * matches any word
+// starting with what comes before it.
+type searchClause struct {
+	stems  []string // One for a word, several for a phrase
+	prefix string   // Set for prefix clauses instead of stems
+}
+
+// parseSearchQuery splits a query into clauses that must all match.
+func parseSearchQuery(query string) ([]searchClause, error) {
+	var clauses []searchClause
+
+	parts := strings.Split(query, `"`)
+	for i, part := range parts {
+		if i%2 == 1 { // Inside quotes; an unclosed quote runs to the end
+			if words := tokenize(part); len(words) > 0 {
+				clauses = append(clauses, searchClause{stems: stemAll(words)})
+			}
+			continue
+		}
+
+		for _, field := range strings.Fields(part) {
+			words := tokenize(field)
+			switch {
+			case len(words) == 0:
+			case strings.HasSuffix(field, "*") && len(words) == 1:
+				clauses = append(clauses, searchClause{prefix: words[0]})
+			default: // Joined words such as "e-mail" are a phrase
+				clauses = append(clauses, searchClause{stems: stemAll(words)})
+			}
+		}
+	}
+
+	if len(clauses) == 0 {
+		return nil, fmt.Errorf("%w: enter at least one word", ErrInvalidSearch)
+	}
+	return clauses, nil
+}
+
+func stemAll(words []string) []string {
+	stems := make([]string, len(words))
+	for i, word := range words {
+		stems[i] = stemEnglish(word)
+	}
+	return stems
+}
+
+// Search returns userName's tasks matching query, best first, at most limit of them
+// (defaultSearchResults when limit is 0).
+func (index *searchIndex) Search(userName, query string, limit int) ([]SearchResult, error) {
+	clauses, err := parseSearchQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		limit = defaultSearchResults
+	}
+	limit = min(limit, maxSearchResults)
+
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	user, exists := index.users[userName]
+	if !exists {
+		return []SearchResult{}, nil
+	}
+
+	// Every clause narrows the matches down and adds to their scores
+	var scores map[int]float64
+	for _, clause := range clauses {
+		clauseScores := user.scoreClause(clause)
+		if scores == nil {
+			scores = clauseScores
+			continue
+		}
+		for id, score := range scores {
+			if clauseScore, matched := clauseScores[id]; matched {
+				scores[id] = score + clauseScore
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+
+	results := make([]SearchResult, 0, len(scores))
+	for id, score := range scores {
+		results = append(results, SearchResult{Task: user.docs[id].task, Score: math.Round(score*1000) / 1000})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Task.ID < results[j].Task.ID
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// scoreClause returns the score of every task the clause matches.
+func (user *userSearchIndex) scoreClause(clause searchClause) map[int]float64 {
+	scores := make(map[int]float64)
+
+	if clause.prefix != "" {
+		// A task scores for the best of its words with the prefix
+		for word, ids := range user.words {
+			if !strings.HasPrefix(word, clause.prefix) {
+				continue
+			}
+			stem := stemEnglish(word)
+			for id := range ids {
+				scores[id] = math.Max(scores[id], user.bm25(stem, id))
+			}
+		}
+		return scores
+	}
+
+	for id := range user.postings[clause.stems[0]] {
+		if len(clause.stems) > 1 && !user.hasPhrase(id, clause.stems) {
+			continue
+		}
+		for _, stem := range clause.stems {
+			scores[id] += user.bm25(stem, id)
+		}
+	}
+	return scores
+}
+
+// hasPhrase reports whether the stems occur one after the other in a field of the task.
+func (user *userSearchIndex) hasPhrase(id int, stems []string) bool {
+	for field := 0; field < searchFieldCount; field++ {
+		for _, start := range user.postings[stems[0]][id].positions[field] {
+			found := true
+			for offset, stem := range stems[1:] {
+				posting := user.postings[stem][id]
+				if posting == nil || !containsInt(posting.positions[field], start+offset+1) {
+					found = false
+					break
+				}
+			}
+			if found {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsInt(sorted []int, n int) bool {
+	i := sort.SearchInts(sorted, n)
+	return i < len(sorted) && sorted[i] == n
+}
+
+// bm25 scores how well a stem describes a task: rarer stems and more occurrences in
+// shorter fields score higher, and title matches count more than description ones.
+func (user *userSearchIndex) bm25(stem string, id int) float64 {
+	posting := user.postings[stem][id]
+	if posting == nil {
+		return 0
+	}
+
+	docs := float64(len(user.docs))
+	docFreq := float64(len(user.postings[stem]))
+	idf := math.Log(1 + (docs-docFreq+0.5)/(docFreq+0.5))
+
+	score := 0.0
+	length := user.docs[id].length
+	for field := 0; field < searchFieldCount; field++ {
+		tf := float64(len(posting.positions[field]))
+		if tf == 0 {
+			continue
+		}
+		average := float64(user.fieldLength[field]) / docs
+		norm := 1 - bm25B + bm25B*float64(length[field])/math.Max(average, 1)
+		score += searchFieldWeights[field] * idf * tf * (bm25K1 + 1) / (tf + bm25K1*norm)
+	}
+	return score
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestStemEnglish(t *testing.T) {
+	cases := map[string]string{
+		"caresses":       "caress",
+		"ponies":         "poni",
+		"cats":           "cat",
+		"agreed":         "agre",
+		"motoring":       "motor",
+		"hopping":        "hop",
+		"filing":         "file",
+		"happy":          "happi",
+		"relational":     "relat",
+		"generalization": "gener",
+		"connection":     "connect",
+		"connecting":     "connect",
+		"hopefulness":    "hope",
+		"adjustment":     "adjust",
+		"controlling":    "control",
+		"go":             "go",
+		"2024":           "2024",
+		"émile":          "émile",
+	}
+	for word, stem := range cases {
+		if got := stemEnglish(word); got != stem {
+			t.Errorf("stemEnglish(%q): expected %q, got %q", word, stem, got)
+		}
+	}
+}
+
+func searchTestIndex() *searchIndex {
+	index := newSearchIndex()
+	index.Rebuild(map[string]map[int]Task{
+		"alice": {
+			1: {ID: 1, Title: "Write quarterly report", Description: "Numbers for the board"},
+			2: {ID: 2, Title: "Pay rent", Description: "Reported late last month, pay on time"},
+			3: {ID: 3, Title: "Rent a van", Description: "For moving the boxes"},
+			4: {ID: 4, Title: "Call the landlord", Description: "About the rent"},
+		},
+		"bob": {
+			1: {ID: 1, Title: "Pay rent", Description: ""},
+		},
+	})
+	return index
+}
+
+func searchIDs(results []SearchResult) []int {
+	ids := make([]int, len(results))
+	for i, result := range results {
+		ids[i] = result.Task.ID
+	}
+	return ids
+}
+
+func TestSearchIndexQueries(t *testing.T) {
+	index := searchTestIndex()
+
+	cases := []struct {
+		query string
+		ids   []int
+	}{
+		{"rent", []int{2, 3, 4}}, // Title matches rank above description ones, shorter titles first
+		{"reporting", []int{1, 2}},
+		{"RENT pay", []int{2}},
+		{`"pay rent"`, []int{2}},
+		{`"rent pay"`, nil},
+		{"rep*", []int{1, 2}},
+		{"land* rent", []int{4}},
+		{"vacation", nil},
+	}
+	for _, c := range cases {
+		results, err := index.Search("alice", c.query, 0)
+		if err != nil {
+			t.Fatalf("%s: %v", c.query, err)
+		}
+		if got := searchIDs(results); !slices.Equal(got, c.ids) {
+			t.Errorf("%s: expected %v, got %v", c.query, c.ids, got)
+		}
+	}
+
+	if results, _ := index.Search("alice", "rent", 1); !slices.Equal(searchIDs(results), []int{2}) {
+		t.Errorf("Expected the limit to keep the best result, got %v", searchIDs(results))
+	}
+	if results, _ := index.Search("carol", "rent", 0); len(results) != 0 {
+		t.Errorf("Expected no results for a user without tasks, got %v", results)
+	}
+	if _, err := index.Search("alice", ` " * `, 0); !errors.Is(err, ErrInvalidSearch) {
+		t.Errorf("Expected a query without words to be rejected, got %v", err)
+	}
+}
+
+func TestSearchIndexFollowsTaskEvents(t *testing.T) {
+	bus := newEventBus()
+	store := newEventTaskStore(localTaskStore(), bus)
+	ctx := context.Background()
+	mustAddTask(t, store, "alice", "Existing task", "")
+
+	index := newSearchIndex()
+	sub := bus.Subscribe(10)
+	if err := index.rebuildFrom(ctx, store); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		index.follow(sub, store)
+		close(done)
+	}()
+
+	renamed := mustAddTask(t, store, "alice", "Draft budget", "")
+	removed := mustAddTask(t, store, "alice", "Budget meeting", "")
+	title := "Final budget"
+	if _, err := store.UpdateTask(ctx, "alice", renamed.ID, 0, TaskUpdate{Title: &title}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RemoveTask(ctx, "alice", removed.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	sub.Close()
+	<-done
+
+	for query, ids := range map[string][]int{"budget": {renamed.ID}, "draft": nil, "existing": {1}} {
+		results, err := index.Search("alice", query, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := searchIDs(results); !slices.Equal(got, ids) {
+			t.Errorf("%s: expected %v, got %v", query, ids, got)
+		}
+	}
+}
+
+func TestSearchIndexRebuildDiscardsOlderEvents(t *testing.T) {
+	bus := newEventBus()
+	store := newEventTaskStore(localTaskStore(), bus)
+	index := newSearchIndex()
+	sub := bus.Subscribe(1)
+
+	task := mustAddTask(t, store, "alice", "Draft budget", "")
+	title := "Final plan"
+	if _, err := store.UpdateTask(context.Background(), "alice", task.ID, 0, TaskUpdate{Title: &title}); err != nil {
+		t.Fatal(err) // Its event does not fit in the buffer
+	}
+	sub.Close()
+	index.follow(sub, store)
+
+	for query, ids := range map[string][]int{"draft": nil, "plan": {task.ID}} {
+		results, err := index.Search("alice", query, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := searchIDs(results); !slices.Equal(got, ids) {
+			t.Errorf("%s: expected %v, got %v", query, ids, got)
+		}
+	}
+}
+
+func TestSearchHandler(t *testing.T) {
+	previousSearch, previousUsers := taskSearch, userStore
+	taskSearch, userStore = searchTestIndex(), newMemoryUserStore()
+	defer func() { taskSearch, userStore = previousSearch, previousUsers }()
+
+	rec := httptest.NewRecorder()
+	searchHandler(rec, httptest.NewRequest(http.MethodGet, "/search?username=bob&q=rent", nil))
+	var results []SearchResult
+	if err := json.NewDecoder(rec.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || len(results) != 1 || results[0].Task.Title != "Pay rent" || results[0].Score <= 0 {
+		t.Errorf("Expected bob's task with a score, got %d %+v", rec.Code, results)
+	}
+
+	for _, target := range []string{"/search?username=bob&q=", "/search?username=bob&q=rent&limit=0"} {
+		rec := httptest.NewRecorder()
+		searchHandler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", target, rec.Code)
+		}
+	}
+}
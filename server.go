@@ -1,25 +1,153 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
+	"net/url"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 )
 
-const traceIDKey = "TraceID"
+// contextKey keeps our context values from colliding with other packages' keys.
+type contextKey string
 
-func startServer() {
+const traceIDKey contextKey = "TraceID"
+
+// traceIDFrom returns the request trace ID carried by ctx, or "" outside a request.
+func traceIDFrom(ctx context.Context) string {
+	traceID, _ := ctx.Value(traceIDKey).(string)
+	return traceID
+}
+
+// apiPrefix is where the REST API is served.
+const apiPrefix = "/api/v1"
+
+// apiRoutes are the REST API endpoints, served under apiPrefix. A request with
+// another method for one of these paths is answered with 405 and an Allow header.
+var apiRoutes = []struct {
+	pattern string
+	handler http.HandlerFunc
+}{
+	{"GET /tasks", listTasksHandler},                    // Task list
+	{"POST /tasks", createTaskHandler},                  // Task creation
+	{"GET /tasks/{id}", getTaskHandler},                 // Single task
+	{"PUT /tasks/{id}", completeTaskHandler},            // Mark a task as completed
+	{"PATCH /tasks/{id}", updateTaskHandler},            // Change a task
+	{"DELETE /tasks/{id}", deleteTaskHandler},           // Delete a task
+	{"POST /tasks/batch", batchHandler},                 // Several task operations at once
+	{"GET /search", searchHandler},                      // Full-text task search
+	{"GET /views", listViewsHandler},                    // Saved filters
+	{"POST /views", saveViewHandler},                    // Save a filter
+	{"DELETE /views/{key}", deleteViewHandler},          // Delete a saved filter
+	{"POST /users", addUserHandler},                     // User creation
+	{"GET /users/list", listUsersHandler},               // List users
+	{"DELETE /users/me", currentUserHandler},            // Self-service account deletion
+	{"POST /users/me/password", changePasswordHandler},  // Self-service password change
+	{"POST /users/me/totp", enrollTOTPHandler},          // Start two-factor enrollment
+	{"POST /users/me/totp/verify", verifyTOTPHandler},   // Confirm two-factor enrollment
+	{"DELETE /admin/users/totp", adminResetTOTPHandler}, // Admin two-factor reset
+	{"GET /admin/snapshot", adminSnapshotHandler},       // Backup of all tasks and users
+	{"GET /admin/cache", adminCacheHandler},             // Task cache hit and miss counts
+}
+
+// newRouter maps requests to handlers: the REST API under apiPrefix and the web pages
+// at the root. The API is also served at its old paths without the prefix, so
+// existing clients keep working; those responses carry a Deprecation header.
+func newRouter() *http.ServeMux {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/tasks", taskHandler)           // Task list and creation
-	mux.HandleFunc("/tasks/", singleTaskHandler)    // Single task operations by ID
-	mux.HandleFunc("/users", addUserHandler)        // User creation
-	mux.HandleFunc("/users/list", listUsersHandler) // List users
-	mux.HandleFunc("/login", loginHandler)          // Login page
-	mux.HandleFunc("/register", registerHandler)    // Registration page
-	mux.HandleFunc("/tasks/view", tasksHandler)     // View tasks (templated UI)
+	allowed := make(map[string][]string) // Path to its methods
+	for _, route := range apiRoutes {
+		method, path, _ := strings.Cut(route.pattern, " ")
+		mux.HandleFunc(method+" "+apiPrefix+path, route.handler)
+		mux.Handle(route.pattern, deprecatedPath(route.handler))
+		allowed[path] = append(allowed[path], method)
+	}
+
+	// The mux only answers 405 for a path no pattern matches with the request's method.
+	// A wildcard path would take the other methods of a fixed one, as GET /tasks/{id}
+	// does for GET /tasks/batch, so those are refused explicitly.
+	refused := make(map[string]bool)
+	for path, methods := range allowed {
+		for other, otherMethods := range allowed {
+			if !wildcardMatches(other, path) {
+				continue
+			}
+			for _, method := range otherMethods {
+				pattern := method + " " + path
+				if slices.Contains(methods, method) || refused[pattern] {
+					continue
+				}
+				refused[pattern] = true
+				mux.HandleFunc(method+" "+apiPrefix+path, methodNotAllowed(methods))
+				mux.Handle(pattern, deprecatedPath(methodNotAllowed(methods)))
+			}
+		}
+	}
+
+	mux.HandleFunc("GET /login", loginHandler)                      // Login page
+	mux.HandleFunc("POST /login", loginHandler)                     // Login form
+	mux.HandleFunc("GET /login/oidc", oidcLoginHandler)             // Single sign-on redirect
+	mux.HandleFunc("GET /login/oidc/callback", oidcCallbackHandler) // Single sign-on callback
+	mux.HandleFunc("GET /register", registerHandler)                // Registration page
+	mux.HandleFunc("POST /register", registerHandler)               // Registration form
+	mux.HandleFunc("GET /tasks/view", tasksHandler)                 // View tasks (templated UI)
+	mux.HandleFunc("GET /account", accountHandler)                  // Account settings page
+	mux.HandleFunc("POST /account", accountHandler)                 // Account settings forms
+	return mux
+}
+
+// wildcardMatches reports whether the path pattern, which has wildcards, matches the
+// fixed path.
+func wildcardMatches(pattern, path string) bool {
+	if !strings.Contains(pattern, "{") || strings.Contains(path, "{") {
+		return false
+	}
+	patternSegments, pathSegments := strings.Split(pattern, "/"), strings.Split(path, "/")
+	if len(patternSegments) != len(pathSegments) {
+		return false
+	}
+	for i, segment := range patternSegments {
+		if segment != pathSegments[i] && !strings.HasPrefix(segment, "{") {
+			return false
+		}
+	}
+	return true
+}
+
+// methodNotAllowed answers 405 with an Allow header listing methods, as the mux does.
+func methodNotAllowed(methods []string) http.HandlerFunc {
+	allow := slices.Clone(methods)
+	if slices.Contains(allow, http.MethodGet) {
+		allow = append(allow, http.MethodHead)
+	}
+	slices.Sort(allow)
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", strings.Join(allow, ", "))
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// deprecatedPath marks responses to an API path without apiPrefix as deprecated and
+// links to the path that replaces it.
+func deprecatedPath(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		successor := url.URL{Path: apiPrefix + r.URL.Path}
+		w.Header().Set("Deprecation", "true")
+		w.Header().Add("Link", "<"+successor.String()+`>; rel="successor-version"`)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func startServer() {
+	mux := newRouter()
 
 	loggedMux := TraceMiddleware(mux)
 
@@ -32,7 +160,13 @@ func startServer() {
 
 func listUsersHandler(w http.ResponseWriter, _ *http.Request) {
 	users := userStore.ListUsers()
-	writeJSONResponse(w, http.StatusOK, users)
+
+	// Only expose usernames; passwords and two-factor secrets stay server-side
+	summaries := make([]userSummary, 0, len(users))
+	for _, user := range users {
+		summaries = append(summaries, userSummary{Username: user.Username})
+	}
+	writeJSONResponse(w, http.StatusOK, summaries)
 }
 
 func addUserHandler(w http.ResponseWriter, r *http.Request) {
@@ -42,102 +176,647 @@ func addUserHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := userStore.AddUser(user.Username, user.Password); err != nil {
+		var invalid *validationError
+		if errors.As(err, &invalid) {
+			writeJSONResponse(w, http.StatusBadRequest, errorResponse{Error: "Invalid registration", Details: invalid.Errors})
+			return
+		}
+		writeJSONResponse(w, http.StatusConflict, errorResponse{Error: err.Error()})
+		return
+	}
+
+	writeJSONResponse(w, http.StatusCreated, userSummary{Username: normalizeUsername(user.Username)})
+}
+
+func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	traceID := traceIDFrom(r.Context())
+
+	userName := requestUserName(r)
+	if userName == "" {
+		http.Error(w, "Username is required", http.StatusBadRequest)
+		return
+	}
+
+	var req passwordChangeRequest
+	if !parseJSONRequest(w, r, &req) {
+		return
+	}
+
+	if errs := passwordRules.Validate(userName, req.NewPassword); len(errs) > 0 {
+		writeJSONResponse(w, http.StatusBadRequest, errorResponse{Error: "Invalid password", Details: errs})
+		return
+	}
+
+	if err := authenticate(userName, req.OldPassword, clientIP(r)); err != nil {
+		logger.Error("Password change rejected", "traceID", traceID, "userName", userName, "error", err)
+		writeAuthenticationError(w, err)
+		return
+	}
+
+	if err := userStore.ChangePassword(userName, req.OldPassword, req.NewPassword); err != nil {
+		logger.Error("Failed to change password", "traceID", traceID, "userName", userName, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info("Password changed", "traceID", traceID, "userName", userName)
+	w.WriteHeader(http.StatusOK)
+}
+
+func currentUserHandler(w http.ResponseWriter, r *http.Request) {
+	traceID := traceIDFrom(r.Context())
+
+	userName := requestUserName(r)
+	if userName == "" {
+		http.Error(w, "Username is required", http.StatusBadRequest)
+		return
+	}
+
+	var req accountDeleteRequest
+	if !parseJSONRequest(w, r, &req) {
+		return
+	}
+
+	if err := confirmAccountDeletion(userName, req.Password, clientIP(r)); err != nil {
+		logger.Error("Account deletion rejected", "traceID", traceID, "userName", userName, "error", err)
+		writeAuthenticationError(w, err)
+		return
+	}
+
+	if err := deleteAccount(r.Context(), userName); err != nil {
+		logger.Error("Failed to delete account", "traceID", traceID, "userName", userName, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if loggedInUsername == userName {
+		isLoggedIn = false
+		loggedInUsername = ""
+	}
+
+	logger.Info("Account deleted", "traceID", traceID, "userName", userName)
+	w.WriteHeader(http.StatusOK)
+}
+
+func enrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	traceID := traceIDFrom(r.Context())
+
+	userName := requestUserName(r)
+	if userName == "" {
+		http.Error(w, "Username is required", http.StatusBadRequest)
+		return
+	}
+
+	var req totpEnrollRequest
+	if !parseJSONRequest(w, r, &req) {
+		return
+	}
+
+	if err := authenticate(userName, req.Password, clientIP(r)); err != nil {
+		logger.Error("Two-factor enrollment rejected", "traceID", traceID, "userName", userName, "error", err)
+		writeAuthenticationError(w, err)
+		return
+	}
+
+	secret, err := userStore.EnrollTOTP(userName)
+	if err != nil {
+		logger.Error("Failed to start two-factor enrollment", "traceID", traceID, "userName", userName, "error", err)
 		http.Error(w, err.Error(), http.StatusConflict)
 		return
 	}
 
-	writeJSONResponse(w, http.StatusCreated, user)
+	logger.Info("Two-factor enrollment started", "traceID", traceID, "userName", userName)
+	writeJSONResponse(w, http.StatusOK, totpEnrollResponse{Secret: secret, URI: totpURI(userName, secret)})
+}
+
+func verifyTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	traceID := traceIDFrom(r.Context())
+
+	userName := requestUserName(r)
+	if userName == "" {
+		http.Error(w, "Username is required", http.StatusBadRequest)
+		return
+	}
+
+	var req totpVerifyRequest
+	if !parseJSONRequest(w, r, &req) {
+		return
+	}
+
+	// The code is only six digits, so wrong codes count towards a lockout like wrong
+	// passwords do. The password keeps others from guessing at a pending enrollment.
+	ip := clientIP(r)
+	if err := loginLimiter.Allow(userName, ip); err != nil {
+		logger.Warn("Two-factor verification throttled", "traceID", traceID, "userName", userName, "ip", ip, "error", err)
+		writeAuthenticationError(w, err)
+		return
+	}
+	if err := userStore.CheckPassword(userName, req.Password); err != nil {
+		loginLimiter.RecordFailure(userName, ip)
+		logger.Error("Two-factor verification rejected", "traceID", traceID, "userName", userName, "error", err)
+		writeAuthenticationError(w, err)
+		return
+	}
+
+	codes, err := userStore.ConfirmTOTP(userName, req.Code, time.Now())
+	if err != nil {
+		loginLimiter.RecordFailure(userName, ip)
+		logger.Error("Two-factor verification failed", "traceID", traceID, "userName", userName, "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	loginLimiter.RecordSuccess(userName)
+
+	auditLogger.Info("Two-factor authentication enabled", "traceID", traceID, "userName", userName)
+	writeJSONResponse(w, http.StatusOK, totpVerifyResponse{RecoveryCodes: codes})
 }
 
-func taskHandler(w http.ResponseWriter, r *http.Request) {
-	traceID := r.Context().Value(traceIDKey).(string)
+func adminResetTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	traceID := traceIDFrom(r.Context())
 
-	var userName string
-	if r.URL.Query().Get("username") != "" { // API case
-		userName = r.URL.Query().Get("username")
-	} else { // CLI case or session
-		userName = loggedInUsername
+	if !requireAdmin(w, r) {
+		return
 	}
 
+	userName := queryUserName(r)
 	if userName == "" {
 		http.Error(w, "Username is required", http.StatusBadRequest)
 		return
 	}
 
-	switch r.Method {
-	case http.MethodGet:
-		logger.Info("Listing tasks", "traceID", traceID, "userName", userName)
-		tasks := taskStore.ListTasks(userName)
-		writeJSONResponse(w, http.StatusOK, tasks)
+	if err := userStore.ResetTOTP(userName); err != nil {
+		logger.Error("Failed to reset two-factor authentication", "traceID", traceID, "userName", userName, "error", err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 
-	case http.MethodPost:
-		logger.Info("Creating task", "traceID", traceID, "userName", userName)
-		var task Task
-		if !parseJSONRequest(w, r, &task) {
-			return
-		}
-		newTask := taskStore.AddTask(userName, task.Title, task.Description)
-		logger.Info("Added task", "traceID", traceID, "taskID", newTask.ID, "userName", userName)
-		writeJSONResponse(w, http.StatusCreated, newTask)
+	w.WriteHeader(http.StatusOK)
+}
 
-	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		logger.Error("Unsupported method", "method", r.Method, "traceID", traceID)
+// adminSnapshotHandler returns a snapshot archive of all tasks and users, taken while
+// the server keeps serving requests.
+func adminSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	traceID := traceIDFrom(r.Context())
+
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	snap, err := takeSnapshot(r.Context(), taskStore, userStore)
+	if err != nil {
+		logger.Error("Failed to take snapshot", "traceID", traceID, "error", err)
+		writeStoreError(w, err)
+		return
+	}
+
+	// Build the archive first, so a failure can still be reported with a status code
+	var archive bytes.Buffer
+	now := time.Now()
+	manifest, err := writeSnapshot(&archive, snap, now)
+	if err != nil {
+		logger.Error("Failed to write snapshot", "traceID", traceID, "error", err)
+		http.Error(w, "Failed to write snapshot", http.StatusInternalServerError)
+		return
+	}
+
+	auditLogger.Info("Snapshot taken", "traceID", traceID, "tasks", manifest.Tasks, "users", manifest.Users, "ip", clientIP(r))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+snapshotFileName(now)+`"`)
+	if _, err := archive.WriteTo(w); err != nil {
+		logger.Error("Failed to send snapshot", "traceID", traceID, "error", err)
 	}
 }
 
-func singleTaskHandler(w http.ResponseWriter, r *http.Request) {
-	traceID := r.Context().Value(traceIDKey).(string)
-	userName := r.URL.Query().Get("username") // Get username from query parameters
-	idStr := strings.TrimPrefix(r.URL.Path, "/tasks/")
+func adminCacheHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
 
-	id, err := strconv.Atoi(idStr)
-	if err != nil || id <= 0 {
-		logger.Error("Invalid task id", "id", id, "traceID", traceID)
-		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+	cache, ok := taskStore.(*cachingTaskStore)
+	if !ok {
+		http.Error(w, "Task cache is disabled", http.StatusNotFound)
 		return
 	}
+	writeJSONResponse(w, http.StatusOK, cache.Stats())
+}
+
+// requireAdmin checks the bearer token against TODO_ADMIN_TOKEN. Admin endpoints are
+// disabled when the variable is unset.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	adminToken := os.Getenv("TODO_ADMIN_TOKEN")
+	if adminToken == "" {
+		http.Error(w, "Admin endpoints are disabled", http.StatusForbidden)
+		return false
+	}
 
-	switch r.Method {
-	case http.MethodGet: // Fetch a single task
-		logger.Info("Fetching task", "taskID", id, "traceID", traceID, "userName", userName)
-		task, err := taskStore.GetTask(userName, id)
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		auditLogger.Warn("Rejected admin request", "url", r.URL.Path, "ip", clientIP(r))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// requestUserName returns the username from the query string, falling back to the CLI session.
+func requestUserName(r *http.Request) string {
+	if userName := queryUserName(r); userName != "" {
+		return userName
+	}
+	return loggedInUsername
+}
+
+// queryUserName returns the account named by the username query parameter, if any.
+func queryUserName(r *http.Request) string {
+	userName := r.URL.Query().Get("username")
+	if userName == "" {
+		return ""
+	}
+	return userStore.ResolveUsername(userName)
+}
+
+// listTasksHandler returns the user's tasks, filtered, sorted and paged as the query asks.
+func listTasksHandler(w http.ResponseWriter, r *http.Request) {
+	traceID := traceIDFrom(r.Context())
+
+	userName := requestUserName(r)
+	if userName == "" {
+		http.Error(w, "Username is required", http.StatusBadRequest)
+		return
+	}
+
+	logger.Info("Listing tasks", "traceID", traceID, "userName", userName)
+	query, err := parseTaskQuery(r.URL.Query())
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if key := r.URL.Query().Get("view"); key != "" {
+		filter, err := viewFilter(userName, key)
 		if err != nil {
-			logger.Error("Task not found", "taskID", id, "traceID", traceID, "userName", userName)
-			http.Error(w, "Task not found", http.StatusNotFound)
+			writeViewError(w, err)
 			return
 		}
-		writeJSONResponse(w, http.StatusOK, task)
+		query.Filter = filter.And(query.Filter)
+	}
+
+	page, err := taskStore.QueryTasks(r.Context(), userName, query)
+	if err != nil {
+		logger.Error("Failed to list tasks", "traceID", traceID, "userName", userName, "error", err)
+		writeStoreError(w, err)
+		return
+	}
 
-	case http.MethodPut: // Mark task as complete
-		logger.Info("Marking task as complete", "taskID", id, "traceID", traceID, "userName", userName)
-		if err := taskStore.CompleteTask(userName, id); err != nil {
-			logger.Error("Failed to complete task", "taskID", id, "traceID", traceID, "userName", userName, "error", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	w.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+	if page.NextCursor != "" {
+		w.Header().Add("Link", nextPageLink(r.URL, page.NextCursor))
+	}
+
+	etag := listETag(page.Tasks)
+	w.Header().Set("ETag", etag)
+	if !noneMatch(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, page.Tasks)
+}
+
+func createTaskHandler(w http.ResponseWriter, r *http.Request) {
+	traceID := traceIDFrom(r.Context())
+
+	userName := requestUserName(r)
+	if userName == "" {
+		http.Error(w, "Username is required", http.StatusBadRequest)
+		return
+	}
+
+	logger.Info("Creating task", "traceID", traceID, "userName", userName)
+	var task Task
+	if !parseJSONRequest(w, r, &task) {
+		return
+	}
+	newTask, err := taskStore.AddTask(r.Context(), userName, task.Title, task.Description)
+	if err != nil {
+		logger.Error("Failed to add task", "traceID", traceID, "userName", userName, "error", err)
+		writeStoreError(w, err)
+		return
+	}
+	logger.Info("Added task", "traceID", traceID, "taskID", newTask.ID, "userName", userName)
+	w.Header().Set("ETag", taskETag(newTask))
+	writeJSONResponse(w, http.StatusCreated, newTask)
+}
+
+// nextPageLink builds the Link header pointing at the page after the current one.
+func nextPageLink(current *url.URL, cursor string) string {
+	params := current.Query()
+	params.Set("cursor", cursor)
+	next := url.URL{Path: current.Path, RawQuery: params.Encode()}
+	return "<" + next.String() + `>; rel="next"`
+}
+
+// searchHandler returns the user's tasks matching q, best match first.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	traceID := traceIDFrom(r.Context())
+
+	userName := requestUserName(r)
+	if userName == "" {
+		http.Error(w, "Username is required", http.StatusBadRequest)
+		return
+	}
+
+	limit := 0
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
 			return
 		}
-		w.WriteHeader(http.StatusOK)
+	}
 
-	case http.MethodDelete: // Delete a task
-		logger.Info("Deleting task", "taskID", id, "traceID", traceID, "userName", userName)
-		if err := taskStore.RemoveTask(userName, id); err != nil {
-			logger.Error("Failed to delete task", "taskID", id, "traceID", traceID, "userName", userName, "error", err)
-			http.Error(w, err.Error(), http.StatusNotFound)
-			return
+	logger.Info("Searching tasks", "traceID", traceID, "userName", userName)
+	results, err := taskSearch.Search(userName, r.URL.Query().Get("q"), limit)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, results)
+}
+
+func listViewsHandler(w http.ResponseWriter, r *http.Request) {
+	userName := requestUserName(r)
+	if userName == "" {
+		http.Error(w, "Username is required", http.StatusBadRequest)
+		return
+	}
+
+	views, err := userStore.ListViews(userName)
+	if err != nil {
+		writeViewError(w, err)
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, views)
+}
+
+// saveViewHandler saves a view, replacing any with the same name.
+func saveViewHandler(w http.ResponseWriter, r *http.Request) {
+	traceID := traceIDFrom(r.Context())
+
+	userName := requestUserName(r)
+	if userName == "" {
+		http.Error(w, "Username is required", http.StatusBadRequest)
+		return
+	}
+
+	var req SavedView
+	if !parseJSONRequest(w, r, &req) {
+		return
+	}
+	view, replaced, err := userStore.SaveView(userName, req.Name, req.Filter)
+	if err != nil {
+		logger.Error("Failed to save view", "traceID", traceID, "userName", userName, "error", err)
+		writeViewError(w, err)
+		return
+	}
+	logger.Info("Saved view", "traceID", traceID, "userName", userName, "view", view.Key)
+	status := http.StatusCreated
+	if replaced {
+		status = http.StatusOK
+	}
+	writeJSONResponse(w, status, view)
+}
+
+// deleteViewHandler deletes the saved view named by the path, /views/{key}.
+func deleteViewHandler(w http.ResponseWriter, r *http.Request) {
+	traceID := traceIDFrom(r.Context())
+
+	userName := requestUserName(r)
+	if userName == "" {
+		http.Error(w, "Username is required", http.StatusBadRequest)
+		return
+	}
+
+	key := strings.TrimPrefix(r.PathValue("key"), "@")
+	if err := userStore.DeleteView(userName, key); err != nil {
+		writeViewError(w, err)
+		return
+	}
+	logger.Info("Deleted view", "traceID", traceID, "userName", userName, "view", key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeViewError reports an error from saving, deleting or using a saved view.
+func writeViewError(w http.ResponseWriter, err error) {
+	var invalid *validationError
+	switch {
+	case errors.As(err, &invalid):
+		writeJSONResponse(w, http.StatusBadRequest, errorResponse{Error: "Invalid view", Details: invalid.Errors})
+	case errors.Is(err, ErrViewNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrUserNotFound):
+		http.Error(w, "User not found", http.StatusNotFound)
+	default:
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+func getTaskHandler(w http.ResponseWriter, r *http.Request) {
+	traceID := traceIDFrom(r.Context())
+	userName := queryUserName(r)
+
+	id, ok := taskIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	logger.Info("Fetching task", "taskID", id, "traceID", traceID, "userName", userName)
+	task, err := taskStore.GetTask(r.Context(), userName, id)
+	if err != nil {
+		logger.Error("Failed to fetch task", "taskID", id, "traceID", traceID, "userName", userName, "error", err)
+		writeStoreError(w, err)
+		return
+	}
+	w.Header().Set("ETag", taskETag(task))
+	writeJSONResponse(w, http.StatusOK, task)
+}
+
+// completeTaskHandler marks a task as completed.
+func completeTaskHandler(w http.ResponseWriter, r *http.Request) {
+	traceID := traceIDFrom(r.Context())
+	userName := queryUserName(r)
+
+	id, ok := taskIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	logger.Info("Marking task as complete", "taskID", id, "traceID", traceID, "userName", userName)
+	version, ok := requireIfMatch(w, r)
+	if !ok {
+		return
+	}
+	task, err := taskStore.CompleteTask(r.Context(), userName, id, version)
+	if err != nil {
+		logger.Error("Failed to complete task", "taskID", id, "traceID", traceID, "userName", userName, "error", err)
+		writeStoreError(w, err)
+		return
+	}
+	w.Header().Set("ETag", taskETag(task))
+	w.WriteHeader(http.StatusOK)
+}
+
+// updateTaskHandler changes the title, description or completion of a task.
+func updateTaskHandler(w http.ResponseWriter, r *http.Request) {
+	traceID := traceIDFrom(r.Context())
+	userName := queryUserName(r)
+
+	id, ok := taskIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	logger.Info("Updating task", "taskID", id, "traceID", traceID, "userName", userName)
+	version, ok := requireIfMatch(w, r)
+	if !ok {
+		return
+	}
+	var update TaskUpdate
+	if !parseJSONRequest(w, r, &update) {
+		return
+	}
+	task, err := taskStore.UpdateTask(r.Context(), userName, id, version, update)
+	if err != nil {
+		logger.Error("Failed to update task", "taskID", id, "traceID", traceID, "userName", userName, "error", err)
+		writeStoreError(w, err)
+		return
+	}
+	w.Header().Set("ETag", taskETag(task))
+	writeJSONResponse(w, http.StatusOK, task)
+}
+
+func deleteTaskHandler(w http.ResponseWriter, r *http.Request) {
+	traceID := traceIDFrom(r.Context())
+	userName := queryUserName(r)
+
+	id, ok := taskIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	logger.Info("Deleting task", "taskID", id, "traceID", traceID, "userName", userName)
+	version, ok := requireIfMatch(w, r)
+	if !ok {
+		return
+	}
+	if err := taskStore.RemoveTask(r.Context(), userName, id, version); err != nil {
+		logger.Error("Failed to delete task", "taskID", id, "traceID", traceID, "userName", userName, "error", err)
+		writeStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// taskIDFromPath reads the {id} of the route, answering 400 when it is not a task ID.
+func taskIDFromPath(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id <= 0 {
+		logger.Error("Invalid task id", "id", r.PathValue("id"), "traceID", traceIDFrom(r.Context()))
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	traceID := traceIDFrom(r.Context())
+
+	userName := requestUserName(r)
+	if userName == "" {
+		http.Error(w, "Username is required", http.StatusBadRequest)
+		return
+	}
+
+	var req batchRequest
+	if !parseJSONRequest(w, r, &req) {
+		return
+	}
+
+	if err := validateBatch(req.Operations); err != nil {
+		writeJSONResponse(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+
+	logger.Info("Applying task batch", "traceID", traceID, "operations", len(req.Operations), "userName", userName)
+	results, err := taskStore.ApplyBatch(r.Context(), userName, req.Operations)
+	if err != nil {
+		logger.Error("Failed to apply task batch", "traceID", traceID, "userName", userName, "error", err)
+		status := storeErrorStatus(err)
+		message := http.StatusText(status)
+		var batchErr *BatchError
+		if errors.As(err, &batchErr) && status != http.StatusInternalServerError {
+			message = batchErr.Error()
 		}
-		w.WriteHeader(http.StatusOK)
+		writeJSONResponse(w, status, errorResponse{Error: message})
+		return
+	}
+
+	writeJSONResponse(w, http.StatusOK, batchResponse{Results: results})
+}
 
+// requireIfMatch reads the If-Match header of a task mutation, answering 428 when it
+// is missing.
+func requireIfMatch(w http.ResponseWriter, r *http.Request) (int, bool) {
+	version, err := ifMatchVersion(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusPreconditionRequired)
+		return 0, false
+	}
+	return version, true
+}
+
+// storeErrorStatus maps a TaskStore error to the HTTP status reported to the client.
+func storeErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, ErrVersionMismatch):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, ErrInvalidQuery), errors.Is(err, ErrInvalidSearch):
+		return http.StatusBadRequest
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
 	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		logger.Error("Unsupported method", "method", r.Method, "traceID", traceID)
+		return http.StatusInternalServerError
 	}
 }
 
+// writeStoreError reports a TaskStore error without exposing storage internals.
+func writeStoreError(w http.ResponseWriter, err error) {
+	status := storeErrorStatus(err)
+	message := http.StatusText(status)
+	switch status {
+	case http.StatusNotFound:
+		message = "Task not found"
+	case http.StatusForbidden:
+		message = "Task belongs to another user"
+	case http.StatusConflict:
+		message = "Task already exists"
+	case http.StatusPreconditionFailed:
+		message = "Task was changed by someone else; reload it and try again"
+	case http.StatusBadRequest:
+		message = err.Error() // Describes what is wrong with the request, not the store
+	}
+	http.Error(w, message, status)
+}
+
 func loginHandler(w http.ResponseWriter, r *http.Request) {
 	tmpl, _ := template.ParseFiles("templates/login.html")
 
 	if r.Method == http.MethodGet {
-		err := tmpl.Execute(w, nil)
+		err := tmpl.Execute(w, loginPageData(""))
 		if err != nil {
 			return
 		}
@@ -145,11 +824,24 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.Method == http.MethodPost {
-		username := r.FormValue("username")
+		username := userStore.ResolveUsername(r.FormValue("username"))
 		password := r.FormValue("password")
 
-		if err := userStore.CheckPassword(username, password); err != nil {
-			err := tmpl.Execute(w, map[string]string{"Error": "Invalid credentials"})
+		err := authenticate(username, password, clientIP(r))
+		if err == nil && userStore.TOTPEnabled(username) {
+			err = authenticateSecondFactor(username, r.FormValue("code"), clientIP(r))
+		}
+
+		if err != nil {
+			message := loginFailureMessage(err, "Invalid credentials")
+
+			var throttled *loginThrottledError
+			if errors.As(err, &throttled) {
+				setRetryAfter(w, throttled.RetryAfter)
+				w.WriteHeader(http.StatusTooManyRequests)
+			}
+
+			err := tmpl.Execute(w, loginPageData(message))
 			if err != nil {
 				return
 			}
@@ -160,15 +852,78 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		isLoggedIn = true
 		loggedInUsername = username
 
-		http.Redirect(w, r, "/tasks/view?username="+username, http.StatusSeeOther)
+		http.Redirect(w, r, "/tasks/view?username="+url.QueryEscape(username), http.StatusSeeOther)
+	}
+}
+
+func loginPageData(errorMessage string) map[string]interface{} {
+	return map[string]interface{}{
+		"Error":       errorMessage,
+		"OIDCEnabled": oidcProvider != nil,
+	}
+}
+
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if oidcProvider == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	authURL, err := oidcProvider.AuthCodeURL()
+	if err != nil {
+		logger.Error("Failed to start single sign-on", "error", err)
+		http.Error(w, "Unable to start single sign-on", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	traceID := traceIDFrom(r.Context())
+
+	if oidcProvider == nil {
+		http.NotFound(w, r)
+		return
 	}
+
+	tmpl, _ := template.ParseFiles("templates/login.html")
+	query := r.URL.Query()
+
+	if idpError := query.Get("error"); idpError != "" {
+		logger.Error("Identity provider returned an error", "traceID", traceID, "error", idpError, "description", query.Get("error_description"))
+		_ = tmpl.Execute(w, loginPageData("Single sign-on failed"))
+		return
+	}
+
+	claims, err := oidcProvider.Exchange(query.Get("state"), query.Get("code"))
+	if err != nil {
+		logger.Error("Single sign-on failed", "traceID", traceID, "error", err)
+		_ = tmpl.Execute(w, loginPageData("Single sign-on failed"))
+		return
+	}
+
+	user, err := userStore.ProvisionOIDCUser(claims.Issuer, claims)
+	if err != nil {
+		logger.Error("Failed to provision single sign-on user", "traceID", traceID, "subject", claims.Subject, "error", err)
+		_ = tmpl.Execute(w, loginPageData("Unable to sign in with this account"))
+		return
+	}
+
+	//set flag and username so that CLI works even if we log in through the web app
+	isLoggedIn = true
+	loggedInUsername = user.Username
+	oidcProvider.RecordLogin(user.Username)
+
+	logger.Info("Single sign-on login", "traceID", traceID, "userName", user.Username)
+	http.Redirect(w, r, "/tasks/view?username="+url.QueryEscape(user.Username), http.StatusSeeOther)
 }
 
 func registerHandler(w http.ResponseWriter, r *http.Request) {
 	tmpl, _ := template.ParseFiles("templates/register.html")
 
 	if r.Method == http.MethodGet {
-		err := tmpl.Execute(w, nil)
+		err := tmpl.Execute(w, registerPageData(nil))
 		if err != nil {
 			return
 		}
@@ -180,7 +935,7 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		password := r.FormValue("password")
 
 		if err := userStore.AddUser(username, password); err != nil {
-			err := tmpl.Execute(w, map[string]string{"Error": "User already exists"})
+			err := tmpl.Execute(w, registerPageData(err))
 			if err != nil {
 				return
 			}
@@ -191,14 +946,73 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func registerPageData(err error) map[string]interface{} {
+	data := map[string]interface{}{"PasswordHint": passwordRules.Describe()}
+
+	var invalid *validationError
+	if errors.As(err, &invalid) {
+		data["Errors"] = invalid.Errors
+	} else if err != nil {
+		data["Error"] = "User already exists"
+	}
+	return data
+}
+
 func tasksHandler(w http.ResponseWriter, r *http.Request) {
-	username := r.URL.Query().Get("username")
+	username := queryUserName(r)
 	if username == "" {
 		http.Error(w, "User not specified", http.StatusBadRequest)
 		return
 	}
 
-	tasks := taskStore.ListTasks(username)
+	// A filter narrows the list down; a search shows the matching tasks, best first
+	filterText := strings.TrimSpace(r.URL.Query().Get("q"))
+	var filter *TaskFilter
+	var filterError string
+	if filterText != "" {
+		var err error
+		if filter, err = parseTaskFilter(filterText, time.Now()); err != nil {
+			filterError = err.Error()
+		}
+	}
+
+	// Saved views are shown as tabs; the selected one filters the list as well
+	views, err := userStore.ListViews(username)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		logger.Error("Failed to list views", "traceID", traceIDFrom(r.Context()), "userName", username, "error", err)
+	}
+	activeView := r.URL.Query().Get("view")
+	if activeView != "" {
+		saved, err := viewFilter(username, activeView)
+		if err != nil {
+			filterError = err.Error()
+		}
+		filter = saved.And(filter)
+	}
+
+	search := strings.TrimSpace(r.URL.Query().Get("search"))
+	var tasks []Task
+	var searchError string
+	if search != "" {
+		results, err := taskSearch.Search(username, search, maxSearchResults)
+		if err != nil {
+			searchError = "Enter at least one word to search for"
+		}
+		for _, result := range results {
+			if filter == nil || filter.Match(result.Task) {
+				tasks = append(tasks, result.Task)
+			}
+		}
+	} else {
+		page, err := taskStore.QueryTasks(r.Context(), username, TaskQuery{Filter: filter})
+		if err != nil {
+			logger.Error("Failed to list tasks", "traceID", traceIDFrom(r.Context()), "userName", username, "error", err)
+			writeStoreError(w, err)
+			return
+		}
+		tasks = page.Tasks
+	}
+
 	tmpl, err := template.ParseFiles("templates/tasks.html")
 	if err != nil {
 		http.Error(w, "Unable to load template", http.StatusInternalServerError)
@@ -207,13 +1021,89 @@ func tasksHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Render the template with the task list and username
 	err = tmpl.Execute(w, struct {
-		Username string
-		Tasks    []Task
+		Username    string
+		Tasks       []Task
+		Views       []SavedView
+		ActiveView  string
+		SaveFilter  string // The view's filter and the typed one together
+		Filter      string
+		FilterError string
+		Search      string
+		SearchError string
 	}{
-		Username: username,
-		Tasks:    tasks,
+		Username:    username,
+		Tasks:       tasks,
+		Views:       views,
+		ActiveView:  activeView,
+		SaveFilter:  filter.String(),
+		Filter:      filterText,
+		FilterError: filterError,
+		Search:      search,
+		SearchError: searchError,
 	})
 	if err != nil {
 		http.Error(w, "Unable to render template", http.StatusInternalServerError)
 	}
 }
+
+func accountHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl, err := template.ParseFiles("templates/account.html")
+	if err != nil {
+		http.Error(w, "Unable to load template", http.StatusInternalServerError)
+		return
+	}
+
+	username := queryUserName(r)
+	if username == "" {
+		http.Error(w, "User not specified", http.StatusBadRequest)
+		return
+	}
+
+	data := map[string]string{"Username": username}
+
+	if r.Method == http.MethodPost {
+		switch r.FormValue("action") {
+		case "password":
+			oldPassword := r.FormValue("old_password")
+			newPassword := r.FormValue("new_password")
+
+			if errs := passwordRules.Validate(username, newPassword); len(errs) > 0 {
+				data["Error"] = (&validationError{Errors: errs}).Error()
+			} else if err := authenticate(username, oldPassword, clientIP(r)); err != nil {
+				data["Error"] = loginFailureMessage(err, "Current password is incorrect")
+			} else if err := userStore.ChangePassword(username, oldPassword, newPassword); err != nil {
+				data["Error"] = "Unable to change password"
+			} else {
+				data["Message"] = "Password updated"
+			}
+
+		case "delete":
+			password := r.FormValue("password")
+			if err := confirmAccountDeletion(username, password, clientIP(r)); err != nil {
+				data["Error"] = loginFailureMessage(err, "Password is incorrect")
+				break
+			}
+
+			if err := deleteAccount(r.Context(), username); err != nil {
+				data["Error"] = "Unable to delete account"
+				break
+			}
+
+			if loggedInUsername == username {
+				isLoggedIn = false
+				loggedInUsername = ""
+			}
+
+			http.Redirect(w, r, "/register", http.StatusSeeOther)
+			return
+
+		default:
+			http.Error(w, "Unknown action", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, "Unable to render template", http.StatusInternalServerError)
+	}
+}
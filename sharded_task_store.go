@@ -0,0 +1,645 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var shardIdleTimeout = flag.Duration("shard-idle-timeout", 10*time.Minute, "How long the sharded store keeps an idle user's tasks in memory (0 keeps them forever)")
+
+// minShardIdleTimeout keeps eviction from running so often that users are reloaded on
+// nearly every request.
+const minShardIdleTimeout = time.Second
+
+func init() {
+	registerTaskStore("sharded", taskStoreBackend{
+		defaultPath: "tasks.d",
+		options:     []string{"idle-timeout"},
+		open: func(path string, options neturl.Values) (TaskStore, error) {
+			idleTimeout := *shardIdleTimeout
+			if value := options.Get("idle-timeout"); value != "" {
+				parsed, err := time.ParseDuration(value)
+				if err != nil {
+					return nil, fmt.Errorf("invalid idle-timeout %q: %w", value, err)
+				}
+				idleTimeout = parsed
+			}
+			if idleTimeout < 0 || idleTimeout > 0 && idleTimeout < minShardIdleTimeout {
+				return nil, fmt.Errorf("invalid idle-timeout %s: must be 0 or at least %s", idleTimeout, minShardIdleTimeout)
+			}
+			store, err := openShardedTaskStore(path, idleTimeout)
+			if err != nil {
+				return nil, err
+			}
+			return store, nil
+		},
+	})
+}
+
+// shardedTaskStore keeps each user's tasks in their own file under dir/users, so
+// users are loaded, locked and saved independently of each other. A user's file is
+// read on first access and dropped from memory again after shardIdleTimeout.
+//
+// IDs stay unique across users through a counter in dir/next-id. Unlike the other
+// stores, IDs of deleted tasks are not reused. The owner of every ID is read from the
+// user files when the store opens, so another user's task is told apart from a
+// missing one without loading that user.
+type shardedTaskStore struct {
+	dir         string
+	idleTimeout time.Duration
+	mutex       sync.Mutex // Guards shards, idSeq and owners
+	snapshotMu  sync.Mutex // Lets only one snapshot hold several shards at a time
+	shards      map[string]*taskShard
+	idSeq       int
+	owners      map[int]string // Task ID to user, including IDs handed out but not yet saved
+	lock        *dataFileLock
+	stop        chan struct{}
+	stopped     sync.Once
+}
+
+type taskShard struct {
+	mutex    sync.Mutex
+	filePath string
+	tasks    map[int]Task
+	loaded   bool
+	evicted  bool // Set once the shard has been dropped; holders must look it up again
+	lastUsed time.Time
+}
+
+func openShardedTaskStore(dir string, idleTimeout time.Duration) (*shardedTaskStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "users"), 0755); err != nil {
+		return nil, err
+	}
+
+	// Only one process may write the user files and the ID counter
+	lock, err := lockDataDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &shardedTaskStore{
+		dir:         dir,
+		idleTimeout: idleTimeout,
+		shards:      make(map[string]*taskShard),
+		owners:      make(map[int]string),
+		lock:        lock,
+		stop:        make(chan struct{}),
+	}
+
+	if err := store.loadIDs(); err != nil {
+		_ = lock.Unlock()
+		return nil, err
+	}
+
+	if idleTimeout > 0 {
+		go store.evictLoop()
+	}
+
+	return store, nil
+}
+
+func (store *shardedTaskStore) idSeqPath() string {
+	return filepath.Join(store.dir, "next-id")
+}
+
+// loadIDs reads the owner of every ID from the user files, and the ID counter. If the
+// counter is missing, the highest ID in any user file is used instead, so a lost
+// counter never causes duplicate IDs.
+func (store *shardedTaskStore) loadIDs() error {
+	userNames, err := store.shardUserNames()
+	if err != nil {
+		return err
+	}
+	highestID := 0
+	for _, userName := range userNames {
+		tasks, err := store.readShard(store.shardPath(userName))
+		if err != nil {
+			return err
+		}
+		for id := range tasks {
+			store.owners[id] = userName
+			highestID = max(highestID, id)
+		}
+	}
+
+	raw, err := os.ReadFile(store.idSeqPath())
+	if err == nil {
+		if store.idSeq, err = strconv.Atoi(strings.TrimSpace(string(raw))); err == nil {
+			return nil
+		}
+		logger.Error("ID counter is corrupt, rebuilding it", "file", store.idSeqPath(), "error", err)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	store.idSeq = highestID
+	return store.saveIDSeq(store.idSeq)
+}
+
+func (store *shardedTaskStore) saveIDSeq(idSeq int) error {
+	return writeFileAtomic(store.idSeqPath(), 0, func(w io.Writer) error {
+		_, err := fmt.Fprintln(w, idSeq)
+		return err
+	})
+}
+
+// nextID hands out the next ID to userName and persists the counter before the ID is
+// used. The ID counts as the user's until forgetIDs is called.
+func (store *shardedTaskStore) nextID(userName string) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if err := store.saveIDSeq(store.idSeq + 1); err != nil {
+		return 0, err
+	}
+	store.idSeq++
+	store.owners[store.idSeq] = userName
+	return store.idSeq, nil
+}
+
+// raiseIDSeq makes sure IDs handed out later are above id. The caller holds store.mutex.
+func (store *shardedTaskStore) raiseIDSeq(id int) error {
+	if id <= store.idSeq {
+		return nil
+	}
+	if err := store.saveIDSeq(id); err != nil {
+		return err
+	}
+	store.idSeq = id
+	return nil
+}
+
+// forgetIDs drops the owner of the user's IDs once their tasks are gone. The IDs are
+// not handed out again.
+func (store *shardedTaskStore) forgetIDs(userName string, ids ...int) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for _, id := range ids {
+		if store.owners[id] == userName {
+			delete(store.owners, id)
+		}
+	}
+}
+
+// shardIDs hands out IDs to one user's batch.
+type shardIDs struct {
+	store    *shardedTaskStore
+	userName string
+}
+
+func (ids shardIDs) nextID() (int, error) {
+	return ids.store.nextID(ids.userName)
+}
+
+func (ids shardIDs) releaseID(id int) {
+	ids.store.forgetIDs(ids.userName, id)
+}
+
+func (store *shardedTaskStore) shardPath(userName string) string {
+	return filepath.Join(store.dir, "users", neturl.PathEscape(userName)+".json")
+}
+
+// shardUserNames lists the users that have a file, i.e. at least one task.
+func (store *shardedTaskStore) shardUserNames() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(store.dir, "users"))
+	if err != nil {
+		return nil, err
+	}
+
+	userNames := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		name, isShard := strings.CutSuffix(entry.Name(), ".json")
+		if !isShard || entry.IsDir() {
+			continue // Backups, temporary and corrupt files
+		}
+		userName, err := neturl.PathUnescape(name)
+		if err != nil {
+			continue
+		}
+		userNames = append(userNames, userName)
+	}
+	sort.Strings(userNames)
+	return userNames, nil
+}
+
+func (store *shardedTaskStore) readShard(filePath string) (map[int]Task, error) {
+	tasks := make(map[int]Task)
+	err := loadJSONFileWithRecovery(filePath, schemaKindUserTasks, *storeBackupCount, &tasks)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if tasks == nil {
+		tasks = make(map[int]Task)
+	}
+	return tasks, nil
+}
+
+// lockShard returns the user's shard locked and loaded. Only the lookup in the shard
+// map is global; loading and everything after happens under the user's own lock.
+func (store *shardedTaskStore) lockShard(ctx context.Context, userName string) (*taskShard, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		store.mutex.Lock()
+		shard, exists := store.shards[userName]
+		if !exists {
+			shard = &taskShard{filePath: store.shardPath(userName)}
+			store.shards[userName] = shard
+		}
+		shard.lastUsed = time.Now()
+		store.mutex.Unlock()
+
+		shard.mutex.Lock()
+		if shard.evicted {
+			shard.mutex.Unlock()
+			continue
+		}
+
+		if !shard.loaded {
+			tasks, err := store.readShard(shard.filePath)
+			if err != nil {
+				shard.mutex.Unlock()
+				return nil, err
+			}
+			shard.tasks = tasks
+			shard.loaded = true
+			logger.Info("Loaded user tasks", "traceID", traceIDFrom(ctx), "userName", userName, "tasks", len(tasks))
+		}
+		return shard, nil
+	}
+}
+
+// save writes the shard's file, or removes it once the user has no tasks left.
+func (shard *taskShard) save(tasks map[int]Task) error {
+	if len(tasks) == 0 {
+		if err := os.Remove(shard.filePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return writeDataFile(shard.filePath, schemaKindUserTasks, *storeBackupCount, tasks)
+}
+
+// lookup finds a task in the shard of userName, which the caller holds.
+func (store *shardedTaskStore) lookup(shard *taskShard, userName string, id int) (Task, error) {
+	if task, exists := shard.tasks[id]; exists {
+		return task, nil
+	}
+
+	store.mutex.Lock()
+	owner, exists := store.owners[id]
+	store.mutex.Unlock()
+	if exists && owner != userName {
+		return Task{}, fmt.Errorf("%w: id %d", ErrForbidden, id)
+	}
+	return Task{}, fmt.Errorf("%w: id %d", ErrNotFound, id)
+}
+
+func (store *shardedTaskStore) evictLoop() {
+	ticker := time.NewTicker(store.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-store.stop:
+			return
+		case now := <-ticker.C:
+			store.evictIdle(now)
+		}
+	}
+}
+
+// evictIdle drops shards not used since idleTimeout. Every change is already on disk,
+// so nothing needs saving. Shards in use are skipped.
+func (store *shardedTaskStore) evictIdle(now time.Time) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for userName, shard := range store.shards {
+		if now.Sub(shard.lastUsed) < store.idleTimeout || !shard.mutex.TryLock() {
+			continue
+		}
+		shard.evicted = true
+		shard.tasks = nil
+		shard.mutex.Unlock()
+		delete(store.shards, userName)
+		logger.Info("Evicted idle user tasks from memory", "userName", userName)
+	}
+}
+
+// Close stops the eviction loop and releases the lock. All data is already saved.
+func (store *shardedTaskStore) Close() error {
+	var err error
+	store.stopped.Do(func() {
+		close(store.stop)
+		err = store.lock.Unlock()
+	})
+	return err
+}
+
+func (store *shardedTaskStore) AddTask(ctx context.Context, userName, title string, description string) (Task, error) {
+	shard, err := store.lockShard(ctx, userName)
+	if err != nil {
+		return Task{}, err
+	}
+	defer shard.mutex.Unlock()
+
+	id, err := store.nextID(userName)
+	if err != nil {
+		return Task{}, err
+	}
+
+	task := Task{
+		ID:          id,
+		Title:       title,
+		Description: description,
+		Completed:   false,
+		Version:     1,
+		CreatedAt:   time.Now().UTC(),
+	}
+
+	shard.tasks[id] = task
+	if err := shard.save(shard.tasks); err != nil {
+		logger.Error("Failed to save user tasks", "traceID", traceIDFrom(ctx), "userName", userName, "error", err)
+		delete(shard.tasks, id)
+		store.forgetIDs(userName, id)
+		return Task{}, err
+	}
+
+	return task, nil
+}
+
+func (store *shardedTaskStore) RemoveTask(ctx context.Context, userName string, id int, version int) error {
+	shard, err := store.lockShard(ctx, userName)
+	if err != nil {
+		return err
+	}
+	defer shard.mutex.Unlock()
+
+	task, err := store.lookup(shard, userName, id)
+	if err != nil {
+		return err
+	}
+	if err := checkVersion(task, version); err != nil {
+		return err
+	}
+
+	delete(shard.tasks, id)
+	if err := shard.save(shard.tasks); err != nil {
+		logger.Error("Failed to save user tasks after deletion", "traceID", traceIDFrom(ctx), "userName", userName, "error", err)
+		shard.tasks[id] = task
+		return err
+	}
+	store.forgetIDs(userName, id)
+
+	logger.Info("Task deleted and user file updated", "traceID", traceIDFrom(ctx), "taskID", id, "userName", userName)
+	return nil
+}
+
+func (store *shardedTaskStore) ListTasks(ctx context.Context, userName string) ([]Task, error) {
+	shard, err := store.lockShard(ctx, userName)
+	if err != nil {
+		return nil, err
+	}
+	defer shard.mutex.Unlock()
+
+	taskList := make([]Task, 0, len(shard.tasks))
+	for _, task := range shard.tasks {
+		taskList = append(taskList, task)
+	}
+	return taskList, nil
+}
+
+func (store *shardedTaskStore) QueryTasks(ctx context.Context, userName string, query TaskQuery) (TaskPage, error) {
+	tasks, err := store.ListTasks(ctx, userName)
+	if err != nil {
+		return TaskPage{}, err
+	}
+	return queryTaskList(tasks, query)
+}
+
+func (store *shardedTaskStore) GetTask(ctx context.Context, userName string, id int) (Task, error) {
+	shard, err := store.lockShard(ctx, userName)
+	if err != nil {
+		return Task{}, err
+	}
+	defer shard.mutex.Unlock()
+
+	return store.lookup(shard, userName, id)
+}
+
+func (store *shardedTaskStore) CompleteTask(ctx context.Context, userName string, id int, version int) (Task, error) {
+	return store.UpdateTask(ctx, userName, id, version, completeUpdate())
+}
+
+func (store *shardedTaskStore) UpdateTask(ctx context.Context, userName string, id int, version int, update TaskUpdate) (Task, error) {
+	shard, err := store.lockShard(ctx, userName)
+	if err != nil {
+		return Task{}, err
+	}
+	defer shard.mutex.Unlock()
+
+	task, err := store.lookup(shard, userName, id)
+	if err != nil {
+		return Task{}, err
+	}
+	if err := checkVersion(task, version); err != nil {
+		return Task{}, err
+	}
+
+	updated := update.apply(task)
+	shard.tasks[id] = updated
+	if err := shard.save(shard.tasks); err != nil {
+		logger.Error("Failed to save user tasks", "traceID", traceIDFrom(ctx), "userName", userName, "error", err)
+		shard.tasks[id] = task
+		return Task{}, err
+	}
+
+	logger.Info("Task updated and user file saved", "traceID", traceIDFrom(ctx), "taskID", id, "version", updated.Version, "userName", userName)
+	return updated, nil
+}
+
+// RemoveUserTasks deletes the user's file together with its backups.
+func (store *shardedTaskStore) RemoveUserTasks(ctx context.Context, userName string) error {
+	shard, err := store.lockShard(ctx, userName)
+	if err != nil {
+		return err
+	}
+	defer shard.mutex.Unlock()
+
+	if err := shard.save(nil); err != nil {
+		return err
+	}
+	for id := range shard.tasks {
+		store.forgetIDs(userName, id)
+	}
+	shard.tasks = make(map[int]Task)
+
+	for n := 1; n <= *storeBackupCount; n++ {
+		if err := os.Remove(backupPath(shard.filePath, n)); err != nil && !os.IsNotExist(err) {
+			logger.Error("Failed to remove backup of user tasks", "traceID", traceIDFrom(ctx), "file", backupPath(shard.filePath, n), "error", err)
+		}
+	}
+
+	logger.Info("All tasks removed for user", "traceID", traceIDFrom(ctx), "userName", userName)
+	return nil
+}
+
+func (store *shardedTaskStore) ListUserNames(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return store.shardUserNames()
+}
+
+// ImportTasks checks the IDs against the owners of all IDs and holds the ID counter
+// until the tasks are saved, so no other user is handed one of them meanwhile. Imports
+// are rare, so holding up other users' new tasks is fine.
+func (store *shardedTaskStore) ImportTasks(ctx context.Context, userName string, tasks []Task) error {
+	tasks = importedTasks(tasks)
+
+	shard, err := store.lockShard(ctx, userName)
+	if err != nil {
+		return err
+	}
+	defer shard.mutex.Unlock()
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for _, task := range tasks {
+		if _, exists := store.owners[task.ID]; exists {
+			return fmt.Errorf("%w: id %d", ErrConflict, task.ID)
+		}
+	}
+
+	merged := make(map[int]Task, len(shard.tasks)+len(tasks))
+	highestID := 0
+	for id, task := range shard.tasks {
+		merged[id] = task
+	}
+	for _, task := range tasks {
+		merged[task.ID] = task
+		if task.ID > highestID {
+			highestID = task.ID
+		}
+	}
+
+	if err := store.raiseIDSeq(highestID); err != nil {
+		return err
+	}
+	if err := shard.save(merged); err != nil {
+		logger.Error("Failed to save user tasks after import", "traceID", traceIDFrom(ctx), "userName", userName, "error", err)
+		return err
+	}
+
+	shard.tasks = merged
+	for _, task := range tasks {
+		store.owners[task.ID] = userName
+	}
+	return nil
+}
+
+// ApplyBatch applies the batch to a copy of the user's tasks and saves the file once.
+// IDs handed out to a batch that then fails are not reused.
+func (store *shardedTaskStore) ApplyBatch(ctx context.Context, userName string, ops []BatchOp) ([]Task, error) {
+	shard, err := store.lockShard(ctx, userName)
+	if err != nil {
+		return nil, err
+	}
+	defer shard.mutex.Unlock()
+
+	tasks := cloneTasks(map[string]map[int]Task{userName: shard.tasks})
+	results, err := applyBatch(tasks, userName, ops, shardIDs{store, userName})
+	if err == nil {
+		if err = shard.save(tasks[userName]); err != nil {
+			logger.Error("Failed to save user tasks after batch", "traceID", traceIDFrom(ctx), "userName", userName, "error", err)
+		}
+	}
+	if err != nil {
+		// Forget the IDs handed out to tasks that were not saved
+		for id := range tasks[userName] {
+			if _, saved := shard.tasks[id]; !saved {
+				store.forgetIDs(userName, id)
+			}
+		}
+		return nil, err
+	}
+	for id := range shard.tasks {
+		if _, kept := tasks[userName][id]; !kept {
+			store.forgetIDs(userName, id)
+		}
+	}
+
+	shard.tasks = tasks[userName]
+	if shard.tasks == nil {
+		shard.tasks = make(map[int]Task)
+	}
+
+	logger.Info("Task batch applied and user file saved", "traceID", traceIDFrom(ctx), "operations", len(ops), "userName", userName)
+	return results, nil
+}
+
+// SnapshotTasks locks every user's shard and copies the tasks once all are held.
+// Other operations hold one shard at a time and snapshots run one after another, so
+// this cannot deadlock. Users that gain their first task meanwhile are picked up by
+// looking again.
+func (store *shardedTaskStore) SnapshotTasks(ctx context.Context) (map[string]map[int]Task, error) {
+	store.snapshotMu.Lock()
+	defer store.snapshotMu.Unlock()
+
+	held := make(map[string]*taskShard)
+	defer func() {
+		for _, shard := range held {
+			shard.mutex.Unlock()
+		}
+	}()
+
+	for {
+		userNames, err := store.shardUserNames()
+		if err != nil {
+			return nil, err
+		}
+
+		added := false
+		for _, userName := range userNames {
+			if held[userName] != nil {
+				continue
+			}
+			shard, err := store.lockShard(ctx, userName)
+			if err != nil {
+				return nil, err
+			}
+			held[userName] = shard
+			added = true
+		}
+		if !added {
+			break
+		}
+	}
+
+	tasks := make(map[string]map[int]Task, len(held))
+	for userName, shard := range held {
+		if len(shard.tasks) == 0 {
+			continue
+		}
+		tasks[userName] = make(map[int]Task, len(shard.tasks))
+		for id, task := range shard.tasks {
+			tasks[userName][id] = task
+		}
+	}
+	return tasks, nil
+}
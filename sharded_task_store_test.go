@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestShardedStore(t *testing.T, dir string, idleTimeout time.Duration) *shardedTaskStore {
+	store, err := openShardedTaskStore(dir, idleTimeout)
+	if err != nil {
+		t.Fatalf("Failed to open sharded store: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	return store
+}
+
+func TestShardedStoreKeepsOneFilePerUser(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestShardedStore(t, dir, 0)
+
+	first := mustAddTask(t, store, "alice", "First", "one")
+	mustAddTask(t, store, "alice", "Second", "two")
+	bobs := mustAddTask(t, store, "bob", "Third", "three")
+
+	if bobs.ID == first.ID {
+		t.Fatalf("Expected IDs to be unique across users, both got %d", bobs.ID)
+	}
+	for _, userName := range []string{"alice", "bob"} {
+		if _, err := os.Stat(filepath.Join(dir, "users", userName+".json")); err != nil {
+			t.Errorf("Expected a file for %s: %v", userName, err)
+		}
+	}
+
+	if _, err := store.GetTask(context.Background(), "bob", first.ID); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Expected another user's task to be forbidden, got %v", err)
+	}
+
+	if err := store.RemoveTask(context.Background(), "bob", bobs.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "users", "bob.json")); !os.IsNotExist(err) {
+		t.Errorf("Expected bob's file to be removed with his last task, got %v", err)
+	}
+	if users := mustListUserNames(t, store); len(users) != 1 || users[0] != "alice" {
+		t.Errorf("Expected only alice to have tasks, got %v", users)
+	}
+
+	closeTaskStore(store)
+	reopened := newTestShardedStore(t, dir, 0)
+	if tasks := mustListTasks(t, reopened, "alice"); len(tasks) != 2 {
+		t.Errorf("Expected alice's 2 tasks after reopening, got %d", len(tasks))
+	}
+	if _, err := reopened.GetTask(context.Background(), "carol", first.ID); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Expected the owners of tasks to be known after reopening, got %v", err)
+	}
+	if _, err := reopened.GetTask(context.Background(), "alice", bobs.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected a deleted task to be reported as not found, got %v", err)
+	}
+	if task := mustAddTask(t, reopened, "carol", "New", ""); task.ID <= bobs.ID {
+		t.Errorf("Expected the ID counter to survive reopening, got ID %d", task.ID)
+	}
+}
+
+func TestShardedStoreRebuildsLostIDCounter(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestShardedStore(t, dir, 0)
+	for j := 0; j < 5; j++ {
+		mustAddTask(t, store, "alice", fmt.Sprintf("Task %d", j), "")
+	}
+
+	if err := os.Remove(filepath.Join(dir, "next-id")); err != nil {
+		t.Fatal(err)
+	}
+
+	closeTaskStore(store)
+	reopened := newTestShardedStore(t, dir, 0)
+	if task := mustAddTask(t, reopened, "bob", "After", ""); task.ID != 6 {
+		t.Errorf("Expected the counter to be rebuilt from the user files, got ID %d", task.ID)
+	}
+}
+
+func TestShardedStoreEvictsIdleUsers(t *testing.T) {
+	store := newTestShardedStore(t, t.TempDir(), 0)
+	store.idleTimeout = time.Minute
+
+	mustAddTask(t, store, "alice", "First", "")
+	mustAddTask(t, store, "bob", "Second", "")
+
+	store.shards["bob"].lastUsed = time.Now().Add(-2 * time.Minute)
+	store.evictIdle(time.Now())
+
+	if _, loaded := store.shards["bob"]; loaded {
+		t.Error("Expected bob's idle tasks to be evicted")
+	}
+	if _, loaded := store.shards["alice"]; !loaded {
+		t.Error("Expected alice's recently used tasks to stay in memory")
+	}
+
+	if tasks := mustListTasks(t, store, "bob"); len(tasks) != 1 {
+		t.Errorf("Expected bob's tasks to be loaded again on access, got %d", len(tasks))
+	}
+}
+
+func TestConcurrentAccessShardedStore(t *testing.T) {
+	store := newTestShardedStore(t, t.TempDir(), time.Millisecond)
+	totalUsers := 10
+	tasksPerUser := 20
+	wg := &sync.WaitGroup{}
+
+	for i := 0; i < totalUsers; i++ {
+		wg.Add(1)
+		go func(userName string) {
+			defer wg.Done()
+			for j := 0; j < tasksPerUser; j++ {
+				task := mustAddTask(t, store, userName, fmt.Sprintf("Task %d", j), "")
+				if _, err := store.CompleteTask(context.Background(), userName, task.ID, 0); err != nil {
+					t.Errorf("Failed to complete task %d for %s: %v", task.ID, userName, err)
+				}
+			}
+			if tasks := mustListTasks(t, store, userName); len(tasks) != tasksPerUser {
+				t.Errorf("Expected %d tasks for %s, got %d", tasksPerUser, userName, len(tasks))
+			}
+		}(fmt.Sprintf("user%d", i))
+	}
+
+	wg.Wait()
+}
+
+func TestShardedStoreImportDoesNotShareIDs(t *testing.T) {
+	store := newTestShardedStore(t, t.TempDir(), 0)
+	ctx := context.Background()
+
+	imported := make([]Task, 20)
+	for i := range imported {
+		imported[i] = Task{ID: i + 1, Title: fmt.Sprintf("Imported %d", i), Version: 1}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 20; j++ {
+			if _, err := store.AddTask(ctx, "bob", "New", ""); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	importErr := store.ImportTasks(ctx, "alice", imported)
+	wg.Wait()
+	if importErr != nil && !errors.Is(importErr, ErrConflict) {
+		t.Fatal(importErr)
+	}
+
+	snapshot, err := store.SnapshotTasks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetTask(ctx, "bob", 1); importErr == nil && !errors.Is(err, ErrForbidden) {
+		t.Errorf("Expected imported tasks to belong to alice, got %v", err)
+	}
+	if ids := snapshot["alice"]; importErr == nil && len(ids) != len(imported) {
+		t.Errorf("Expected %d imported tasks, got %d", len(imported), len(ids))
+	}
+	for id := range snapshot["alice"] {
+		if _, shared := snapshot["bob"][id]; shared {
+			t.Errorf("Expected ID %d to belong to one user only", id)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// snapshotFormatVersion is the version of the archive layout written by writeSnapshot.
+const snapshotFormatVersion = 1
+
+// Files in a snapshot archive. The data files use the same format as on disk, and are
+// encrypted if a key is configured.
+const (
+	snapshotManifestFile = "manifest.json"
+	snapshotTasksFile    = "tasks.json"
+	snapshotUsersFile    = "users.json"
+)
+
+// maxSnapshotFileSize guards restore against archives that decompress to huge files.
+const maxSnapshotFileSize = 1 << 30
+
+// snapshot is every user's tasks and every account at one point in time.
+type snapshot struct {
+	Tasks map[string]map[int]Task // Map of userName to tasks
+	Users map[string]User
+}
+
+type snapshotManifest struct {
+	FormatVersion int            `json:"format_version"`
+	CreatedAt     time.Time      `json:"created_at"`
+	Users         int            `json:"users"`
+	TaskUsers     int            `json:"task_users"` // Users with at least one task
+	Tasks         int            `json:"tasks"`
+	EncryptedWith string         `json:"encrypted_with,omitempty"` // Key ID
+	Files         []snapshotFile `json:"files"`
+}
+
+type snapshotFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// takeSnapshot copies all tasks and users while the server keeps running. Tasks are
+// read at a single point in time by the store; users are copied right before.
+func takeSnapshot(ctx context.Context, tasks TaskStore, users UserStore) (snapshot, error) {
+	userCopy := users.Snapshot()
+	taskCopy, err := tasks.SnapshotTasks(ctx)
+	if err != nil {
+		return snapshot{}, err
+	}
+	return snapshot{Tasks: taskCopy, Users: userCopy}, nil
+}
+
+func (snap snapshot) taskCount() int {
+	count := 0
+	for _, userTasks := range snap.Tasks {
+		count += len(userTasks)
+	}
+	return count
+}
+
+// writeSnapshot writes snap as a gzip-compressed tar archive. The manifest comes
+// first and lists the size and SHA-256 checksum of every other file.
+func writeSnapshot(w io.Writer, snap snapshot, createdAt time.Time) (snapshotManifest, error) {
+	manifest := snapshotManifest{
+		FormatVersion: snapshotFormatVersion,
+		CreatedAt:     createdAt.UTC(),
+		Users:         len(snap.Users),
+		TaskUsers:     len(snap.Tasks),
+		Tasks:         snap.taskCount(),
+	}
+	if activeKey != nil {
+		manifest.EncryptedWith = activeKey.ID()
+	}
+
+	files := []struct {
+		name string
+		kind string
+		data interface{}
+	}{
+		{snapshotTasksFile, schemaKindTasks, snap.Tasks},
+		{snapshotUsersFile, schemaKindUsers, snap.Users},
+	}
+
+	contents := make([][]byte, len(files))
+	for i, file := range files {
+		var plain bytes.Buffer
+		if err := encodeData(&plain, file.kind, file.data); err != nil {
+			return manifest, err
+		}
+		sealed, err := sealData(activeKey, plain.Bytes())
+		if err != nil {
+			return manifest, err
+		}
+
+		sum := sha256.Sum256(sealed)
+		contents[i] = sealed
+		manifest.Files = append(manifest.Files, snapshotFile{Name: file.name, Size: int64(len(sealed)), SHA256: hex.EncodeToString(sum[:])})
+	}
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+
+	add := func(name string, data []byte) error {
+		header := &tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: manifest.CreatedAt}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := archive.Write(data)
+		return err
+	}
+
+	if err := add(snapshotManifestFile, manifestData); err != nil {
+		return manifest, err
+	}
+	for i, file := range files {
+		if err := add(file.name, contents[i]); err != nil {
+			return manifest, err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return manifest, err
+	}
+	return manifest, gz.Close()
+}
+
+// readSnapshot reads and validates an archive written by writeSnapshot: every file in
+// the manifest must be present with the recorded size and checksum, and the tasks
+// must have unique, positive IDs and match the manifest's counts.
+func readSnapshot(r io.Reader) (snapshot, snapshotManifest, error) {
+	var manifest snapshotManifest
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return snapshot{}, manifest, fmt.Errorf("not a snapshot archive: %w", err)
+	}
+	archive := tar.NewReader(gz)
+
+	contents := make(map[string][]byte)
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return snapshot{}, manifest, fmt.Errorf("reading archive: %w", err)
+		}
+		if header.Size > maxSnapshotFileSize {
+			return snapshot{}, manifest, fmt.Errorf("%s is too large", header.Name)
+		}
+		if contents[header.Name], err = io.ReadAll(archive); err != nil {
+			return snapshot{}, manifest, fmt.Errorf("reading %s: %w", header.Name, err)
+		}
+	}
+
+	manifestData, exists := contents[snapshotManifestFile]
+	if !exists {
+		return snapshot{}, manifest, fmt.Errorf("archive has no %s", snapshotManifestFile)
+	}
+	if err := json.Unmarshal(manifestData, &manifest); err != nil {
+		return snapshot{}, manifest, fmt.Errorf("%s: %w", snapshotManifestFile, err)
+	}
+	if manifest.FormatVersion > snapshotFormatVersion {
+		return snapshot{}, manifest, fmt.Errorf("snapshot has format version %d, but this program only understands up to version %d; upgrade the program", manifest.FormatVersion, snapshotFormatVersion)
+	}
+
+	listed := make(map[string]bool)
+	for _, file := range manifest.Files {
+		data, exists := contents[file.Name]
+		if !exists {
+			return snapshot{}, manifest, fmt.Errorf("%s is listed in the manifest but missing", file.Name)
+		}
+		sum := sha256.Sum256(data)
+		if int64(len(data)) != file.Size || hex.EncodeToString(sum[:]) != file.SHA256 {
+			return snapshot{}, manifest, fmt.Errorf("%s does not match its checksum in the manifest", file.Name)
+		}
+		listed[file.Name] = true
+	}
+	for name := range contents {
+		if name != snapshotManifestFile && !listed[name] {
+			return snapshot{}, manifest, fmt.Errorf("%s is not listed in the manifest", name)
+		}
+	}
+
+	var snap snapshot
+	for _, file := range []struct {
+		name string
+		kind string
+		v    interface{}
+	}{
+		{snapshotTasksFile, schemaKindTasks, &snap.Tasks},
+		{snapshotUsersFile, schemaKindUsers, &snap.Users},
+	} {
+		data, exists := contents[file.name]
+		if !exists {
+			return snapshot{}, manifest, fmt.Errorf("archive has no %s", file.name)
+		}
+		plain, err := openData(activeKey, data)
+		if isKeyError(err) {
+			return snapshot{}, manifest, fmt.Errorf("%s: %w; set $%s or -encryption-key-file to the key the snapshot was taken with", file.name, err, encryptionKeyEnv)
+		}
+		if err != nil {
+			return snapshot{}, manifest, fmt.Errorf("%s: %w", file.name, err)
+		}
+		if _, err := decodeData(file.name, plain, file.kind, file.v); err != nil {
+			return snapshot{}, manifest, fmt.Errorf("%s: %w", file.name, err)
+		}
+	}
+
+	if err := validateSnapshot(snap, manifest); err != nil {
+		return snapshot{}, manifest, err
+	}
+	return snap, manifest, nil
+}
+
+// validateSnapshot checks what the checksums cannot: that the data is consistent.
+func validateSnapshot(snap snapshot, manifest snapshotManifest) error {
+	owners := make(map[int]string)
+	for userName, userTasks := range snap.Tasks {
+		for id, task := range userTasks {
+			if id <= 0 || task.ID != id {
+				return fmt.Errorf("task %d of %s has an invalid ID", id, userName)
+			}
+			if owner, taken := owners[id]; taken {
+				return fmt.Errorf("task ID %d belongs to both %s and %s", id, owner, userName)
+			}
+			owners[id] = userName
+		}
+	}
+
+	for username, user := range snap.Users {
+		if user.Username != username {
+			return fmt.Errorf("user %q is stored under %q", user.Username, username)
+		}
+	}
+
+	if snap.taskCount() != manifest.Tasks || len(snap.Users) != manifest.Users {
+		return fmt.Errorf("snapshot has %d tasks and %d users, but the manifest lists %d and %d", snap.taskCount(), len(snap.Users), manifest.Tasks, manifest.Users)
+	}
+	return nil
+}
+
+// restoreTasks imports every user's tasks into target, which must be empty, and then
+// checks that target holds exactly the snapshot's tasks.
+func restoreTasks(ctx context.Context, snap snapshot, target TaskStore) error {
+	existing, err := target.ListUserNames(ctx)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return fmt.Errorf("%w: the target store already has tasks for %d users", ErrConflict, len(existing))
+	}
+
+	userNames := make([]string, 0, len(snap.Tasks))
+	for userName := range snap.Tasks {
+		userNames = append(userNames, userName)
+	}
+	sort.Strings(userNames)
+
+	for _, userName := range userNames {
+		tasks := make([]Task, 0, len(snap.Tasks[userName]))
+		for _, task := range snap.Tasks[userName] {
+			tasks = append(tasks, task)
+		}
+		if err := target.ImportTasks(ctx, userName, tasks); err != nil {
+			return fmt.Errorf("importing tasks for %s: %w", userName, err)
+		}
+	}
+
+	restored, err := target.SnapshotTasks(ctx)
+	if err != nil {
+		return err
+	}
+	if len(restored) != len(snap.Tasks) {
+		return fmt.Errorf("target has tasks for %d users after restoring, expected %d", len(restored), len(snap.Tasks))
+	}
+	for userName, userTasks := range snap.Tasks {
+		if digestTasks(taskList(userTasks)) != digestTasks(taskList(restored[userName])) {
+			return fmt.Errorf("restored tasks for %s do not match the snapshot", userName)
+		}
+	}
+	return nil
+}
+
+func taskList(tasks map[int]Task) []Task {
+	list := make([]Task, 0, len(tasks))
+	for _, task := range tasks {
+		list = append(list, task)
+	}
+	return list
+}
+
+// openUsersForRestore opens the user store to restore into, which keeps a running
+// server from overwriting the restored accounts, and checks that it has no users yet.
+func openUsersForRestore(dsn string) (UserStore, error) {
+	users, err := openUserStore(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if existing := users.ListUsers(); len(existing) > 0 {
+		closeUserStore(users)
+		return nil, fmt.Errorf("%w: %s already has %d users", ErrConflict, dsn, len(existing))
+	}
+	return users, nil
+}
+
+// snapshotFileName is the suggested name for a snapshot taken at t.
+func snapshotFileName(t time.Time) string {
+	return "todo-snapshot-" + t.UTC().Format("20060102T150405Z") + ".tar.gz"
+}
+
+// runRestore implements the "restore" subcommand and returns the process exit code.
+func runRestore(args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	flags.SetOutput(out)
+	to := flags.String("to", "", "Target task store: a backend name or a DSN such as sqlite:///var/lib/todo/tasks.db")
+	toPath := flags.String("to-path", "", "Target data file (defaults to the backend's usual file)")
+	usersDSN := flags.String("users", "json", "User store to restore the accounts into: a backend name or a DSN")
+	skipUsers := flags.Bool("skip-users", false, "Restore only the tasks")
+	dryRun := flags.Bool("dry-run", false, "Only validate the snapshot")
+	keyFile := flags.String("encryption-key-file", "", "File with the key the snapshot was taken with (instead of $"+encryptionKeyEnv+")")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if flags.NArg() != 1 || (*to == "" && !*dryRun) {
+		_, _ = fmt.Fprintln(out, "Usage: restore -to=<store> [-to-path=...] [-users=...] [-skip-users] [-dry-run] <snapshot.tar.gz>")
+		return 2
+	}
+
+	key, err := loadEncryptionKey(*keyFile, os.Getenv(encryptionKeyEnv))
+	if err != nil {
+		_, _ = fmt.Fprintln(out, err)
+		return 2
+	}
+	activeKey = key
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		_, _ = fmt.Fprintln(out, err)
+		return 1
+	}
+	defer safeClose(file)
+
+	snap, manifest, err := readSnapshot(file)
+	if err != nil {
+		_, _ = fmt.Fprintln(out, "Invalid snapshot:", err)
+		return 1
+	}
+	_, _ = fmt.Fprintf(out, "Snapshot from %s is valid: %d tasks for %d users, %d accounts.\n",
+		manifest.CreatedAt.Format(time.RFC3339), manifest.Tasks, manifest.TaskUsers, manifest.Users)
+	if *dryRun {
+		return 0
+	}
+
+	// Check the user store before touching the task store, so a conflict changes nothing
+	var users UserStore
+	if !*skipUsers {
+		users, err = openUsersForRestore(*usersDSN)
+		if err != nil {
+			_, _ = fmt.Fprintln(out, "Cannot restore users:", err)
+			return 1
+		}
+		defer closeUserStore(users)
+	}
+
+	target, err := openTaskStoreAt(*to, *toPath)
+	if err != nil {
+		_, _ = fmt.Fprintln(out, err)
+		return 2
+	}
+	defer closeTaskStore(target)
+
+	if err := restoreTasks(context.Background(), snap, target); err != nil {
+		_, _ = fmt.Fprintln(out, "Restore failed:", err)
+		return 1
+	}
+	_, _ = fmt.Fprintf(out, "Restored %d tasks for %d users into %s.\n", manifest.Tasks, manifest.TaskUsers, *to)
+
+	if !*skipUsers {
+		if err := users.ImportUsers(snap.Users); err != nil {
+			_, _ = fmt.Fprintln(out, "Restoring users failed:", err)
+			return 1
+		}
+		_, _ = fmt.Fprintf(out, "Restored %d accounts into %s.\n", manifest.Users, *usersDSN)
+	}
+	return 0
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSnapshot(t *testing.T) snapshot {
+	store := localTaskStore()
+	first := mustAddTask(t, store, "alice", "First", "one")
+	mustAddTask(t, store, "alice", "Second", "two")
+	mustAddTask(t, store, "bob", "Third", "")
+	if _, err := store.CompleteTask(context.Background(), "alice", first.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	users := newMemoryUserStore()
+	if err := users.ImportUsers(map[string]User{
+		"alice": {Username: "alice", Password: "hash-a"},
+		"bob":   {Username: "bob", Password: "hash-b"},
+		"carol": {Username: "carol", Password: "hash-c"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := takeSnapshot(context.Background(), store, users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snap
+}
+
+func TestSnapshotRestoresIntoEveryBackend(t *testing.T) {
+	var archive bytes.Buffer
+	if _, err := writeSnapshot(&archive, newTestSnapshot(t), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, manifest, err := readSnapshot(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Tasks != 3 || manifest.TaskUsers != 2 || manifest.Users != 3 {
+		t.Errorf("Unexpected manifest counts: %+v", manifest)
+	}
+
+	dir := t.TempDir()
+	targets := map[string]TaskStore{
+		"memory":  localTaskStore(),
+		"json":    newTestJSONStore(t, filepath.Join(dir, "tasks.json")),
+		"wal":     newTestWALStore(t, dir, 0),
+		"sqlite":  newTestSQLiteStore(t, filepath.Join(dir, "tasks.db")),
+		"sharded": newTestShardedStore(t, filepath.Join(dir, "tasks.d"), 0),
+	}
+
+	for name, target := range targets {
+		t.Run(name, func(t *testing.T) {
+			if err := restoreTasks(context.Background(), snap, target); err != nil {
+				t.Fatal(err)
+			}
+			tasks := mustListTasks(t, target, "alice")
+			if len(tasks) != 2 {
+				t.Errorf("Expected alice's 2 tasks, got %+v", tasks)
+			}
+
+			if err := restoreTasks(context.Background(), snap, target); err == nil {
+				t.Error("Expected restoring into a store with tasks to fail")
+			}
+		})
+	}
+}
+
+func TestReadSnapshotRejectsTamperedArchive(t *testing.T) {
+	var archive bytes.Buffer
+	if _, err := writeSnapshot(&archive, newTestSnapshot(t), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unpack, change a task title and pack again with the original manifest
+	gz, err := gzip.NewReader(&archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := tar.NewReader(gz)
+	var tampered bytes.Buffer
+	tamperedGz := gzip.NewWriter(&tampered)
+	writer := tar.NewWriter(tamperedGz)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(reader)
+		if header.Name == snapshotTasksFile {
+			data = bytes.Replace(data, []byte("Second"), []byte("Secant"), 1)
+		}
+		if err := writer.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		_, _ = writer.Write(data)
+	}
+	_ = writer.Close()
+	_ = tamperedGz.Close()
+
+	if _, _, err := readSnapshot(&tampered); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("Expected a checksum error, got %v", err)
+	}
+}
+
+func TestAdminSnapshotHandler(t *testing.T) {
+	previousTasks, previousUsers := taskStore, userStore
+	taskStore, userStore = localTaskStore(), newMemoryUserStore()
+	defer func() { taskStore, userStore = previousTasks, previousUsers }()
+	if err := userStore.ImportUsers(map[string]User{"alice": {Username: "alice"}}); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TODO_ADMIN_TOKEN", "secret")
+
+	mustAddTask(t, taskStore, "alice", "First", "")
+
+	unauthorized := httptest.NewRecorder()
+	adminSnapshotHandler(unauthorized, httptest.NewRequest(http.MethodGet, "/admin/snapshot", nil))
+	if unauthorized.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without the admin token, got %d", unauthorized.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/snapshot", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp := httptest.NewRecorder()
+	adminSnapshotHandler(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.Code, resp.Body.String())
+	}
+
+	snap, _, err := readSnapshot(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snap.Tasks["alice"]) != 1 || len(snap.Users) != 1 {
+		t.Errorf("Unexpected snapshot contents: %+v", snap)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+)
+
+// The SQLite store runs task queries in SQL. These functions give text matching and
+// time ordering exactly the behaviour of queryTaskList, which SQLite's own lower()
+// and date functions would not (they fold only ASCII and keep milliseconds).
+func init() {
+	mustRegisterSQLiteFunction("todo_contains_fold", 2, func(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		s, _ := args[0].(string)
+		substr, _ := args[1].(string)
+		return containsFold(s, substr), nil
+	})
+	mustRegisterSQLiteFunction("todo_time_key", 1, func(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		s, _ := args[0].(string)
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, err
+		}
+		return timeKey(t), nil
+	})
+}
+
+func mustRegisterSQLiteFunction(name string, args int32, fn func(*sqlite.FunctionContext, []driver.Value) (driver.Value, error)) {
+	if err := sqlite.RegisterDeterministicScalarFunction(name, args, fn); err != nil {
+		panic(err)
+	}
+}
+
+// timeKey formats t so that comparing the strings compares the times.
+func timeKey(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000000000Z")
+}
+
+// sqliteSortColumns are the SQL expressions tasks are sorted by.
+var sqliteSortColumns = map[string]string{
+	sortByID:        "id",
+	sortByTitle:     "title",
+	sortByCreated:   "todo_time_key(created_at)",
+	sortByCompleted: "completed",
+}
+
+// QueryTasks filters, sorts and pages in SQL, so only the requested page is read.
+func (store *sqliteTaskStore) QueryTasks(ctx context.Context, userName string, query TaskQuery) (TaskPage, error) {
+	cursor, err := query.validate()
+	if err != nil {
+		return TaskPage{}, err
+	}
+
+	where := []string{"user_name = ?"}
+	args := []any{userName}
+	if query.Completed != nil {
+		where = append(where, "completed = ?")
+		args = append(args, *query.Completed)
+	}
+	if query.Text != "" {
+		where = append(where, "(todo_contains_fold(title, ?) OR todo_contains_fold(description, ?))")
+		args = append(args, query.Text, query.Text)
+	}
+	if !query.CreatedAfter.IsZero() {
+		where = append(where, "todo_time_key(created_at) >= ?")
+		args = append(args, timeKey(query.CreatedAfter))
+	}
+	if !query.CreatedBefore.IsZero() {
+		where = append(where, "todo_time_key(created_at) < ?")
+		args = append(args, timeKey(query.CreatedBefore))
+	}
+	if query.Filter != nil {
+		for _, term := range query.Filter.terms {
+			condition, conditionArgs := sqliteFilterCondition(term)
+			where = append(where, condition)
+			args = append(args, conditionArgs...)
+		}
+	}
+
+	// Ties are broken by ID, as in queryTaskList
+	keys := append(append([]SortKey(nil), query.Sort...), SortKey{Field: sortByID})
+	order := make([]string, len(keys))
+	for i, key := range keys {
+		order[i] = sqliteSortColumns[key.Field]
+		if key.Desc {
+			order[i] += " DESC"
+		}
+	}
+
+	var page TaskPage
+	err = store.inTx(ctx, func(tx *sql.Tx) error {
+		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM tasks WHERE `+strings.Join(where, " AND "), args...).Scan(&page.Total); err != nil {
+			return err
+		}
+
+		pageWhere, pageArgs := where, args
+		if cursor != nil {
+			condition, conditionArgs := sqliteAfterCursor(keys, *cursor)
+			pageWhere = append(append([]string(nil), where...), condition)
+			pageArgs = append(append([]any(nil), args...), conditionArgs...)
+		}
+
+		statement := `SELECT ` + taskColumns + ` FROM tasks WHERE ` + strings.Join(pageWhere, " AND ") + ` ORDER BY ` + strings.Join(order, ", ")
+		if query.Limit > 0 {
+			statement += ` LIMIT ?`
+			pageArgs = append(pageArgs, query.Limit+1) // One more shows whether there is a next page
+		}
+
+		rows, err := tx.QueryContext(ctx, statement, pageArgs...)
+		if err != nil {
+			return err
+		}
+		defer safeClose(rows)
+
+		page.Tasks = make([]Task, 0)
+		for rows.Next() {
+			var task Task
+			if err := scanTask(rows, &task); err != nil {
+				return err
+			}
+			page.Tasks = append(page.Tasks, task)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return TaskPage{}, err
+	}
+
+	if query.Limit > 0 && len(page.Tasks) > query.Limit {
+		page.Tasks = page.Tasks[:query.Limit]
+		page.NextCursor = query.encodeCursor(page.Tasks[query.Limit-1])
+	}
+	return page, nil
+}
+
+// sqliteFilterCondition returns the SQL condition of a filter term, matching what
+// filterTerm.match does.
+func sqliteFilterCondition(term filterTerm) (string, []any) {
+	var condition string
+	var args []any
+
+	switch term.field {
+	case filterText:
+		condition = "(todo_contains_fold(title, ?) OR todo_contains_fold(description, ?))"
+		args = []any{term.text, term.text}
+	case filterTitle:
+		condition, args = "todo_contains_fold(title, ?)", []any{term.text}
+	case filterDescription:
+		condition, args = "todo_contains_fold(description, ?)", []any{term.text}
+	case filterStatus:
+		condition, args = "completed = ?", []any{!term.open}
+	case filterID, filterVersion:
+		condition, args = term.field+" "+term.op+" ?", []any{term.number}
+	case filterCreated:
+		var bounds []string
+		if !term.from.IsZero() {
+			bounds = append(bounds, "todo_time_key(created_at) >= ?")
+			args = append(args, timeKey(term.from))
+		}
+		if !term.to.IsZero() {
+			bounds = append(bounds, "todo_time_key(created_at) < ?")
+			args = append(args, timeKey(term.to))
+		}
+		condition = "(" + strings.Join(bounds, " AND ") + ")"
+	default:
+		panic(fmt.Sprintf("unknown filter field %q", term.field))
+	}
+
+	if term.negate {
+		condition = "NOT " + condition
+	}
+	return condition, args
+}
+
+// sqliteAfterCursor returns the condition selecting the tasks ordered after the
+// cursor: (k1 > v1) OR (k1 = v1 AND k2 > v2) OR ..., with < for descending keys.
+func sqliteAfterCursor(keys []SortKey, cursor taskCursor) (string, []any) {
+	var alternatives []string
+	var args []any
+
+	for i, key := range keys {
+		var parts []string
+		for _, equal := range keys[:i] {
+			parts = append(parts, sqliteSortColumns[equal.Field]+" = ?")
+			args = append(args, sqliteCursorValue(equal.Field, cursor))
+		}
+		operator := " > ?"
+		if key.Desc {
+			operator = " < ?"
+		}
+		parts = append(parts, sqliteSortColumns[key.Field]+operator)
+		args = append(args, sqliteCursorValue(key.Field, cursor))
+		alternatives = append(alternatives, "("+strings.Join(parts, " AND ")+")")
+	}
+	return "(" + strings.Join(alternatives, " OR ") + ")", args
+}
+
+func sqliteCursorValue(field string, cursor taskCursor) any {
+	switch field {
+	case sortByTitle:
+		return cursor.Title
+	case sortByCreated:
+		return timeKey(cursor.CreatedAt)
+	case sortByCompleted:
+		return cursor.Completed
+	case sortByID:
+		return cursor.ID
+	}
+	panic(fmt.Sprintf("unknown sort key %q", field))
+}
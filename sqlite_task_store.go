@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+func init() {
+	registerTaskStore("sqlite", taskStoreBackend{
+		defaultPath: "tasks.db",
+		open: func(path string, _ url.Values) (TaskStore, error) {
+			store, err := openSQLiteTaskStore(path)
+			if err != nil {
+				return nil, err
+			}
+			return store, nil
+		},
+	})
+}
+
+// sqliteMigrations are applied in order and recorded in schema_migrations. Never edit
+// an entry once released; add a new one instead.
+var sqliteMigrations = []string{
+	// 1: tasks, with IDs unique across users like the other stores
+	`CREATE TABLE tasks (
+		id          INTEGER PRIMARY KEY,
+		user_name   TEXT    NOT NULL,
+		title       TEXT    NOT NULL,
+		description TEXT    NOT NULL,
+		completed   INTEGER NOT NULL DEFAULT 0,
+		created_at  TEXT    NOT NULL,
+		updated_at  TEXT    NOT NULL
+	);
+	CREATE INDEX idx_tasks_user_name ON tasks (user_name);
+	CREATE INDEX idx_tasks_user_completed ON tasks (user_name, completed);`,
+
+	// 2: history of every mutation
+	`CREATE TABLE task_history (
+		seq         INTEGER PRIMARY KEY AUTOINCREMENT,
+		task_id     INTEGER NOT NULL,
+		user_name   TEXT    NOT NULL,
+		op          TEXT    NOT NULL,
+		title       TEXT,
+		occurred_at TEXT    NOT NULL
+	);
+	CREATE INDEX idx_task_history_user_name ON task_history (user_name, task_id);`,
+
+	// 3: optimistic concurrency; existing tasks start at version 1
+	`ALTER TABLE tasks ADD COLUMN version INTEGER NOT NULL DEFAULT 1;`,
+}
+
+// sqliteTaskStore keeps tasks in an embedded SQLite database. Every mutation runs in a
+// transaction together with its history entry.
+type sqliteTaskStore struct {
+	db  *sql.DB
+	now func() time.Time
+}
+
+func openSQLiteTaskStore(filePath string) (*sqliteTaskStore, error) {
+	dsn := "file:" + filePath + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=synchronous(FULL)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows a single writer; one connection avoids SQLITE_BUSY between our own goroutines
+	db.SetMaxOpenConns(1)
+
+	store := &sqliteTaskStore{db: db, now: time.Now}
+	if err := store.migrate(); err != nil {
+		safeClose(db)
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (store *sqliteTaskStore) migrate() error {
+	if _, err := store.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TEXT NOT NULL
+	)`); err != nil {
+		return err
+	}
+
+	var current int
+	if err := store.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+
+	if current > len(sqliteMigrations) {
+		return fmt.Errorf("database schema version %d is newer than this binary supports (%d)", current, len(sqliteMigrations))
+	}
+
+	for version := current + 1; version <= len(sqliteMigrations); version++ {
+		err := store.inTx(context.Background(), func(tx *sql.Tx) error {
+			if _, err := tx.Exec(sqliteMigrations[version-1]); err != nil {
+				return err
+			}
+			_, err := tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, version, store.timestamp())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		logger.Info("Applied database migration", "version", version)
+	}
+
+	return nil
+}
+
+func (store *sqliteTaskStore) timestamp() string {
+	return formatTimestamp(store.now())
+}
+
+// taskColumns are the columns scanTask reads, in order.
+const taskColumns = "id, title, description, completed, version, created_at"
+
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// scanTask reads the columns selected by taskColumns, followed by any extra ones.
+func scanTask(row interface{ Scan(...any) error }, task *Task, extra ...any) error {
+	var created string
+	dest := append([]any{&task.ID, &task.Title, &task.Description, &task.Completed, &task.Version, &created}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return err
+	}
+
+	createdAt, err := time.Parse(time.RFC3339Nano, created)
+	if err != nil {
+		return fmt.Errorf("task %d has an invalid creation time %q: %w", task.ID, created, err)
+	}
+	task.CreatedAt = createdAt.UTC()
+	return nil
+}
+
+// inTx runs fn in a transaction, committing on success and rolling back otherwise.
+func (store *sqliteTaskStore) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			logger.Error("Failed to roll back transaction", "error", rollbackErr)
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (store *sqliteTaskStore) recordHistory(ctx context.Context, tx *sql.Tx, taskID int, userName, op, title string) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO task_history (task_id, user_name, op, title, occurred_at) VALUES (?, ?, ?, ?, ?)`,
+		taskID, userName, op, title, store.timestamp())
+	return err
+}
+
+// nextTaskID returns the lowest free ID, reusing gaps left by deleted tasks.
+func nextTaskID(ctx context.Context, tx *sql.Tx) (int, error) {
+	var id int
+	err := tx.QueryRowContext(ctx, `
+		SELECT CASE WHEN NOT EXISTS (SELECT 1 FROM tasks WHERE id = 1) THEN 1 ELSE (
+			SELECT MIN(t.id) + 1 FROM tasks t
+			WHERE NOT EXISTS (SELECT 1 FROM tasks n WHERE n.id = t.id + 1)
+		) END`).Scan(&id)
+	return id, err
+}
+
+func (store *sqliteTaskStore) Close() error {
+	return store.db.Close()
+}
+
+// rowQuerier is implemented by both *sql.DB and *sql.Tx.
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// loadTask reads a task and checks that it belongs to userName.
+func loadTask(ctx context.Context, db rowQuerier, userName string, id int) (Task, error) {
+	var task Task
+	var owner string
+	row := db.QueryRowContext(ctx, `SELECT `+taskColumns+`, user_name FROM tasks WHERE id = ?`, id)
+	err := scanTask(row, &task, &owner)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Task{}, fmt.Errorf("%w: id %d", ErrNotFound, id)
+	}
+	if err != nil {
+		return Task{}, err
+	}
+	if owner != userName {
+		return Task{}, fmt.Errorf("%w: id %d", ErrForbidden, id)
+	}
+	return task, nil
+}
+
+func (store *sqliteTaskStore) AddTask(ctx context.Context, userName, title string, description string) (Task, error) {
+	var task Task
+
+	err := store.inTx(ctx, func(tx *sql.Tx) (err error) {
+		task, err = store.addTaskTx(ctx, tx, userName, title, description)
+		return err
+	})
+	if err != nil {
+		logger.Error("Failed to add task to database", "traceID", traceIDFrom(ctx), "userName", userName, "error", err)
+		return Task{}, err
+	}
+
+	return task, nil
+}
+
+func (store *sqliteTaskStore) addTaskTx(ctx context.Context, tx *sql.Tx, userName, title, description string) (Task, error) {
+	id, err := nextTaskID(ctx, tx)
+	if err != nil {
+		return Task{}, err
+	}
+
+	created := store.now().UTC()
+	now := formatTimestamp(created)
+	if _, err := tx.ExecContext(ctx, `INSERT INTO tasks (id, user_name, title, description, completed, created_at, updated_at) VALUES (?, ?, ?, ?, 0, ?, ?)`,
+		id, userName, title, description, now, now); err != nil {
+		return Task{}, err
+	}
+
+	task := Task{ID: id, Title: title, Description: description, Version: 1, CreatedAt: created}
+	return task, store.recordHistory(ctx, tx, id, userName, "add", title)
+}
+
+func (store *sqliteTaskStore) RemoveTask(ctx context.Context, userName string, id int, version int) error {
+	return store.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := store.removeTaskTx(ctx, tx, userName, id, version)
+		return err
+	})
+}
+
+func (store *sqliteTaskStore) removeTaskTx(ctx context.Context, tx *sql.Tx, userName string, id int, version int) (Task, error) {
+	task, err := loadTask(ctx, tx, userName, id)
+	if err != nil {
+		return Task{}, err
+	}
+	if err := checkVersion(task, version); err != nil {
+		return Task{}, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM tasks WHERE id = ? AND user_name = ?`, id, userName); err != nil {
+		return Task{}, err
+	}
+	return task, store.recordHistory(ctx, tx, id, userName, "remove", task.Title)
+}
+
+func (store *sqliteTaskStore) ListTasks(ctx context.Context, userName string) ([]Task, error) {
+	rows, err := store.db.QueryContext(ctx, `SELECT `+taskColumns+` FROM tasks WHERE user_name = ? ORDER BY id`, userName)
+	if err != nil {
+		return nil, err
+	}
+	defer safeClose(rows)
+
+	taskList := make([]Task, 0)
+	for rows.Next() {
+		var task Task
+		if err := scanTask(rows, &task); err != nil {
+			return nil, err
+		}
+		taskList = append(taskList, task)
+	}
+
+	return taskList, rows.Err()
+}
+
+func (store *sqliteTaskStore) GetTask(ctx context.Context, userName string, id int) (Task, error) {
+	return loadTask(ctx, store.db, userName, id)
+}
+
+func (store *sqliteTaskStore) CompleteTask(ctx context.Context, userName string, id int, version int) (Task, error) {
+	return store.updateTask(ctx, userName, id, version, completeUpdate(), "complete")
+}
+
+func (store *sqliteTaskStore) UpdateTask(ctx context.Context, userName string, id int, version int, update TaskUpdate) (Task, error) {
+	return store.updateTask(ctx, userName, id, version, update, "update")
+}
+
+func (store *sqliteTaskStore) updateTask(ctx context.Context, userName string, id int, version int, update TaskUpdate, op string) (Task, error) {
+	var updated Task
+
+	err := store.inTx(ctx, func(tx *sql.Tx) (err error) {
+		updated, err = store.updateTaskTx(ctx, tx, userName, id, version, update, op)
+		return err
+	})
+	if err != nil {
+		return Task{}, err
+	}
+
+	return updated, nil
+}
+
+// updateTaskTx applies update and records it in the history as op.
+func (store *sqliteTaskStore) updateTaskTx(ctx context.Context, tx *sql.Tx, userName string, id int, version int, update TaskUpdate, op string) (Task, error) {
+	task, err := loadTask(ctx, tx, userName, id)
+	if err != nil {
+		return Task{}, err
+	}
+	if err := checkVersion(task, version); err != nil {
+		return Task{}, err
+	}
+
+	updated := update.apply(task)
+	if _, err := tx.ExecContext(ctx, `UPDATE tasks SET title = ?, description = ?, completed = ?, version = ?, updated_at = ? WHERE id = ?`,
+		updated.Title, updated.Description, updated.Completed, updated.Version, store.timestamp(), id); err != nil {
+		return Task{}, err
+	}
+
+	return updated, store.recordHistory(ctx, tx, id, userName, op, updated.Title)
+}
+
+// ApplyBatch runs every operation in one transaction, so a failing operation rolls
+// back the ones before it.
+func (store *sqliteTaskStore) ApplyBatch(ctx context.Context, userName string, ops []BatchOp) ([]Task, error) {
+	results := make([]Task, 0, len(ops))
+
+	err := store.inTx(ctx, func(tx *sql.Tx) error {
+		for i, op := range ops {
+			var task Task
+			var err error
+
+			switch op.Op {
+			case batchOpAdd:
+				task, err = store.addTaskTx(ctx, tx, userName, op.Title, op.Description)
+			case batchOpComplete:
+				task, err = store.updateTaskTx(ctx, tx, userName, op.ID, op.Version, completeUpdate(), "complete")
+			case batchOpUpdate:
+				task, err = store.updateTaskTx(ctx, tx, userName, op.ID, op.Version, op.Update, "update")
+			case batchOpDelete:
+				task, err = store.removeTaskTx(ctx, tx, userName, op.ID, op.Version)
+			default:
+				err = fmt.Errorf("unknown operation %q", op.Op)
+			}
+
+			if err != nil {
+				return &BatchError{Index: i, Err: err}
+			}
+			results = append(results, task)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+func (store *sqliteTaskStore) RemoveUserTasks(ctx context.Context, userName string) error {
+	return store.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO task_history (task_id, user_name, op, title, occurred_at)
+			SELECT id, user_name, 'remove', title, ? FROM tasks WHERE user_name = ?`, store.timestamp(), userName); err != nil {
+			return err
+		}
+
+		_, err := tx.ExecContext(ctx, `DELETE FROM tasks WHERE user_name = ?`, userName)
+		return err
+	})
+}
+
+func (store *sqliteTaskStore) ListUserNames(ctx context.Context) ([]string, error) {
+	rows, err := store.db.QueryContext(ctx, `SELECT DISTINCT user_name FROM tasks ORDER BY user_name`)
+	if err != nil {
+		return nil, err
+	}
+	defer safeClose(rows)
+
+	userNames := make([]string, 0)
+	for rows.Next() {
+		var userName string
+		if err := rows.Scan(&userName); err != nil {
+			return nil, err
+		}
+		userNames = append(userNames, userName)
+	}
+	return userNames, rows.Err()
+}
+
+// SnapshotTasks reads all tasks with a single query, which SQLite runs against one
+// consistent view of the database.
+func (store *sqliteTaskStore) SnapshotTasks(ctx context.Context) (map[string]map[int]Task, error) {
+	rows, err := store.db.QueryContext(ctx, `SELECT `+taskColumns+`, user_name FROM tasks`)
+	if err != nil {
+		return nil, err
+	}
+	defer safeClose(rows)
+
+	tasks := make(map[string]map[int]Task)
+	for rows.Next() {
+		var task Task
+		var userName string
+		if err := scanTask(rows, &task, &userName); err != nil {
+			return nil, err
+		}
+		if tasks[userName] == nil {
+			tasks[userName] = make(map[int]Task)
+		}
+		tasks[userName][task.ID] = task
+	}
+	return tasks, rows.Err()
+}
+
+// ImportTasks inserts tasks as they are, keeping their IDs and completion state. The
+// whole batch is one transaction, so a conflicting ID imports nothing.
+func (store *sqliteTaskStore) ImportTasks(ctx context.Context, userName string, tasks []Task) error {
+	return store.inTx(ctx, func(tx *sql.Tx) error {
+		now := store.timestamp()
+		for _, task := range importedTasks(tasks) {
+			var exists bool
+			if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM tasks WHERE id = ?)`, task.ID).Scan(&exists); err != nil {
+				return err
+			}
+			if exists {
+				return fmt.Errorf("%w: id %d", ErrConflict, task.ID)
+			}
+
+			if _, err := tx.ExecContext(ctx, `INSERT INTO tasks (id, user_name, title, description, completed, version, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+				task.ID, userName, task.Title, task.Description, task.Completed, task.Version, formatTimestamp(task.CreatedAt), now); err != nil {
+				return err
+			}
+
+			if err := store.recordHistory(ctx, tx, task.ID, userName, "import", task.Title); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
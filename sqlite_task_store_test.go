@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func newTestSQLiteStore(t *testing.T, filePath string) *sqliteTaskStore {
+	store, err := openSQLiteTaskStore(filePath)
+	if err != nil {
+		t.Fatalf("Failed to open SQLite store: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	return store
+}
+
+func TestSQLiteStorePersistsAndReusesIDs(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "tasks.db")
+	store := newTestSQLiteStore(t, filePath)
+
+	first := mustAddTask(t, store, "alice", "First", "one")
+	second := mustAddTask(t, store, "alice", "Second", "two")
+	mustAddTask(t, store, "bob", "Third", "three")
+
+	if _, err := store.CompleteTask(context.Background(), "alice", first.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.CompleteTask(context.Background(), "bob", first.ID, 0); err == nil {
+		t.Error("Expected completing another user's task to fail")
+	}
+	if err := store.RemoveTask(context.Background(), "alice", second.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := newTestSQLiteStore(t, filePath)
+	task, err := reopened.GetTask(context.Background(), "alice", first.ID)
+	if err != nil || !task.Completed || task.Title != "First" {
+		t.Errorf("Unexpected task after reopen: %+v, %v", task, err)
+	}
+
+	if task := mustAddTask(t, reopened, "carol", "Reused", ""); task.ID != second.ID {
+		t.Errorf("Expected freed ID %d to be reused, got %d", second.ID, task.ID)
+	}
+
+	var history int
+	if err := reopened.db.QueryRow(`SELECT COUNT(*) FROM task_history WHERE user_name = 'alice'`).Scan(&history); err != nil {
+		t.Fatal(err)
+	}
+	if history != 4 {
+		t.Errorf("Expected 4 history entries for alice, got %d", history)
+	}
+
+	var version int
+	if err := reopened.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != len(sqliteMigrations) {
+		t.Errorf("Expected schema version %d, got %d", len(sqliteMigrations), version)
+	}
+}
+
+func TestConcurrentAccessSQLiteStore(t *testing.T) {
+	store := newTestSQLiteStore(t, filepath.Join(t.TempDir(), "tasks.db"))
+	totalUsers := 5
+	tasksPerUser := 20
+	wg := &sync.WaitGroup{}
+
+	for i := 0; i < totalUsers; i++ {
+		userName := fmt.Sprintf("user%d", i)
+		wg.Add(1)
+
+		go func(userName string) {
+			defer wg.Done()
+			for j := 0; j < tasksPerUser; j++ {
+				task := mustAddTask(t, store, userName, fmt.Sprintf("Task %d", j), "")
+				if _, err := store.CompleteTask(context.Background(), userName, task.ID, 0); err != nil {
+					t.Errorf("Failed to complete task %d for user %s: %v", task.ID, userName, err)
+				}
+			}
+
+			if tasks := mustListTasks(t, store, userName); len(tasks) != tasksPerUser {
+				t.Errorf("Expected %d tasks for %s, got %d", tasksPerUser, userName, len(tasks))
+			}
+		}(userName)
+	}
+
+	wg.Wait()
+}
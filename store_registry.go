@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Stores are configured with a DSN: the backend's scheme, optionally followed by a
+// path and options, for example
+//
+//	json                              the backend's default file
+//	json:tasks.json                   a path relative to the working directory
+//	json:///var/lib/todo/tasks.json   an absolute path
+//	wal://data/tasks.wal?snapshot=data/snapshot.json
+//
+// Backends register themselves by scheme from an init function in their own file.
+
+// taskStoreBackend describes how to open one kind of task store.
+type taskStoreBackend struct {
+	defaultPath string
+	options     []string // Query parameters the backend understands
+	open        func(path string, options url.Values) (TaskStore, error)
+}
+
+// userStoreBackend describes how to open one kind of user store.
+type userStoreBackend struct {
+	defaultPath string
+	options     []string
+	open        func(path string, options url.Values) (UserStore, error)
+}
+
+var (
+	taskStoreBackends = make(map[string]taskStoreBackend)
+	userStoreBackends = make(map[string]userStoreBackend)
+)
+
+func registerTaskStore(scheme string, backend taskStoreBackend) {
+	if _, exists := taskStoreBackends[scheme]; exists {
+		panic("task store " + scheme + " registered twice")
+	}
+	taskStoreBackends[scheme] = backend
+}
+
+func registerUserStore(scheme string, backend userStoreBackend) {
+	if _, exists := userStoreBackends[scheme]; exists {
+		panic("user store " + scheme + " registered twice")
+	}
+	userStoreBackends[scheme] = backend
+}
+
+// openTaskStore opens the task store a DSN describes.
+func openTaskStore(dsn string) (TaskStore, error) {
+	scheme, path, options, err := parseStoreDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return openTaskBackend(dsn, scheme, path, options)
+}
+
+// openTaskStoreAt opens a store given as a backend name or DSN and a separate path, as
+// taken by the -from-path and -to-path flags. The path is used as it is, so it may
+// contain characters that have a meaning in a DSN, such as ? and #.
+func openTaskStoreAt(store, path string) (TaskStore, error) {
+	if path == "" || strings.Contains(store, ":") {
+		return openTaskStore(store)
+	}
+	return openTaskBackend(store, store, path, url.Values{})
+}
+
+// taskStorePath returns the data file or directory openTaskStoreAt would use, or ""
+// for a backend that keeps no files.
+func taskStorePath(store, path string) (string, error) {
+	scheme := store
+	if path == "" || strings.Contains(store, ":") {
+		var err error
+		if scheme, path, _, err = parseStoreDSN(store); err != nil {
+			return "", err
+		}
+	}
+
+	backend, exists := taskStoreBackends[scheme]
+	if !exists {
+		return "", fmt.Errorf("unknown task store %q, use one of %s", scheme, schemeList(taskStoreBackends))
+	}
+	if path == "" {
+		path = backend.defaultPath
+	}
+	return path, nil
+}
+
+func openTaskBackend(dsn, scheme, path string, options url.Values) (TaskStore, error) {
+	backend, exists := taskStoreBackends[scheme]
+	if !exists {
+		return nil, fmt.Errorf("unknown task store %q, use one of %s", scheme, schemeList(taskStoreBackends))
+	}
+	if err := checkStoreOptions(dsn, options, backend.options); err != nil {
+		return nil, err
+	}
+	if path == "" {
+		path = backend.defaultPath
+	}
+	return backend.open(path, options)
+}
+
+// openUserStore opens the user store a DSN describes.
+func openUserStore(dsn string) (UserStore, error) {
+	scheme, path, options, err := parseStoreDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	backend, exists := userStoreBackends[scheme]
+	if !exists {
+		return nil, fmt.Errorf("unknown user store %q, use one of %s", scheme, schemeList(userStoreBackends))
+	}
+	if err := checkStoreOptions(dsn, options, backend.options); err != nil {
+		return nil, err
+	}
+	if path == "" {
+		path = backend.defaultPath
+	}
+	return backend.open(path, options)
+}
+
+// parseStoreDSN splits a DSN into the backend's scheme, the path (empty for the
+// default) and the options from the query string.
+func parseStoreDSN(dsn string) (string, string, url.Values, error) {
+	if !strings.Contains(dsn, ":") {
+		return dsn, "", url.Values{}, nil // Just a backend name
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("invalid store DSN %q: %w", dsn, err)
+	}
+
+	path := u.Host + u.Path
+	if u.Opaque != "" {
+		if path, err = url.PathUnescape(u.Opaque); err != nil {
+			return "", "", nil, fmt.Errorf("invalid store DSN %q: %w", dsn, err)
+		}
+	}
+	return u.Scheme, path, u.Query(), nil
+}
+
+// storeDSN describes a backend name or DSN with a separate path in one string, to tell
+// whether two stores are the same. It is not meant to be parsed again.
+func storeDSN(store, path string) string {
+	if path == "" || strings.Contains(store, ":") {
+		return store
+	}
+	return store + ":" + path
+}
+
+func checkStoreOptions(dsn string, options url.Values, known []string) error {
+	for name := range options {
+		if !containsString(known, name) {
+			return fmt.Errorf("store DSN %q has unknown option %q", dsn, name)
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// schemeList lists the registered schemes for help and error messages.
+func schemeList[B any](backends map[string]B) string {
+	schemes := make([]string, 0, len(backends))
+	for scheme := range backends {
+		schemes = append(schemes, "'"+scheme+"'")
+	}
+	sort.Strings(schemes)
+	return strings.Join(schemes, ", ")
+}
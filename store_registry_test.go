@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseStoreDSN(t *testing.T) {
+	cases := []struct {
+		dsn, scheme, path string
+	}{
+		{"json", "json", ""},
+		{"json:tasks.json", "json", "tasks.json"},
+		{"json://data/tasks.json", "json", "data/tasks.json"},
+		{"json:///var/lib/todo/tasks.json", "json", "/var/lib/todo/tasks.json"},
+		{"sqlite:my%20tasks.db", "sqlite", "my tasks.db"},
+	}
+
+	for _, c := range cases {
+		scheme, path, _, err := parseStoreDSN(c.dsn)
+		if err != nil {
+			t.Errorf("%s: %v", c.dsn, err)
+			continue
+		}
+		if scheme != c.scheme || path != c.path {
+			t.Errorf("%s: expected %q and %q, got %q and %q", c.dsn, c.scheme, c.path, scheme, path)
+		}
+	}
+
+	_, _, options, err := parseStoreDSN("wal:///tmp/tasks.wal?snapshot=/tmp/tasks.snap")
+	if err != nil || options.Get("snapshot") != "/tmp/tasks.snap" {
+		t.Errorf("Expected the snapshot option, got %v (%v)", options, err)
+	}
+}
+
+func TestOpenTaskStoreByDSN(t *testing.T) {
+	dir := t.TempDir()
+
+	if _, err := openTaskStore("postgres://localhost/todo"); err == nil {
+		t.Error("Expected an unknown scheme to be rejected")
+	}
+	if _, err := openTaskStore("json:" + filepath.Join(dir, "tasks.json") + "?watch=1s"); err == nil {
+		t.Error("Expected an unknown option to be rejected")
+	}
+
+	snapshotPath := filepath.Join(dir, "custom.snapshot.json")
+	store, err := openTaskStore("wal://" + filepath.Join(dir, "tasks.wal") + "?snapshot=" + snapshotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTaskStore(store)
+	mustAddTask(t, store, "alice", "First", "")
+
+	if _, err := os.Stat(filepath.Join(dir, "tasks.wal")); err != nil {
+		t.Errorf("Expected the log at the DSN's path: %v", err)
+	}
+	if walStore, ok := store.(*walTaskStore); !ok || walStore.snapshotPath != snapshotPath {
+		t.Errorf("Expected the snapshot path from the DSN, got %+v", store)
+	}
+}
+
+func TestOpenTaskStoreAtKeepsPathAsIs(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, name := range []string{"my?x.json", "a#b.json", "50%.json"} {
+		path := filepath.Join(dir, name)
+		store, err := openTaskStoreAt("json", path)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		mustAddTask(t, store, "alice", "First", "")
+		closeTaskStore(store)
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Expected the store at %s: %v", name, err)
+		}
+	}
+}
+
+func TestOpenTaskStoreReportsUnusableFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	jsonPath := filepath.Join(dir, "tasks.json")
+	held, err := openTaskStoreAt("json", jsonPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTaskStore(held)
+	if _, err := openTaskStoreAt("json", jsonPath); err == nil {
+		t.Error("Expected a locked JSON file to be reported")
+	}
+
+	walPath := filepath.Join(dir, "tasks.wal")
+	if err := os.WriteFile(walPath, []byte("{not a record\n"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openTaskStoreAt("wal", walPath); err == nil {
+		t.Error("Expected a corrupt WAL to be reported")
+	}
+}
+
+func TestOpenShardedStoreRejectsShortIdleTimeout(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "tasks.d")
+
+	for _, value := range []string{"-1m", "1ns", "999ms"} {
+		if store, err := openTaskStore("sharded:" + dir + "?idle-timeout=" + value); err == nil {
+			closeTaskStore(store)
+			t.Errorf("Expected idle-timeout=%s to be rejected", value)
+		}
+	}
+
+	for _, value := range []string{"0", "1s"} {
+		store, err := openTaskStore("sharded:" + dir + "?idle-timeout=" + value)
+		if err != nil {
+			t.Errorf("idle-timeout=%s: %v", value, err)
+			continue
+		}
+		closeTaskStore(store)
+	}
+}
+
+func TestJSONUserStoreImportsAndReopens(t *testing.T) {
+	dsn := "json:" + filepath.Join(t.TempDir(), "users.json")
+
+	users, err := openUserStore(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.ImportUsers(map[string]User{"alice": {Username: "alice", Password: "hash"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.ImportUsers(map[string]User{"alice": {Username: "alice"}, "bob": {Username: "bob"}}); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected importing an existing user to conflict, got %v", err)
+	}
+
+	if _, err := openUserStore(dsn); !errors.Is(err, errFileLocked) {
+		t.Errorf("Expected a second user store on the same file to be refused, got %v", err)
+	}
+	closeUserStore(users)
+
+	reopened, err := openUserStore(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeUserStore(reopened)
+	if got := reopened.Snapshot(); len(got) != 1 || got["alice"].Password != "hash" {
+		t.Errorf("Expected only alice after reopening, got %v", got)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Fields a filter can test
+const (
+	filterText        = "" // A value without a field: the title or the description
+	filterStatus      = "status"
+	filterTitle       = "title"
+	filterDescription = "description"
+	filterID          = "id"
+	filterVersion     = "version"
+	filterCreated     = "created"
+)
+
+var filterFields = []string{filterStatus, filterTitle, filterDescription, filterID, filterVersion, filterCreated}
+
+// TaskFilter is a parsed filter such as `status:open created:<7d "pay rent"`. A task
+// matches when it matches every term; a term starting with - must not match.
+//
+//	status:open, status:done      open or completed tasks
+//	title:word, description:word  the word in that field, ignoring case
+//	word, "two words"             the text in the title or the description
+//	id:>=10, version:2            numbers compared with =, <, <=, > or >=
+//	created:>=2024-03-01          dates and RFC 3339 times compared with the creation time
+//	created:<7d                   the task's age, in hours (h), days (d) or weeks (w)
+type TaskFilter struct {
+	source string
+	terms  []filterTerm
+}
+
+type filterTerm struct {
+	negate bool
+	field  string
+	text   string    // Text fields
+	open   bool      // Status
+	op     string    // Comparison of numbers
+	number int       // Numbers
+	from   time.Time // Creation time, inclusive; zero for no bound
+	to     time.Time // Creation time, exclusive; zero for no bound
+}
+
+// FilterError reports a filter that cannot be parsed and where the problem is.
+type FilterError struct {
+	Column  int // Counted in characters from 1
+	Message string
+}
+
+func (err *FilterError) Error() string {
+	return fmt.Sprintf("invalid filter at column %d: %s", err.Column, err.Message)
+}
+
+// Unwrap makes filter errors invalid queries, so they are reported with 400.
+func (err *FilterError) Unwrap() error {
+	return ErrInvalidQuery
+}
+
+// parseTaskFilter parses source. Relative times such as 7d are counted back from now.
+func parseTaskFilter(source string, now time.Time) (*TaskFilter, error) {
+	filter := &TaskFilter{source: source}
+	pos := 0
+	fail := func(at int, format string, args ...any) error {
+		return &FilterError{Column: utf8.RuneCountInString(source[:at]) + 1, Message: fmt.Sprintf(format, args...)}
+	}
+
+	for {
+		for pos < len(source) && isFilterSpace(source[pos]) {
+			pos++
+		}
+		if pos == len(source) {
+			return filter, nil
+		}
+		start := pos
+
+		var term filterTerm
+		if source[pos] == '-' {
+			term.negate = true
+			pos++
+		}
+
+		// A field is a name directly followed by a colon; anything else is text
+		end := pos
+		for end < len(source) && ('a' <= source[end] && source[end] <= 'z' || 'A' <= source[end] && source[end] <= 'Z') {
+			end++
+		}
+		if end > pos && end < len(source) && source[end] == ':' {
+			term.field = strings.ToLower(source[pos:end])
+			if !containsString(filterFields, term.field) {
+				return nil, fail(pos, "unknown field %q; tasks can be filtered by %s", term.field, strings.Join(filterFields, ", "))
+			}
+			pos = end + 1
+			for _, op := range []string{">=", "<=", ">", "<", "="} {
+				if strings.HasPrefix(source[pos:], op) {
+					term.op = op
+					pos += len(op)
+					break
+				}
+			}
+		}
+
+		valueStart := pos
+		var value string
+		if pos < len(source) && source[pos] == '"' {
+			closing := strings.IndexByte(source[pos+1:], '"')
+			if closing < 0 {
+				return nil, fail(pos, "missing closing quote")
+			}
+			value = source[pos+1 : pos+1+closing]
+			pos += closing + 2
+		} else {
+			for pos < len(source) && !isFilterSpace(source[pos]) {
+				pos++
+			}
+			value = source[valueStart:pos]
+		}
+		if strings.TrimSpace(value) == "" {
+			if term.field != "" {
+				return nil, fail(valueStart, "%s: needs a value", term.field)
+			}
+			return nil, fail(start, "nothing to filter by after -")
+		}
+
+		if err := term.parseValue(value, now); err != nil {
+			column := start
+			if term.field != "" {
+				column = valueStart
+			}
+			return nil, fail(column, "%s", err.Error())
+		}
+		filter.terms = append(filter.terms, term)
+	}
+}
+
+// parseValue reads value for the term's field.
+func (term *filterTerm) parseValue(value string, now time.Time) error {
+	switch term.field {
+	case filterText, filterTitle, filterDescription:
+		if term.op != "" {
+			return fmt.Errorf("%s: text cannot be compared with %s", term.field, term.op)
+		}
+		term.text = value
+
+	case filterStatus:
+		if term.op != "" {
+			return fmt.Errorf("status: cannot be compared with %s", term.op)
+		}
+		switch strings.ToLower(value) {
+		case "open":
+			term.open = true
+		case "done", "completed":
+		default:
+			return fmt.Errorf("status: %q is not open or done", value)
+		}
+
+	case filterID, filterVersion:
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a number", term.field, value)
+		}
+		term.number = number
+		if term.op == "" {
+			term.op = "="
+		}
+
+	case filterCreated:
+		return term.parseCreated(value, now)
+	}
+	return nil
+}
+
+// parseCreated turns a creation time condition into the range [from, to).
+func (term *filterTerm) parseCreated(value string, now time.Time) error {
+	if age, ok := parseFilterAge(value); ok {
+		if term.op == "" || term.op == "=" {
+			return fmt.Errorf("created: compare an age such as %s with < or >", value)
+		}
+		// A younger task was created after the boundary
+		boundary := now.Add(-age)
+		switch term.op {
+		case "<":
+			term.from = boundary.Add(time.Nanosecond)
+		case "<=":
+			term.from = boundary
+		case ">":
+			term.to = boundary
+		case ">=":
+			term.to = boundary.Add(time.Nanosecond)
+		}
+		return nil
+	}
+
+	t, err := parseQueryTime(value)
+	if err != nil {
+		return fmt.Errorf("created: %q is not a date (2006-01-02), an RFC 3339 time or an age such as 7d", value)
+	}
+	// A date stands for the whole day
+	next := t.Add(time.Nanosecond)
+	if len(value) == len(time.DateOnly) {
+		next = t.AddDate(0, 0, 1)
+	}
+	switch term.op {
+	case "", "=":
+		term.from, term.to = t, next
+	case "<":
+		term.to = t
+	case "<=":
+		term.to = next
+	case ">":
+		term.from = next
+	case ">=":
+		term.from = t
+	}
+	return nil
+}
+
+// parseFilterAge reads an age such as 36h, 7d or 2w.
+func parseFilterAge(value string) (time.Duration, bool) {
+	if len(value) < 2 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(value[:len(value)-1])
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	switch value[len(value)-1] {
+	case 'h':
+		return time.Duration(n) * time.Hour, true
+	case 'd':
+		return time.Duration(n) * 24 * time.Hour, true
+	case 'w':
+		return time.Duration(n) * 7 * 24 * time.Hour, true
+	}
+	return 0, false
+}
+
+// String returns the filter as it was written; a nil filter is empty.
+func (filter *TaskFilter) String() string {
+	if filter == nil {
+		return ""
+	}
+	return filter.source
+}
+
+// And returns a filter matching the tasks that match both filters.
+func (filter *TaskFilter) And(other *TaskFilter) *TaskFilter {
+	switch {
+	case filter == nil:
+		return other
+	case other == nil:
+		return filter
+	}
+	return &TaskFilter{
+		source: filter.source + " " + other.source,
+		terms:  append(append([]filterTerm(nil), filter.terms...), other.terms...),
+	}
+}
+
+// Match reports whether task matches every term of the filter.
+func (filter *TaskFilter) Match(task Task) bool {
+	for _, term := range filter.terms {
+		if term.match(task) == term.negate {
+			return false
+		}
+	}
+	return true
+}
+
+func (term filterTerm) match(task Task) bool {
+	switch term.field {
+	case filterText:
+		return containsFold(task.Title, term.text) || containsFold(task.Description, term.text)
+	case filterTitle:
+		return containsFold(task.Title, term.text)
+	case filterDescription:
+		return containsFold(task.Description, term.text)
+	case filterStatus:
+		return task.Completed != term.open
+	case filterID:
+		return compareFilterNumber(task.ID, term.op, term.number)
+	case filterVersion:
+		return compareFilterNumber(task.Version, term.op, term.number)
+	case filterCreated:
+		return (term.from.IsZero() || !task.CreatedAt.Before(term.from)) && (term.to.IsZero() || task.CreatedAt.Before(term.to))
+	}
+	return false
+}
+
+func compareFilterNumber(n int, op string, value int) bool {
+	switch op {
+	case "<":
+		return n < value
+	case "<=":
+		return n <= value
+	case ">":
+		return n > value
+	case ">=":
+		return n >= value
+	}
+	return n == value
+}
+
+// isFilterSpace reports whether c separates filter terms.
+func isFilterSpace(c byte) bool {
+	return c == ' ' || c == '\t'
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTaskFilterMatches(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	task := Task{ID: 7, Title: "Pay rent", Description: "Before the 5th", Version: 2, CreatedAt: time.Date(2024, 3, 8, 9, 30, 0, 0, time.UTC)}
+
+	cases := map[string]bool{
+		"":                               true,
+		"status:open":                    true,
+		"Status:DONE":                    false,
+		"-status:done rent":              true,
+		`"pay rent"`:                     true,
+		`"rent pay"`:                     false,
+		"title:5th":                      false,
+		"description:5TH":                true,
+		"id:7 version:>=2 version:<3":    true,
+		"id:>7":                          false,
+		"created:2024-03-08":             true,
+		"created:>2024-03-08":            false,
+		"created:<=2024-03-08":           true,
+		"created:>=2024-03-08T09:30:00Z": true,
+		"created:<3d":                    true,
+		"created:<2d":                    false,
+		"created:>1w":                    false,
+		"-created:>=1d":                  false,
+	}
+	for source, expected := range cases {
+		filter, err := parseTaskFilter(source, now)
+		if err != nil {
+			t.Errorf("%q: %v", source, err)
+			continue
+		}
+		if got := filter.Match(task); got != expected {
+			t.Errorf("%q: expected %v, got %v", source, expected, got)
+		}
+	}
+}
+
+func TestTaskFilterErrors(t *testing.T) {
+	cases := map[string]*FilterError{
+		"status:open priority:>=high": {Column: 13, Message: `unknown field "priority"; tasks can be filtered by status, title, description, id, version, created`},
+		"status:maybe":                {Column: 8, Message: `status: "maybe" is not open or done`},
+		"título:x id:x":               {Column: 13, Message: `id: "x" is not a number`},
+		`title:"pay rent`:             {Column: 7, Message: "missing closing quote"},
+		"id:>":                        {Column: 5, Message: "id: needs a value"},
+		"created:7d":                  {Column: 9, Message: "created: compare an age such as 7d with < or >"},
+		"title:>rent":                 {Column: 8, Message: "title: text cannot be compared with >"},
+		"ok -":                        {Column: 4, Message: "nothing to filter by after -"},
+	}
+	for source, expected := range cases {
+		_, err := parseTaskFilter(source, time.Now())
+		var filterErr *FilterError
+		if !errors.As(err, &filterErr) || !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%q: expected a filter error, got %v", source, err)
+			continue
+		}
+		if filterErr.Column != expected.Column || filterErr.Message != expected.Message {
+			t.Errorf("%q: expected %+v, got %+v", source, expected, filterErr)
+		}
+	}
+}
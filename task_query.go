@@ -0,0 +1,284 @@
+package main
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidQuery is returned for a TaskQuery that cannot be run, such as an unknown
+// sort key or a cursor from another query.
+var ErrInvalidQuery = errors.New("invalid task query")
+
+// maxTaskPageSize bounds the tasks returned by one paged request.
+const maxTaskPageSize = 1000
+
+// Keys tasks can be sorted by
+const (
+	sortByID        = "id"
+	sortByTitle     = "title"
+	sortByCreated   = "created"
+	sortByCompleted = "completed"
+)
+
+// TaskQuery selects, orders and pages a user's tasks for QueryTasks. The zero value
+// returns every task ordered by ID.
+type TaskQuery struct {
+	Completed     *bool       // Only completed or only open tasks
+	Text          string      // Case-insensitive match in the title or description
+	CreatedAfter  time.Time   // Inclusive
+	CreatedBefore time.Time   // Exclusive
+	Filter        *TaskFilter // Written in the filter language, as in GET /tasks?q=
+	Sort          []SortKey   // Ties are broken by ID
+	Limit         int         // Page size; 0 returns all matches
+	Cursor        string      // TaskPage.NextCursor of the previous page
+}
+
+type SortKey struct {
+	Field string
+	Desc  bool
+}
+
+// TaskPage is one page of a query's results.
+type TaskPage struct {
+	Tasks      []Task
+	Total      int    // Matching tasks across all pages
+	NextCursor string // Empty on the last page
+}
+
+// taskCursor marks the last task of a page by its sort values.
+type taskCursor struct {
+	Sort      string    `json:"s"`
+	ID        int       `json:"i"`
+	Title     string    `json:"t,omitempty"`
+	CreatedAt time.Time `json:"c,omitzero"`
+	Completed bool      `json:"d,omitempty"`
+}
+
+// parseSort reads a sort parameter such as "-created,title", where a leading minus
+// sorts that key in descending order.
+func parseSort(s string) ([]SortKey, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var keys []SortKey
+	for _, field := range strings.Split(s, ",") {
+		key := SortKey{Field: strings.TrimPrefix(field, "-"), Desc: strings.HasPrefix(field, "-")}
+		switch key.Field {
+		case sortByID, sortByTitle, sortByCreated, sortByCompleted:
+		default:
+			return nil, fmt.Errorf("%w: unknown sort key %q, use id, title, created or completed", ErrInvalidQuery, key.Field)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func formatSort(keys []SortKey) string {
+	fields := make([]string, len(keys))
+	for i, key := range keys {
+		fields[i] = key.Field
+		if key.Desc {
+			fields[i] = "-" + key.Field
+		}
+	}
+	return strings.Join(fields, ",")
+}
+
+// validate checks the query and decodes its cursor, if any.
+func (query TaskQuery) validate() (*taskCursor, error) {
+	if _, err := parseSort(formatSort(query.Sort)); err != nil {
+		return nil, err
+	}
+	if query.Limit < 0 || query.Limit > maxTaskPageSize { // 0 means no limit
+		return nil, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidQuery, maxTaskPageSize)
+	}
+	if query.Cursor == "" {
+		return nil, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(query.Cursor)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	}
+	var cursor taskCursor
+	if err := json.Unmarshal(raw, &cursor); err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	}
+	if cursor.Sort != formatSort(query.Sort) {
+		return nil, fmt.Errorf("%w: the cursor belongs to a query with another sort order", ErrInvalidQuery)
+	}
+	return &cursor, nil
+}
+
+// encodeCursor returns the cursor for the page ending with task.
+func (query TaskQuery) encodeCursor(task Task) string {
+	cursor := taskCursor{Sort: formatSort(query.Sort), ID: task.ID}
+	for _, key := range query.Sort {
+		switch key.Field {
+		case sortByTitle:
+			cursor.Title = task.Title
+		case sortByCreated:
+			cursor.CreatedAt = task.CreatedAt
+		case sortByCompleted:
+			cursor.Completed = task.Completed
+		}
+	}
+	raw, _ := json.Marshal(cursor) // Plain fields cannot fail to encode
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func (cursor taskCursor) task() Task {
+	return Task{ID: cursor.ID, Title: cursor.Title, CreatedAt: cursor.CreatedAt, Completed: cursor.Completed}
+}
+
+func (query TaskQuery) matches(task Task) bool {
+	if query.Completed != nil && task.Completed != *query.Completed {
+		return false
+	}
+	if query.Text != "" && !containsFold(task.Title, query.Text) && !containsFold(task.Description, query.Text) {
+		return false
+	}
+	if !query.CreatedAfter.IsZero() && task.CreatedAt.Before(query.CreatedAfter) {
+		return false
+	}
+	if !query.CreatedBefore.IsZero() && !task.CreatedAt.Before(query.CreatedBefore) {
+		return false
+	}
+	if query.Filter != nil && !query.Filter.Match(task) {
+		return false
+	}
+	return true
+}
+
+// less orders tasks by the query's sort keys, then by ID.
+func (query TaskQuery) less(a, b Task) bool {
+	for _, key := range query.Sort {
+		order := 0
+		switch key.Field {
+		case sortByID:
+			order = cmp.Compare(a.ID, b.ID)
+		case sortByTitle:
+			order = strings.Compare(a.Title, b.Title)
+		case sortByCreated:
+			order = a.CreatedAt.Compare(b.CreatedAt)
+		case sortByCompleted:
+			order = compareBools(a.Completed, b.Completed)
+		}
+		if key.Desc {
+			order = -order
+		}
+		if order != 0 {
+			return order < 0
+		}
+	}
+	return a.ID < b.ID
+}
+
+// queryTaskList runs query over all of a user's tasks. Stores that keep tasks in
+// memory use it to implement QueryTasks.
+func queryTaskList(tasks []Task, query TaskQuery) (TaskPage, error) {
+	cursor, err := query.validate()
+	if err != nil {
+		return TaskPage{}, err
+	}
+
+	matches := make([]Task, 0, len(tasks))
+	for _, task := range tasks {
+		if query.matches(task) {
+			matches = append(matches, task)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return query.less(matches[i], matches[j]) })
+
+	page := TaskPage{Tasks: matches, Total: len(matches)}
+	if cursor != nil {
+		after := cursor.task()
+		start := sort.Search(len(matches), func(i int) bool { return query.less(after, matches[i]) })
+		page.Tasks = matches[start:]
+	}
+	if query.Limit > 0 && len(page.Tasks) > query.Limit {
+		page.Tasks = page.Tasks[:query.Limit]
+		page.NextCursor = query.encodeCursor(page.Tasks[query.Limit-1])
+	}
+	return page, nil
+}
+
+// parseTaskQuery reads a TaskQuery from the parameters of GET /tasks.
+func parseTaskQuery(params url.Values) (TaskQuery, error) {
+	query := TaskQuery{Text: params.Get("text"), Cursor: params.Get("cursor")}
+
+	if value := params.Get("completed"); value != "" {
+		completed, err := strconv.ParseBool(value)
+		if err != nil {
+			return TaskQuery{}, fmt.Errorf("%w: completed must be true or false", ErrInvalidQuery)
+		}
+		query.Completed = &completed
+	}
+
+	for name, target := range map[string]*time.Time{"created_after": &query.CreatedAfter, "created_before": &query.CreatedBefore} {
+		if value := params.Get(name); value != "" {
+			t, err := parseQueryTime(value)
+			if err != nil {
+				return TaskQuery{}, fmt.Errorf("%w: %s must be a date (2006-01-02) or an RFC 3339 time", ErrInvalidQuery, name)
+			}
+			*target = t
+		}
+	}
+
+	if value := strings.TrimSpace(params.Get("q")); value != "" {
+		filter, err := parseTaskFilter(value, time.Now())
+		if err != nil {
+			return TaskQuery{}, err
+		}
+		query.Filter = filter
+	}
+
+	if value := params.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			return TaskQuery{}, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidQuery, maxTaskPageSize)
+		}
+		query.Limit = limit
+	}
+
+	sortKeys, err := parseSort(params.Get("sort"))
+	if err != nil {
+		return TaskQuery{}, err
+	}
+	query.Sort = sortKeys
+
+	_, err = query.validate()
+	return query, err
+}
+
+// parseQueryTime reads an RFC 3339 time or a date, which means midnight UTC.
+func parseQueryTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
+
+// containsFold reports whether substr is in s, ignoring case.
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+func compareBools(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case !a:
+		return -1
+	}
+	return 1
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// queryTestTasks have creation times a day apart, starting on 1 March 2024.
+func queryTestTasks() []Task {
+	start := time.Date(2024, 3, 1, 9, 0, 0, 123456789, time.UTC)
+	titles := []string{"Buy milk", "Call Émile", "buy stamps", "Write report", "Pay rent", "Buy bread"}
+	tasks := make([]Task, len(titles))
+	for i, title := range titles {
+		tasks[i] = Task{ID: i + 1, Title: title, Completed: i%2 == 1, Version: 1, CreatedAt: start.Add(time.Duration(i) * 24 * time.Hour)}
+	}
+	tasks[3].Description = "Quarterly numbers for ÉMILE"
+	return tasks
+}
+
+func taskIDs(tasks []Task) []int {
+	ids := make([]int, len(tasks))
+	for i, task := range tasks {
+		ids[i] = task.ID
+	}
+	return ids
+}
+
+func TestStoresQueryTasks(t *testing.T) {
+	dir := t.TempDir()
+	stores := map[string]TaskStore{
+		"memory":  localTaskStore(),
+		"json":    newTestJSONStore(t, filepath.Join(dir, "tasks.json")),
+		"wal":     newTestWALStore(t, dir, 0),
+		"sqlite":  newTestSQLiteStore(t, filepath.Join(dir, "tasks.db")),
+		"sharded": newTestShardedStore(t, filepath.Join(dir, "tasks.d"), 0),
+		"cached":  newCachingTaskStore(localTaskStore(), 0),
+	}
+	open := false
+	now := time.Date(2024, 3, 8, 0, 0, 0, 0, time.UTC)
+	filter := func(source string) *TaskFilter {
+		filter, err := parseTaskFilter(source, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return filter
+	}
+
+	cases := []struct {
+		name  string
+		query TaskQuery
+		ids   []int
+	}{
+		{"default order", TaskQuery{}, []int{1, 2, 3, 4, 5, 6}},
+		{"open only", TaskQuery{Completed: &open}, []int{1, 3, 5}},
+		{"text in title or description", TaskQuery{Text: "émile"}, []int{2, 4}},
+		{"created range", TaskQuery{CreatedAfter: time.Date(2024, 3, 2, 9, 0, 0, 123456789, time.UTC), CreatedBefore: time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)}, []int{2, 3}},
+		{"several keys", TaskQuery{Sort: []SortKey{{Field: sortByCompleted, Desc: true}, {Field: sortByTitle}}}, []int{6, 2, 4, 1, 5, 3}},
+		{"filter", TaskQuery{Filter: filter("status:open created:>=2024-03-02 -title:rent")}, []int{3}},
+		{"filter with age and numbers", TaskQuery{Filter: filter(`created:<4d id:>=5 "buy"`)}, []int{6}},
+		{"newest first", TaskQuery{Text: "buy", Sort: []SortKey{{Field: sortByCreated, Desc: true}}}, []int{6, 3, 1}},
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			if err := store.ImportTasks(ctx, "alice", queryTestTasks()); err != nil {
+				t.Fatal(err)
+			}
+			mustAddTask(t, store, "bob", "Buy milk", "")
+
+			for _, c := range cases {
+				page, err := store.QueryTasks(ctx, "alice", c.query)
+				if err != nil {
+					t.Fatalf("%s: %v", c.name, err)
+				}
+				if got := taskIDs(page.Tasks); !slices.Equal(got, c.ids) || page.Total != len(c.ids) || page.NextCursor != "" {
+					t.Errorf("%s: expected %v, got %v (total %d)", c.name, c.ids, got, page.Total)
+				}
+			}
+
+			// Page through by title, two at a time
+			query := TaskQuery{Sort: []SortKey{{Field: sortByTitle}}, Limit: 2}
+			var seen []int
+			for pages := 0; pages < 10; pages++ {
+				page, err := store.QueryTasks(ctx, "alice", query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if page.Total != 6 {
+					t.Errorf("Expected a total of 6 on every page, got %d", page.Total)
+				}
+				seen = append(seen, taskIDs(page.Tasks)...)
+				if page.NextCursor == "" {
+					break
+				}
+				query.Cursor = page.NextCursor
+			}
+			if expected := []int{6, 1, 2, 5, 4, 3}; !slices.Equal(seen, expected) {
+				t.Errorf("Expected pages to cover %v, got %v", expected, seen)
+			}
+
+			query.Sort = nil
+			if _, err := store.QueryTasks(ctx, "alice", query); !errors.Is(err, ErrInvalidQuery) {
+				t.Errorf("Expected a cursor from another sort order to be rejected, got %v", err)
+			}
+		})
+	}
+}
+
+func TestTaskHandlerPagesWithLinkHeader(t *testing.T) {
+	previousTasks, previousUsers := taskStore, userStore
+	taskStore, userStore = localTaskStore(), newMemoryUserStore()
+	defer func() { taskStore, userStore = previousTasks, previousUsers }()
+	if err := taskStore.ImportTasks(context.Background(), "alice", queryTestTasks()); err != nil {
+		t.Fatal(err)
+	}
+	router := newRouter()
+
+	first := httptest.NewRecorder()
+	router.ServeHTTP(first, httptest.NewRequest(http.MethodGet, "/api/v1/tasks?username=alice&completed=false&sort=-created&limit=2", nil))
+	if first.Code != http.StatusOK || first.Header().Get("X-Total-Count") != "3" {
+		t.Fatalf("Expected 200 with a total of 3, got %d %q", first.Code, first.Header().Get("X-Total-Count"))
+	}
+	link := first.Header().Get("Link")
+	if !strings.HasPrefix(link, "</api/v1/tasks?") || !strings.HasSuffix(link, `>; rel="next"`) {
+		t.Fatalf("Expected a Link to the next page, got %q", link)
+	}
+
+	next := httptest.NewRecorder()
+	router.ServeHTTP(next, httptest.NewRequest(http.MethodGet, strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`), nil))
+	var tasks []Task
+	if err := json.NewDecoder(next.Body).Decode(&tasks); err != nil {
+		t.Fatal(err)
+	}
+	if ids := taskIDs(tasks); !slices.Equal(ids, []int{1}) || next.Header().Get("Link") != "" {
+		t.Errorf("Expected the last page to hold task 1 and no Link, got %v %q", ids, next.Header().Get("Link"))
+	}
+
+	invalid := httptest.NewRecorder()
+	router.ServeHTTP(invalid, httptest.NewRequest(http.MethodGet, "/api/v1/tasks?username=alice&sort=priority", nil))
+	if invalid.Code != http.StatusBadRequest || !strings.Contains(invalid.Body.String(), "priority") {
+		t.Errorf("Expected 400 naming the unknown sort key, got %d %q", invalid.Code, invalid.Body.String())
+	}
+
+	filtered := httptest.NewRecorder()
+	router.ServeHTTP(filtered, httptest.NewRequest(http.MethodGet, "/api/v1/tasks?username=alice&q="+url.QueryEscape("status:open priority:high"), nil))
+	if filtered.Code != http.StatusBadRequest || !strings.Contains(filtered.Body.String(), `column 13: unknown field "priority"`) {
+		t.Errorf("Expected 400 pointing at the unknown field, got %d %q", filtered.Code, filtered.Body.String())
+	}
+}
+
+func TestZeroCreationTimeIsLeftOut(t *testing.T) {
+	raw, err := json.Marshal(Task{ID: 1, Title: "Old", Version: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), "created_at") {
+		t.Errorf("Expected no created_at for a task without one, got %s", raw)
+	}
+
+	cursor := TaskQuery{Sort: []SortKey{{Field: sortByCreated}}}.encodeCursor(Task{ID: 1})
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(decoded), `"c"`) {
+		t.Errorf("Expected no creation time in the cursor, got %s", decoded)
+	}
+}
@@ -1,26 +1,120 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
+	"fmt"
+	"net/url"
 	"os"
 	"sort"
 	"sync"
+	"time"
 )
 
+func init() {
+	registerTaskStore("memory", taskStoreBackend{
+		open: func(string, url.Values) (TaskStore, error) { return localTaskStore(), nil },
+	})
+	registerTaskStore("json", taskStoreBackend{
+		defaultPath: "tasks.json",
+		open:        func(path string, _ url.Values) (TaskStore, error) { return openJSONTaskStore(path) },
+	})
+}
+
 type Task struct {
 	ID          int    `json:"id"`
 	Title       string `json:"title"`
 	Description string `json:"description"`
 	Completed   bool   `json:"completed"`
+	Version     int    `json:"version"` // Incremented on every change, starting at 1
+
+	CreatedAt time.Time `json:"created_at,omitzero"` // Zero for tasks created before it was recorded
+}
+
+// TaskUpdate holds the fields to change on a task; nil fields are left as they are.
+type TaskUpdate struct {
+	Title       *string `json:"title,omitempty"`
+	Description *string `json:"description,omitempty"`
+	Completed   *bool   `json:"completed,omitempty"`
+}
+
+// apply returns task with the update applied and its version incremented.
+func (update TaskUpdate) apply(task Task) Task {
+	if update.Title != nil {
+		task.Title = *update.Title
+	}
+	if update.Description != nil {
+		task.Description = *update.Description
+	}
+	if update.Completed != nil {
+		task.Completed = *update.Completed
+	}
+	task.Version++
+	return task
 }
 
+func completeUpdate() TaskUpdate {
+	completed := true
+	return TaskUpdate{Completed: &completed}
+}
+
+// Errors returned by every TaskStore. Implementations wrap them with details, so
+// callers should compare with errors.Is.
+var (
+	ErrNotFound  = errors.New("task not found")
+	ErrForbidden = errors.New("task belongs to another user")
+	ErrConflict  = errors.New("task already exists")
+
+	ErrVersionMismatch = errors.New("task was changed by someone else")
+)
+
+// TaskStore methods honour ctx cancellation and return errors wrapping ErrNotFound,
+// ErrForbidden, ErrConflict or ErrVersionMismatch where those apply; anything else is
+// a storage failure.
+//
+// Mutations of a single task take the version the caller last saw and fail with
+// ErrVersionMismatch if the task has changed since. A version of 0 skips the check.
 type TaskStore interface {
-	AddTask(userName, title string, description string) Task
-	RemoveTask(userName string, id int) error
-	ListTasks(userName string) []Task
-	GetTask(userName string, id int) (Task, error)
-	CompleteTask(userName string, id int) error
+	AddTask(ctx context.Context, userName, title string, description string) (Task, error)
+	RemoveTask(ctx context.Context, userName string, id int, version int) error
+	ListTasks(ctx context.Context, userName string) ([]Task, error)
+	// QueryTasks returns one page of the user's tasks that match query, in its order.
+	// Invalid queries fail with ErrInvalidQuery.
+	QueryTasks(ctx context.Context, userName string, query TaskQuery) (TaskPage, error)
+	GetTask(ctx context.Context, userName string, id int) (Task, error)
+	CompleteTask(ctx context.Context, userName string, id int, version int) (Task, error)
+	UpdateTask(ctx context.Context, userName string, id int, version int, update TaskUpdate) (Task, error)
+	RemoveUserTasks(ctx context.Context, userName string) error
+	ListUserNames(ctx context.Context) ([]string, error)
+	ImportTasks(ctx context.Context, userName string, tasks []Task) error
+
+	// ApplyBatch runs ops for userName atomically: either every operation is applied
+	// and persisted together, or none is and the error is a *BatchError.
+	ApplyBatch(ctx context.Context, userName string, ops []BatchOp) ([]Task, error)
+
+	// SnapshotTasks returns a copy of every user's tasks as of a single point in time.
+	SnapshotTasks(ctx context.Context) (map[string]map[int]Task, error)
+}
+
+// checkVersion fails unless version is 0 or matches the task's current version.
+func checkVersion(task Task, version int) error {
+	if version != 0 && version != task.Version {
+		return fmt.Errorf("%w: id %d is at version %d, not %d", ErrVersionMismatch, task.ID, task.Version, version)
+	}
+	return nil
+}
+
+// importedTasks returns a copy of tasks where tasks written before versioning start
+// at version 1.
+func importedTasks(tasks []Task) []Task {
+	imported := make([]Task, len(tasks))
+	for i, task := range tasks {
+		if task.Version == 0 {
+			task.Version = 1
+		}
+		imported[i] = task
+	}
+	return imported
 }
 
 type inMemoryTaskStore struct {
@@ -36,7 +130,11 @@ func localTaskStore() *inMemoryTaskStore {
 	}
 }
 
-func (store *inMemoryTaskStore) AddTask(userName, title string, description string) Task {
+func (store *inMemoryTaskStore) AddTask(ctx context.Context, userName, title string, description string) (Task, error) {
+	if err := ctx.Err(); err != nil {
+		return Task{}, err
+	}
+
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
@@ -55,6 +153,8 @@ func (store *inMemoryTaskStore) AddTask(userName, title string, description stri
 		Title:       title,
 		Description: description,
 		Completed:   false,
+		Version:     1,
+		CreatedAt:   time.Now().UTC(),
 	}
 
 	if store.tasks[id] == nil {
@@ -62,19 +162,37 @@ func (store *inMemoryTaskStore) AddTask(userName, title string, description stri
 	}
 	store.tasks[id][userName] = task // Store task under the user
 
-	return task
+	return task, nil
 }
 
-func (store *inMemoryTaskStore) RemoveTask(userName string, id int) error {
+// lookup returns the user's task, telling a missing ID apart from one owned by someone else.
+func (store *inMemoryTaskStore) lookup(userName string, id int) (Task, error) {
+	userTasks, exists := store.tasks[id]
+	if !exists {
+		return Task{}, fmt.Errorf("%w: id %d", ErrNotFound, id)
+	}
+
+	task, exists := userTasks[userName]
+	if !exists {
+		return Task{}, fmt.Errorf("%w: id %d", ErrForbidden, id)
+	}
+	return task, nil
+}
+
+func (store *inMemoryTaskStore) RemoveTask(ctx context.Context, userName string, id int, version int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
-	if _, ok := store.tasks[id]; !ok {
-		return errors.New("task not found")
+	task, err := store.lookup(userName, id)
+	if err != nil {
+		return err
 	}
-
-	if _, ok := store.tasks[id][userName]; !ok {
-		return errors.New("task not found for user")
+	if err := checkVersion(task, version); err != nil {
+		return err
 	}
 
 	delete(store.tasks[id], userName)
@@ -87,7 +205,11 @@ func (store *inMemoryTaskStore) RemoveTask(userName string, id int) error {
 	return nil
 }
 
-func (store *inMemoryTaskStore) ListTasks(userName string) []Task {
+func (store *inMemoryTaskStore) ListTasks(ctx context.Context, userName string) ([]Task, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
@@ -98,33 +220,176 @@ func (store *inMemoryTaskStore) ListTasks(userName string) []Task {
 		}
 	}
 
-	return taskList
+	return taskList, nil
+}
+
+func (store *inMemoryTaskStore) QueryTasks(ctx context.Context, userName string, query TaskQuery) (TaskPage, error) {
+	tasks, err := store.ListTasks(ctx, userName)
+	if err != nil {
+		return TaskPage{}, err
+	}
+	return queryTaskList(tasks, query)
 }
 
-func (store *inMemoryTaskStore) GetTask(userName string, id int) (Task, error) {
+func (store *inMemoryTaskStore) GetTask(ctx context.Context, userName string, id int) (Task, error) {
+	if err := ctx.Err(); err != nil {
+		return Task{}, err
+	}
+
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
-	if userTasks, exists := store.tasks[id]; exists {
-		if task, exists := userTasks[userName]; exists {
-			return task, nil
+	return store.lookup(userName, id)
+}
+
+func (store *inMemoryTaskStore) CompleteTask(ctx context.Context, userName string, id int, version int) (Task, error) {
+	return store.UpdateTask(ctx, userName, id, version, completeUpdate())
+}
+
+func (store *inMemoryTaskStore) UpdateTask(ctx context.Context, userName string, id int, version int, update TaskUpdate) (Task, error) {
+	if err := ctx.Err(); err != nil {
+		return Task{}, err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	task, err := store.lookup(userName, id)
+	if err != nil {
+		return Task{}, err
+	}
+	if err := checkVersion(task, version); err != nil {
+		return Task{}, err
+	}
+
+	task = update.apply(task)
+	store.tasks[id][userName] = task
+	return task, nil
+}
+
+func (store *inMemoryTaskStore) RemoveUserTasks(ctx context.Context, userName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for id, userTasks := range store.tasks {
+		if _, exists := userTasks[userName]; !exists {
+			continue
 		}
+
+		delete(userTasks, userName)
+		if len(userTasks) == 0 {
+			delete(store.tasks, id)
+		}
+		store.reusableIds = append(store.reusableIds, id)
 	}
-	return Task{}, errors.New("task not found for user")
+
+	sort.Ints(store.reusableIds)
+	return nil
 }
 
-func (store *inMemoryTaskStore) CompleteTask(userName string, id int) error {
+func (store *inMemoryTaskStore) ListUserNames(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
-	if userTasks, exists := store.tasks[id]; exists {
-		if task, exists := userTasks[userName]; exists {
-			task.Completed = true
-			userTasks[userName] = task
-			return nil
+	seen := make(map[string]bool)
+	for _, userTasks := range store.tasks {
+		for userName := range userTasks {
+			seen[userName] = true
 		}
 	}
-	return errors.New("task not found for user")
+
+	userNames := make([]string, 0, len(seen))
+	for userName := range seen {
+		userNames = append(userNames, userName)
+	}
+	sort.Strings(userNames)
+	return userNames, nil
+}
+
+// ImportTasks stores tasks as they are, keeping their IDs and completion state.
+func (store *inMemoryTaskStore) ImportTasks(ctx context.Context, userName string, tasks []Task) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	tasks = importedTasks(tasks)
+	for _, task := range tasks {
+		if _, exists := store.tasks[task.ID]; exists {
+			return fmt.Errorf("%w: id %d", ErrConflict, task.ID)
+		}
+	}
+
+	byUser := store.byUser()
+	for _, task := range tasks {
+		store.tasks[task.ID] = map[string]Task{userName: task}
+		if byUser[userName] == nil {
+			byUser[userName] = make(map[int]Task)
+		}
+		byUser[userName][task.ID] = task
+	}
+
+	store.idSeq, store.reusableIds = idStateFromTasks(byUser)
+	return nil
+}
+
+// byUser returns the tasks as a new map of userName to tasks.
+func (store *inMemoryTaskStore) byUser() map[string]map[int]Task {
+	byUser := make(map[string]map[int]Task)
+	for id, userTasks := range store.tasks {
+		for owner, task := range userTasks {
+			if byUser[owner] == nil {
+				byUser[owner] = make(map[int]Task)
+			}
+			byUser[owner][id] = task
+		}
+	}
+	return byUser
+}
+
+func (store *inMemoryTaskStore) SnapshotTasks(ctx context.Context) (map[string]map[int]Task, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.byUser(), nil
+}
+
+func (store *inMemoryTaskStore) ApplyBatch(ctx context.Context, userName string, ops []BatchOp) ([]Task, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	byUser := store.byUser()
+	results, err := applyBatch(byUser, userName, ops, newGapIDAllocator(byUser))
+	if err != nil {
+		return nil, err
+	}
+
+	store.tasks = make(map[int]map[string]Task)
+	for owner, userTasks := range byUser {
+		for id, task := range userTasks {
+			store.tasks[id] = map[string]Task{owner: task}
+		}
+	}
+	store.idSeq, store.reusableIds = idStateFromTasks(byUser)
+	return results, nil
 }
 
 type jsonTaskStore struct {
@@ -133,15 +398,29 @@ type jsonTaskStore struct {
 	tasks       map[string]map[int]Task // Map of userName to tasks
 	idSeq       int
 	reusableIds []int
+	lock        *dataFileLock
+	stop        chan struct{}
+	stopped     sync.Once
+
+	// Set when watching the file for external changes
+	watching bool
+	fileInfo os.FileInfo             // The file as the store last read or wrote it
+	base     map[string]map[int]Task // The tasks as the store last read or wrote them
 }
 
-func newJSONTaskStore(filePath string) *jsonTaskStore {
+func openJSONTaskStore(filePath string) (*jsonTaskStore, error) {
+	// Only one process may write the file, or each would overwrite the other's changes
+	lock, err := lockDataFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
 	// Check if the file exists
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
 		// Create an empty file if it doesn't exist
-		if err := createEmptyJSONFile(filePath); err != nil {
-			logger.Error("Failed to create empty JSON file", "error", err)
-			os.Exit(1)
+		if err := createEmptyJSONFile(filePath, schemaKindTasks); err != nil {
+			_ = lock.Unlock()
+			return nil, fmt.Errorf("failed to create %s: %w", filePath, err)
 		}
 	}
 
@@ -150,21 +429,51 @@ func newJSONTaskStore(filePath string) *jsonTaskStore {
 		filePath:    filePath,
 		tasks:       make(map[string]map[int]Task), // Initialize the map for user-specific tasks
 		reusableIds: []int{},
+		lock:        lock,
+		stop:        make(chan struct{}),
 	}
 
-	// Load tasks from the file during initialization
+	// Load tasks from the file during initialization. A corrupt file is recovered from
+	// backups, so only I/O failures end up here.
 	if err := store.loadFromFile(); err != nil {
-		logger.Error("Failed to load JSON file", "error", err)
-		os.Exit(1)
+		_ = store.Close()
+		return nil, fmt.Errorf("failed to load tasks from %s: %w", filePath, err)
+	}
+
+	if *jsonWatchInterval > 0 {
+		if err := store.startWatching(*jsonWatchInterval); err != nil {
+			_ = store.Close()
+			return nil, fmt.Errorf("failed to watch %s: %w", filePath, err)
+		}
 	}
 
-	return store
+	return store, nil
 }
 
-func (store *jsonTaskStore) AddTask(userName, title string, description string) Task {
+// Close stops watching the file and releases the lock. All data is already saved.
+func (store *jsonTaskStore) Close() error {
+	store.stopped.Do(func() { close(store.stop) })
+
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
+	if store.lock == nil {
+		return nil
+	}
+	err := store.lock.Unlock()
+	store.lock = nil
+	return err
+}
+
+func (store *jsonTaskStore) AddTask(ctx context.Context, userName, title string, description string) (Task, error) {
+	if err := ctx.Err(); err != nil {
+		return Task{}, err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.mergeExternalChanges()
+
 	var id int
 	if len(store.reusableIds) > 0 {
 		id = store.reusableIds[0]
@@ -179,6 +488,8 @@ func (store *jsonTaskStore) AddTask(userName, title string, description string)
 		Title:       title,
 		Description: description,
 		Completed:   false,
+		Version:     1,
+		CreatedAt:   time.Now().UTC(),
 	}
 
 	// Store task under the user
@@ -188,41 +499,86 @@ func (store *jsonTaskStore) AddTask(userName, title string, description string)
 	store.tasks[userName][task.ID] = task
 
 	if err := store.saveToFile(); err != nil {
-		logger.Error("Failed to save JSON file", "error", err)
+		logger.Error("Failed to save JSON file", "traceID", traceIDFrom(ctx), "error", err)
+		store.restore(userName, Task{ID: task.ID}, false)
+		return Task{}, err
 	}
 
-	return task
+	return task, nil
 }
 
-func (store *jsonTaskStore) RemoveTask(userName string, id int) error {
-	store.mutex.Lock()
-	defer store.mutex.Unlock()
-
-	if userTasks, exists := store.tasks[userName]; exists {
-		if _, ok := userTasks[id]; !ok {
-			return errors.New("task not found for user")
+// restore undoes an in-memory change that could not be saved: it puts task back for
+// the user, or removes it when present is false.
+func (store *jsonTaskStore) restore(userName string, task Task, present bool) {
+	if present {
+		if store.tasks[userName] == nil {
+			store.tasks[userName] = make(map[int]Task)
 		}
-
-		delete(userTasks, id)
-		if len(userTasks) == 0 {
-			delete(store.tasks, userName) // Remove user if no tasks are left
+		store.tasks[userName][task.ID] = task
+	} else {
+		delete(store.tasks[userName], task.ID)
+		if len(store.tasks[userName]) == 0 {
+			delete(store.tasks, userName)
 		}
+	}
+	store.idSeq, store.reusableIds = idStateFromTasks(store.tasks)
+}
 
-		store.reusableIds = append(store.reusableIds, id)
+// lookupUserTask finds a task in a map of userName to tasks, telling a missing ID apart
+// from one owned by someone else.
+func lookupUserTask(tasks map[string]map[int]Task, userName string, id int) (Task, error) {
+	if task, exists := tasks[userName][id]; exists {
+		return task, nil
+	}
 
-		if err := store.saveToFile(); err != nil {
-			logger.Error("Error saving to file after deletion", "error", err)
-			return err
+	for _, userTasks := range tasks {
+		if _, exists := userTasks[id]; exists {
+			return Task{}, fmt.Errorf("%w: id %d", ErrForbidden, id)
 		}
+	}
+	return Task{}, fmt.Errorf("%w: id %d", ErrNotFound, id)
+}
 
-		logger.Info("Task deleted and file updated", "taskID", id, "userName", userName)
-		return nil
+func (store *jsonTaskStore) RemoveTask(ctx context.Context, userName string, id int, version int) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	return errors.New("user not found")
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.mergeExternalChanges()
+
+	task, err := lookupUserTask(store.tasks, userName, id)
+	if err != nil {
+		return err
+	}
+	if err := checkVersion(task, version); err != nil {
+		return err
+	}
+
+	userTasks := store.tasks[userName]
+	delete(userTasks, id)
+	if len(userTasks) == 0 {
+		delete(store.tasks, userName) // Remove user if no tasks are left
+	}
+
+	store.reusableIds = append(store.reusableIds, id)
+
+	if err := store.saveToFile(); err != nil {
+		logger.Error("Error saving to file after deletion", "traceID", traceIDFrom(ctx), "error", err)
+		store.restore(userName, task, true)
+		return err
+	}
+
+	logger.Info("Task deleted and file updated", "traceID", traceIDFrom(ctx), "taskID", id, "userName", userName)
+	return nil
 }
 
-func (store *jsonTaskStore) ListTasks(userName string) []Task {
+func (store *jsonTaskStore) ListTasks(ctx context.Context, userName string) ([]Task, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
@@ -234,66 +590,216 @@ func (store *jsonTaskStore) ListTasks(userName string) []Task {
 		}
 	}
 
-	return taskList
+	return taskList, nil
 }
 
-func (store *jsonTaskStore) GetTask(userName string, id int) (Task, error) {
+func (store *jsonTaskStore) QueryTasks(ctx context.Context, userName string, query TaskQuery) (TaskPage, error) {
+	tasks, err := store.ListTasks(ctx, userName)
+	if err != nil {
+		return TaskPage{}, err
+	}
+	return queryTaskList(tasks, query)
+}
+
+func (store *jsonTaskStore) GetTask(ctx context.Context, userName string, id int) (Task, error) {
+	if err := ctx.Err(); err != nil {
+		return Task{}, err
+	}
+
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
-	if userTasks, exists := store.tasks[userName]; exists {
-		if task, exists := userTasks[id]; exists {
-			return task, nil
-		}
+	return lookupUserTask(store.tasks, userName, id)
+}
+
+func (store *jsonTaskStore) CompleteTask(ctx context.Context, userName string, id int, version int) (Task, error) {
+	return store.UpdateTask(ctx, userName, id, version, completeUpdate())
+}
+
+func (store *jsonTaskStore) UpdateTask(ctx context.Context, userName string, id int, version int, update TaskUpdate) (Task, error) {
+	if err := ctx.Err(); err != nil {
+		return Task{}, err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.mergeExternalChanges()
+
+	task, err := lookupUserTask(store.tasks, userName, id)
+	if err != nil {
+		return Task{}, err
 	}
-	return Task{}, errors.New("task not found for user")
+	if err := checkVersion(task, version); err != nil {
+		return Task{}, err
+	}
+
+	updated := update.apply(task)
+	store.tasks[userName][id] = updated
+
+	if err := store.saveToFile(); err != nil {
+		logger.Error("Error saving to file", "traceID", traceIDFrom(ctx), "error", err)
+		store.tasks[userName][id] = task
+		return Task{}, err
+	}
+
+	logger.Info("Task updated and saved to file", "traceID", traceIDFrom(ctx), "taskID", id, "version", updated.Version, "userName", userName)
+	return updated, nil
 }
 
-func (store *jsonTaskStore) CompleteTask(userName string, id int) error {
+func (store *jsonTaskStore) RemoveUserTasks(ctx context.Context, userName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
+	store.mergeExternalChanges()
 
-	if userTasks, exists := store.tasks[userName]; exists {
-		if task, exists := userTasks[id]; exists {
-			task.Completed = true
-			userTasks[id] = task
+	userTasks, exists := store.tasks[userName]
+	if !exists {
+		return nil
+	}
 
-			if err := store.saveToFile(); err != nil {
-				logger.Error("Error saving to file", "error", err)
-				return err
-			}
+	delete(store.tasks, userName)
+
+	if err := store.saveToFile(); err != nil {
+		logger.Error("Error saving to file after removing user tasks", "traceID", traceIDFrom(ctx), "error", err)
+		store.tasks[userName] = userTasks
+		return err
+	}
 
-			logger.Info("Task marked as complete and saved to file", "taskID", id, "userName", userName)
-			return nil
+	store.idSeq, store.reusableIds = idStateFromTasks(store.tasks)
+
+	logger.Info("All tasks removed for user", "traceID", traceIDFrom(ctx), "userName", userName)
+	return nil
+}
+
+func (store *jsonTaskStore) ListUserNames(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	userNames := make([]string, 0, len(store.tasks))
+	for userName := range store.tasks {
+		userNames = append(userNames, userName)
+	}
+	sort.Strings(userNames)
+	return userNames, nil
+}
+
+// ImportTasks stores tasks as they are, keeping their IDs and completion state, and
+// saves the file once for the whole batch.
+func (store *jsonTaskStore) ImportTasks(ctx context.Context, userName string, tasks []Task) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.mergeExternalChanges()
+
+	tasks = importedTasks(tasks)
+	if err := checkImportIDs(store.tasks, tasks); err != nil {
+		return err
+	}
+
+	if store.tasks[userName] == nil {
+		store.tasks[userName] = make(map[int]Task)
+	}
+	for _, task := range tasks {
+		store.tasks[userName][task.ID] = task
+	}
+
+	if err := store.saveToFile(); err != nil {
+		logger.Error("Error saving to file after import", "traceID", traceIDFrom(ctx), "error", err)
+		for _, task := range tasks {
+			store.restore(userName, task, false)
 		}
+		return err
 	}
-	return errors.New("task not found for user")
+
+	store.idSeq, store.reusableIds = idStateFromTasks(store.tasks)
+	return nil
 }
 
-func (store *jsonTaskStore) loadFromFile() error {
+// ApplyBatch applies the whole batch to a copy of the tasks and saves the file once.
+func (store *jsonTaskStore) ApplyBatch(ctx context.Context, userName string, ops []BatchOp) ([]Task, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
+	store.mergeExternalChanges()
 
-	file, err := os.Open(store.filePath)
+	tasks := cloneTasks(store.tasks)
+	results, err := applyBatch(tasks, userName, ops, newGapIDAllocator(tasks))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer func(file *os.File) {
-		err := file.Close()
-		if err != nil {
-			logger.Error("Error closing file:", "error", err)
+
+	if err := store.writeTasks(tasks); err != nil {
+		logger.Error("Error saving to file after batch", "traceID", traceIDFrom(ctx), "error", err)
+		return nil, err
+	}
+
+	store.tasks = tasks
+	store.idSeq, store.reusableIds = idStateFromTasks(tasks)
+
+	logger.Info("Task batch applied and saved to file", "traceID", traceIDFrom(ctx), "operations", len(ops), "userName", userName)
+	return results, nil
+}
+
+func (store *jsonTaskStore) SnapshotTasks(ctx context.Context) (map[string]map[int]Task, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.mergeExternalChanges()
+	return cloneTasks(store.tasks), nil
+}
+
+// checkImportIDs fails if any imported task would overwrite an existing one.
+func checkImportIDs(existing map[string]map[int]Task, tasks []Task) error {
+	for _, task := range tasks {
+		for _, userTasks := range existing {
+			if _, exists := userTasks[task.ID]; exists {
+				return fmt.Errorf("%w: id %d", ErrConflict, task.ID)
+			}
 		}
-	}(file)
+	}
+	return nil
+}
+
+func (store *jsonTaskStore) loadFromFile() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
 
 	tasks := make(map[string]map[int]Task) // Match the type used in saveToFile
-	if err := json.NewDecoder(file).Decode(&tasks); err != nil {
+	if err := loadJSONFileWithRecovery(store.filePath, schemaKindTasks, *storeBackupCount, &tasks); err != nil {
 		return err
 	}
+	if tasks == nil {
+		tasks = make(map[string]map[int]Task)
+	}
 
 	store.tasks = tasks
 
-	// Reset reusableIds and track used IDs
-	store.reusableIds = []int{}
+	store.idSeq, store.reusableIds = idStateFromTasks(tasks)
+
+	return nil
+}
+
+// idStateFromTasks rebuilds the ID sequence and the reusable IDs (gaps below the
+// highest ID) from a set of per-user tasks.
+func idStateFromTasks(tasks map[string]map[int]Task) (int, []int) {
+	reusableIds := []int{}
 	usedIds := make(map[int]bool)
 
 	// Determine the highest ID to update the sequence
@@ -311,28 +817,21 @@ func (store *jsonTaskStore) loadFromFile() error {
 	// Populate reusableIds with missing IDs
 	for id := 1; id < highestID; id++ {
 		if !usedIds[id] {
-			store.reusableIds = append(store.reusableIds, id)
+			reusableIds = append(reusableIds, id)
 		}
 	}
 
-	store.idSeq = highestID
-
-	return nil
+	return highestID, reusableIds
 }
 
 func (store *jsonTaskStore) saveToFile() error {
-	file, err := os.Create(store.filePath)
-	if err != nil {
+	return store.writeTasks(store.tasks)
+}
+
+func (store *jsonTaskStore) writeTasks(tasks map[string]map[int]Task) error {
+	if err := writeDataFile(store.filePath, schemaKindTasks, *storeBackupCount, tasks); err != nil {
 		return err
 	}
-	defer func(file *os.File) {
-		err := file.Close()
-		if err != nil {
-			logger.Error("Error closing file:", "error", err)
-		}
-	}(file)
-
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	return encoder.Encode(store.tasks)
+	store.recordWrite(tasks)
+	return nil
 }
@@ -1,8 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"testing"
 )
@@ -22,11 +29,11 @@ func TestConcurrentAccessMemoryStore(t *testing.T) {
 			for j := 0; j < tasksPerUser; j++ {
 				taskTitle := fmt.Sprintf("Task %d", j)
 				taskDesc := fmt.Sprintf("Description for task %d", j)
-				store.AddTask(userName, taskTitle, taskDesc)
+				mustAddTask(t, store, userName, taskTitle, taskDesc)
 			}
 
 			// List tasks to ensure they were added
-			tasks := store.ListTasks(userName)
+			tasks := mustListTasks(t, store, userName)
 			if len(tasks) != tasksPerUser {
 				t.Errorf("Expected %d tasks for %s, got %d", tasksPerUser, userName, len(tasks))
 			}
@@ -37,12 +44,12 @@ func TestConcurrentAccessMemoryStore(t *testing.T) {
 }
 
 func TestConcurrentAccessJSONStore(t *testing.T) {
-	filePath := "test_tasks.json"
+	filePath := filepath.Join(t.TempDir(), "tasks.json")
 	if err := os.WriteFile(filePath, []byte("{}"), 0664); err != nil {
 		t.Fatal("Failed to clean to test file", err)
 	}
 
-	store := newJSONTaskStore("test_tasks.json")
+	store := newTestJSONStore(t, filePath)
 	totalUsers := 10
 	tasksPerUser := 100
 	wg := &sync.WaitGroup{}
@@ -56,11 +63,11 @@ func TestConcurrentAccessJSONStore(t *testing.T) {
 			for j := 0; j < tasksPerUser; j++ {
 				taskTitle := fmt.Sprintf("Task %d", j)
 				taskDesc := fmt.Sprintf("Description for task %d", j)
-				store.AddTask(userName, taskTitle, taskDesc)
+				mustAddTask(t, store, userName, taskTitle, taskDesc)
 			}
 
 			// List tasks to ensure they were added
-			tasks := store.ListTasks(userName)
+			tasks := mustListTasks(t, store, userName)
 			if len(tasks) != tasksPerUser {
 				t.Errorf("Expected %d tasks for %s, got %d", tasksPerUser, userName, len(tasks))
 			}
@@ -87,9 +94,9 @@ func TestConcurrentTaskCompletionMemoryStore(t *testing.T) {
 			for j := 0; j < tasksPerUser; j++ {
 				taskTitle := fmt.Sprintf("Task %d", j)
 				taskDesc := fmt.Sprintf("Description for task %d", j)
-				task := store.AddTask(userName, taskTitle, taskDesc)
+				task := mustAddTask(t, store, userName, taskTitle, taskDesc)
 
-				if err := store.CompleteTask(userName, task.ID); err != nil {
+				if _, err := store.CompleteTask(context.Background(), userName, task.ID, 0); err != nil {
 					t.Errorf("Failed to complete task %d for user %s: %v", task.ID, userName, err)
 				}
 			}
@@ -100,12 +107,12 @@ func TestConcurrentTaskCompletionMemoryStore(t *testing.T) {
 }
 
 func TestConcurrentTaskCompletionJSONStore(t *testing.T) {
-	filePath := "test_complete_tasks.json"
+	filePath := filepath.Join(t.TempDir(), "tasks.json")
 	if err := os.WriteFile(filePath, []byte("{}"), 0664); err != nil {
 		t.Fatal("Failed to clean to test file", err)
 	}
 
-	store := newJSONTaskStore("test_complete_tasks.json")
+	store := newTestJSONStore(t, filePath)
 
 	totalUsers := 5
 	tasksPerUser := 50
@@ -121,9 +128,9 @@ func TestConcurrentTaskCompletionJSONStore(t *testing.T) {
 			for j := 0; j < tasksPerUser; j++ {
 				taskTitle := fmt.Sprintf("Task %d", j)
 				taskDesc := fmt.Sprintf("Description for task %d", j)
-				task := store.AddTask(userName, taskTitle, taskDesc)
+				task := mustAddTask(t, store, userName, taskTitle, taskDesc)
 
-				if err := store.CompleteTask(userName, task.ID); err != nil {
+				if _, err := store.CompleteTask(context.Background(), userName, task.ID, 0); err != nil {
 					t.Errorf("Failed to complete task %d for user %s: %v", task.ID, userName, err)
 				}
 			}
@@ -132,3 +139,302 @@ func TestConcurrentTaskCompletionJSONStore(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestRemoveUserTasksJSONStore(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "tasks.json")
+	if err := os.WriteFile(filePath, []byte("{}"), 0664); err != nil {
+		t.Fatal("Failed to clean to test file", err)
+	}
+
+	store := newTestJSONStore(t, filePath)
+	for j := 0; j < 5; j++ {
+		mustAddTask(t, store, "alice", fmt.Sprintf("Task %d", j), "")
+		mustAddTask(t, store, "bob", fmt.Sprintf("Task %d", j), "")
+	}
+
+	if err := store.RemoveUserTasks(context.Background(), "alice"); err != nil {
+		t.Fatalf("Failed to remove tasks for alice: %v", err)
+	}
+
+	if tasks := mustListTasks(t, store, "alice"); len(tasks) != 0 {
+		t.Errorf("Expected no tasks for alice, got %d", len(tasks))
+	}
+	if tasks := mustListTasks(t, store, "bob"); len(tasks) != 5 {
+		t.Errorf("Expected 5 tasks for bob, got %d", len(tasks))
+	}
+
+	closeTaskStore(store)
+	reloaded := newTestJSONStore(t, filePath)
+	if tasks := mustListTasks(t, reloaded, "alice"); len(tasks) != 0 {
+		t.Errorf("Expected no tasks for alice after reload, got %d", len(tasks))
+	}
+}
+
+func TestJSONStoreRecoversFromCorruptFile(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "tasks.json")
+
+	store := newTestJSONStore(t, filePath)
+	mustAddTask(t, store, "alice", "First", "")
+	mustAddTask(t, store, "alice", "Second", "")
+
+	// Simulate a crash that left the main file truncated
+	if err := os.WriteFile(filePath, []byte(`{"alice": {"1": {"id": 1, "ti`), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	closeTaskStore(store)
+	recovered := newTestJSONStore(t, filePath)
+	if tasks := mustListTasks(t, recovered, "alice"); len(tasks) != 1 {
+		t.Errorf("Expected the newest backup with 1 task to be restored, got %d tasks", len(tasks))
+	}
+
+	corrupt, _ := filepath.Glob(filePath + ".corrupt-*")
+	if len(corrupt) != 1 {
+		t.Errorf("Expected the corrupt file to be kept aside, found %v", corrupt)
+	}
+}
+
+func TestJSONStoreKeepsRotatingBackups(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "tasks.json")
+
+	store := newTestJSONStore(t, filePath)
+	for j := 0; j < *storeBackupCount+2; j++ {
+		mustAddTask(t, store, "alice", fmt.Sprintf("Task %d", j), "")
+	}
+
+	for n := 1; n <= *storeBackupCount; n++ {
+		if _, err := os.Stat(backupPath(filePath, n)); err != nil {
+			t.Errorf("Expected backup %d to exist: %v", n, err)
+		}
+	}
+
+	if _, err := os.Stat(backupPath(filePath, *storeBackupCount+1)); !os.IsNotExist(err) {
+		t.Errorf("Expected at most %d backups", *storeBackupCount)
+	}
+
+	if leftovers, _ := filepath.Glob(filePath + ".tmp-*"); len(leftovers) != 0 {
+		t.Errorf("Expected no temporary files, found %v", leftovers)
+	}
+}
+
+// newTestJSONStore opens a JSON store that is closed, releasing its file lock, when
+// the test ends.
+func newTestJSONStore(t *testing.T, filePath string) *jsonTaskStore {
+	t.Helper()
+	store, err := openJSONTaskStore(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	return store
+}
+
+// The helpers below report store errors with t.Errorf so they are safe to call from
+// the goroutines of the concurrency tests.
+
+func mustAddTask(t *testing.T, store TaskStore, userName, title, description string) Task {
+	t.Helper()
+	task, err := store.AddTask(context.Background(), userName, title, description)
+	if err != nil {
+		t.Errorf("Failed to add task for %s: %v", userName, err)
+	}
+	return task
+}
+
+func mustListTasks(t *testing.T, store TaskStore, userName string) []Task {
+	t.Helper()
+	tasks, err := store.ListTasks(context.Background(), userName)
+	if err != nil {
+		t.Errorf("Failed to list tasks for %s: %v", userName, err)
+	}
+	return tasks
+}
+
+func mustListUserNames(t *testing.T, store TaskStore) []string {
+	t.Helper()
+	userNames, err := store.ListUserNames(context.Background())
+	if err != nil {
+		t.Errorf("Failed to list users: %v", err)
+	}
+	return userNames
+}
+
+func TestStoresReturnTypedErrors(t *testing.T) {
+	dir := t.TempDir()
+	stores := map[string]TaskStore{
+		"memory":  localTaskStore(),
+		"json":    newTestJSONStore(t, filepath.Join(dir, "tasks.json")),
+		"wal":     newTestWALStore(t, dir, 0),
+		"sqlite":  newTestSQLiteStore(t, filepath.Join(dir, "tasks.db")),
+		"sharded": newTestShardedStore(t, filepath.Join(dir, "tasks.d"), 0),
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			task := mustAddTask(t, store, "alice", "Mine", "")
+
+			if _, err := store.GetTask(ctx, "alice", task.ID+100); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Expected ErrNotFound for a missing task, got %v", err)
+			}
+			if _, err := store.CompleteTask(ctx, "bob", task.ID, 0); !errors.Is(err, ErrForbidden) {
+				t.Errorf("Expected ErrForbidden for another user's task, got %v", err)
+			}
+			if err := store.RemoveTask(ctx, "bob", task.ID, 0); !errors.Is(err, ErrForbidden) {
+				t.Errorf("Expected ErrForbidden when deleting another user's task, got %v", err)
+			}
+			if err := store.ImportTasks(ctx, "bob", []Task{task}); !errors.Is(err, ErrConflict) {
+				t.Errorf("Expected ErrConflict for an imported duplicate ID, got %v", err)
+			}
+
+			canceled, cancel := context.WithCancel(ctx)
+			cancel()
+			if _, err := store.ListTasks(canceled, "alice"); !errors.Is(err, context.Canceled) {
+				t.Errorf("Expected a canceled context to stop the call, got %v", err)
+			}
+		})
+	}
+}
+
+func TestStoreErrorStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{fmt.Errorf("%w: id 1", ErrNotFound), http.StatusNotFound},
+		{fmt.Errorf("%w: id 1", ErrForbidden), http.StatusForbidden},
+		{fmt.Errorf("%w: id 1", ErrConflict), http.StatusConflict},
+		{errors.New("disk full"), http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		if got := storeErrorStatus(test.err); got != test.want {
+			t.Errorf("storeErrorStatus(%v) = %d, want %d", test.err, got, test.want)
+		}
+	}
+}
+
+func TestStoresCheckTaskVersions(t *testing.T) {
+	dir := t.TempDir()
+	stores := map[string]TaskStore{
+		"memory":  localTaskStore(),
+		"json":    newTestJSONStore(t, filepath.Join(dir, "tasks.json")),
+		"wal":     newTestWALStore(t, dir, 0),
+		"sqlite":  newTestSQLiteStore(t, filepath.Join(dir, "tasks.db")),
+		"sharded": newTestShardedStore(t, filepath.Join(dir, "tasks.d"), 0),
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			task := mustAddTask(t, store, "alice", "Draft", "")
+			if task.Version != 1 {
+				t.Fatalf("Expected a new task at version 1, got %d", task.Version)
+			}
+
+			title := "Final"
+			updated, err := store.UpdateTask(ctx, "alice", task.ID, 1, TaskUpdate{Title: &title})
+			if err != nil || updated.Version != 2 || updated.Title != title {
+				t.Fatalf("Expected update to version 2, got %+v, %v", updated, err)
+			}
+
+			if _, err := store.CompleteTask(ctx, "alice", task.ID, 1); !errors.Is(err, ErrVersionMismatch) {
+				t.Errorf("Expected ErrVersionMismatch for a stale version, got %v", err)
+			}
+			if err := store.RemoveTask(ctx, "alice", task.ID, 1); !errors.Is(err, ErrVersionMismatch) {
+				t.Errorf("Expected ErrVersionMismatch when deleting a stale version, got %v", err)
+			}
+
+			completed, err := store.CompleteTask(ctx, "alice", task.ID, 2)
+			if err != nil || !completed.Completed || completed.Version != 3 {
+				t.Errorf("Expected completion at version 3, got %+v, %v", completed, err)
+			}
+
+			if got, err := store.GetTask(ctx, "alice", task.ID); err != nil || got.Version != 3 || got.Title != title {
+				t.Errorf("Expected the stored task at version 3, got %+v, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestSingleTaskHandlerUsesETags(t *testing.T) {
+	previousTasks, previousUsers := taskStore, userStore
+	taskStore, userStore = localTaskStore(), newMemoryUserStore()
+	defer func() { taskStore, userStore = previousTasks, previousUsers }()
+
+	router := newRouter()
+	task := mustAddTask(t, taskStore, "alice", "Draft", "")
+	target := fmt.Sprintf("/api/v1/tasks/%d?username=alice", task.ID)
+
+	get := httptest.NewRecorder()
+	router.ServeHTTP(get, httptest.NewRequest(http.MethodGet, target, nil))
+	etag := get.Header().Get("ETag")
+	if etag != `"1"` {
+		t.Fatalf("Expected ETag \"1\", got %q", etag)
+	}
+
+	missing := httptest.NewRecorder()
+	router.ServeHTTP(missing, httptest.NewRequest(http.MethodPut, target, nil))
+	if missing.Code != http.StatusPreconditionRequired {
+		t.Errorf("Expected 428 without If-Match, got %d", missing.Code)
+	}
+
+	complete := httptest.NewRequest(http.MethodPut, target, nil)
+	complete.Header.Set("If-Match", etag)
+	completed := httptest.NewRecorder()
+	router.ServeHTTP(completed, complete)
+	if completed.Code != http.StatusOK || completed.Header().Get("ETag") != `"2"` {
+		t.Fatalf("Expected completion to return ETag \"2\", got %d %q", completed.Code, completed.Header().Get("ETag"))
+	}
+
+	stale := httptest.NewRequest(http.MethodDelete, target, nil)
+	stale.Header.Set("If-Match", etag)
+	rejected := httptest.NewRecorder()
+	router.ServeHTTP(rejected, stale)
+	if rejected.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for a stale ETag, got %d", rejected.Code)
+	}
+
+	list := httptest.NewRecorder()
+	router.ServeHTTP(list, httptest.NewRequest(http.MethodGet, "/api/v1/tasks?username=alice", nil))
+	poll := httptest.NewRequest(http.MethodGet, "/api/v1/tasks?username=alice", nil)
+	poll.Header.Set("If-None-Match", list.Header().Get("ETag"))
+	unchanged := httptest.NewRecorder()
+	router.ServeHTTP(unchanged, poll)
+	if unchanged.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for an unchanged list, got %d", unchanged.Code)
+	}
+}
+
+func TestRouterMatchesMethodsAndPaths(t *testing.T) {
+	previousTasks, previousUsers := taskStore, userStore
+	taskStore, userStore = localTaskStore(), newMemoryUserStore()
+	defer func() { taskStore, userStore = previousTasks, previousUsers }()
+	router := newRouter()
+
+	wrongMethod := httptest.NewRecorder()
+	router.ServeHTTP(wrongMethod, httptest.NewRequest(http.MethodPost, "/api/v1/tasks/1?username=alice", nil))
+	allow := wrongMethod.Header().Get("Allow")
+	if wrongMethod.Code != http.StatusMethodNotAllowed || !strings.Contains(allow, "PATCH") || !strings.Contains(allow, "DELETE") {
+		t.Errorf("Expected 405 with the allowed methods, got %d and Allow %q", wrongMethod.Code, allow)
+	}
+
+	badID := httptest.NewRecorder()
+	router.ServeHTTP(badID, httptest.NewRequest(http.MethodGet, "/api/v1/tasks/abc?username=alice", nil))
+	if badID.Code != http.StatusBadRequest || !strings.Contains(badID.Body.String(), "Invalid task ID") {
+		t.Errorf("Expected 400 for a malformed ID, got %d %q", badID.Code, badID.Body.String())
+	}
+
+	// The web page is not taken for a task with the ID "view"
+	page := httptest.NewRecorder()
+	router.ServeHTTP(page, httptest.NewRequest(http.MethodGet, "/tasks/view", nil))
+	if strings.Contains(page.Body.String(), "Invalid task ID") {
+		t.Errorf("Expected /tasks/view to reach the tasks page, got %d %q", page.Code, page.Body.String())
+	}
+
+	legacy := httptest.NewRecorder()
+	router.ServeHTTP(legacy, httptest.NewRequest(http.MethodGet, "/tasks/abc?username=alice", nil))
+	if legacy.Header().Get("Deprecation") != "true" || !slices.Contains(legacy.Header().Values("Link"), `</api/v1/tasks/abc>; rel="successor-version"`) {
+		t.Errorf("Expected the unversioned path to point to its successor, got %v", legacy.Header())
+	}
+}
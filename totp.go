@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RFC 6238 parameters. These match the defaults of common authenticator apps.
+const (
+	totpIssuer        = "ToDoApp"
+	totpDigits        = 6
+	totpPeriod        = 30
+	totpSkew          = 1 // Accept codes one period either side of now
+	recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+func totpURI(username, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// hotpCode computes the RFC 4226 value for a counter, truncated to the given number of digits.
+func hotpCode(key []byte, counter int64, digits int) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulus := uint32(1)
+	for i := 0; i < digits; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%modulus)
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	return totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+}
+
+// validateTOTP checks code against the secret around now. Steps at or before lastStep
+// have already been used and are rejected to prevent replay. It returns the matched step.
+func validateTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotpCode(key, step, totpDigits)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func generateRecoveryCodes() (codes []string, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		encoded := strings.ToLower(totpEncoding.EncodeToString(raw))
+		code := encoded[:4] + "-" + encoded[4:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// EnrollTOTP stores a new, not yet enabled secret for the user and returns it.
+func (store *jsonUserStore) EnrollTOTP(username string) (string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	user, exists := store.users[username]
+	if !exists {
+		return "", ErrUserNotFound
+	}
+
+	if user.TOTPEnabled {
+		return "", errors.New("two-factor authentication is already enabled")
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+
+	user.TOTPSecret = secret
+	store.users[username] = user
+
+	if err := store.saveUsersToFile(); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// ConfirmTOTP enables two-factor authentication once the user proves they can generate
+// codes, and returns freshly generated recovery codes. Only their hashes are stored.
+func (store *jsonUserStore) ConfirmTOTP(username, code string, now time.Time) ([]string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	user, exists := store.users[username]
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+
+	if user.TOTPEnabled {
+		return nil, errors.New("two-factor authentication is already enabled")
+	}
+
+	if user.TOTPSecret == "" {
+		return nil, errors.New("two-factor enrollment not started")
+	}
+
+	step, ok := validateTOTP(user.TOTPSecret, code, now, user.TOTPLastStep)
+	if !ok {
+		return nil, errors.New("invalid authentication code")
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	user.TOTPEnabled = true
+	user.TOTPLastStep = step
+	user.RecoveryCodes = hashes
+	store.users[username] = user
+
+	if err := store.saveUsersToFile(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (store *jsonUserStore) TOTPEnabled(username string) bool {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.users[username].TOTPEnabled
+}
+
+// VerifySecondFactor accepts either a current authentication code or an unused recovery
+// code. Recovery codes are consumed on use.
+func (store *jsonUserStore) VerifySecondFactor(username, code string, now time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	user, exists := store.users[username]
+	if !exists {
+		return ErrUserNotFound
+	}
+
+	if !user.TOTPEnabled {
+		return nil
+	}
+
+	code = strings.TrimSpace(code)
+	if step, ok := validateTOTP(user.TOTPSecret, code, now, user.TOTPLastStep); ok {
+		user.TOTPLastStep = step
+		store.users[username] = user
+		return store.saveUsersToFile()
+	}
+
+	hashed := hashRecoveryCode(code)
+	for i, stored := range user.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(hashed)) == 1 {
+			user.RecoveryCodes = append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+			store.users[username] = user
+			logger.Info("Recovery code used", "userName", username, "remaining", len(user.RecoveryCodes))
+			return store.saveUsersToFile()
+		}
+	}
+
+	return errors.New("invalid authentication code")
+}
+
+// ResetTOTP disables two-factor authentication for a user. Used by administrators
+// when a user has lost both their device and recovery codes.
+func (store *jsonUserStore) ResetTOTP(username string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	user, exists := store.users[username]
+	if !exists {
+		return ErrUserNotFound
+	}
+
+	user.TOTPSecret = ""
+	user.TOTPEnabled = false
+	user.TOTPLastStep = 0
+	user.RecoveryCodes = nil
+	store.users[username] = user
+
+	auditLogger.Warn("Two-factor authentication reset", "userName", username)
+	return store.saveUsersToFile()
+}
+
+// authenticateSecondFactor checks a TOTP or recovery code through the login limiter.
+func authenticateSecondFactor(username, code, ip string) error {
+	if err := loginLimiter.Allow(username, ip); err != nil {
+		return err
+	}
+
+	if err := userStore.VerifySecondFactor(username, code, time.Now()); err != nil {
+		loginLimiter.RecordFailure(username, ip)
+		return err
+	}
+
+	loginLimiter.RecordSuccess(username)
+	return nil
+}
+
+func promptSecondFactor(scanner *bufio.Scanner, username string) error {
+	fmt.Print("Enter authentication code (or recovery code): ")
+	scanner.Scan()
+	return authenticateSecondFactor(username, scanner.Text(), "cli")
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/base32"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Secret and expectations from RFC 6238 Appendix B (SHA-1), truncated to six digits.
+var rfc6238Secret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPMatchesRFC6238Vectors(t *testing.T) {
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	key, err := decodeTOTPSecret(rfc6238Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range vectors {
+		if got := hotpCode(key, totpStep(time.Unix(v.unix, 0)), totpDigits); got != v.code {
+			t.Errorf("At %d expected %s, got %s", v.unix, v.code, got)
+		}
+	}
+}
+
+func TestValidateTOTPSkewAndReplay(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+
+	step, ok := validateTOTP(rfc6238Secret, "050471", now, 0)
+	if !ok {
+		t.Fatal("Expected current code to validate")
+	}
+
+	if _, ok := validateTOTP(rfc6238Secret, "050471", now.Add(totpPeriod*time.Second), 0); !ok {
+		t.Error("Expected code from the previous period to validate within skew")
+	}
+
+	if _, ok := validateTOTP(rfc6238Secret, "050471", now.Add(3*totpPeriod*time.Second), 0); ok {
+		t.Error("Expected code outside the skew window to be rejected")
+	}
+
+	if _, ok := validateTOTP(rfc6238Secret, "050471", now, step); ok {
+		t.Error("Expected a used code to be rejected")
+	}
+}
+
+func TestRecoveryCodesAreHashed(t *testing.T) {
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("Expected %d codes, got %d codes and %d hashes", recoveryCodeCount, len(codes), len(hashes))
+	}
+
+	for i, code := range codes {
+		if hashes[i] == code {
+			t.Errorf("Recovery code %d stored in plain text", i)
+		}
+		if hashRecoveryCode(" "+code+" ") != hashes[i] {
+			t.Errorf("Recovery code %d does not match its hash", i)
+		}
+	}
+}
+
+func TestTOTPVerificationLocksOutWrongCodes(t *testing.T) {
+	previousUsers, previousLimiter := userStore, loginLimiter
+	defer func() { userStore, loginLimiter = previousUsers, previousLimiter }()
+	userStore = newMemoryUserStore()
+	now := time.Now()
+	loginLimiter = newTestLoginLimiter(&now)
+
+	if err := userStore.AddUser("alice", "Password1"); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := userStore.EnrollTOTP("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := hotpCode(key, totpStep(time.Now()), totpDigits)
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+
+	verify := func(password, code string) *httptest.ResponseRecorder {
+		now = now.Add(time.Minute) // Past any backoff, but not the lockout
+		body := fmt.Sprintf(`{"password": %q, "code": %q}`, password, code)
+		rec := httptest.NewRecorder()
+		verifyTOTPHandler(rec, httptest.NewRequest(http.MethodPost, "/users/me/totp/verify?username=alice", strings.NewReader(body)))
+		return rec
+	}
+
+	if rec := verify("", code); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the code to be refused without the password, got %d", rec.Code)
+	}
+	for i := 0; i < 2; i++ {
+		if rec := verify("Password1", wrong); rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected a wrong code to be rejected, got %d", rec.Code)
+		}
+	}
+	if rec := verify("Password1", code); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected repeated failures to lock the enrollment out, got %d", rec.Code)
+	}
+	if userStore.TOTPEnabled("alice") {
+		t.Error("Expected two-factor authentication to stay disabled")
+	}
+}
@@ -2,90 +2,190 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"sync"
+	"time"
 )
 
 type User struct {
+	Username      string      `json:"username"`
+	Password      string      `json:"password"`
+	TOTPSecret    string      `json:"totp_secret,omitempty"`
+	TOTPEnabled   bool        `json:"totp_enabled,omitempty"`
+	TOTPLastStep  int64       `json:"totp_last_step,omitempty"`
+	RecoveryCodes []string    `json:"recovery_codes,omitempty"` // SHA-256 hashes
+	OIDCIssuer    string      `json:"oidc_issuer,omitempty"`
+	OIDCSubject   string      `json:"oidc_subject,omitempty"`
+	Views         []SavedView `json:"views,omitempty"`
+}
+
+// ErrUserNotFound is returned for a username without an account.
+var ErrUserNotFound = errors.New("user not found")
+
+// ErrNoPassword is returned when a password is checked or changed for a single sign-on
+// account. Such accounts have no local password, so operations that confirm one are
+// refused for them.
+var ErrNoPassword = errors.New("this account signs in with single sign-on and has no password")
+
+type userSummary struct {
 	Username string `json:"username"`
-	Password string `json:"password"`
 }
 
-type UserStore struct {
-	users map[string]User
-	mutex sync.Mutex
+// UserStore keeps the accounts. Backends register themselves by scheme and are
+// chosen with the -users flag.
+type UserStore interface {
+	AddUser(username, password string) error
+	// ResolveUsername returns the name of the account a submitted username refers to.
+	ResolveUsername(username string) string
+	ListUsers() []User
+	// Snapshot returns a copy of all users, keyed by username.
+	Snapshot() map[string]User
+	// ImportUsers adds users exactly as given, as when restoring a snapshot. It fails
+	// with ErrConflict, without adding anyone, if one of the usernames is taken.
+	ImportUsers(users map[string]User) error
+	CheckPassword(username, password string) error
+	ChangePassword(username, oldPassword, newPassword string) error
+	DeleteUser(username string) error
+
+	EnrollTOTP(username string) (string, error)
+	ConfirmTOTP(username, code string, now time.Time) ([]string, error)
+	TOTPEnabled(username string) bool
+	VerifySecondFactor(username, code string, now time.Time) error
+	ResetTOTP(username string) error
+
+	ProvisionOIDCUser(issuer string, claims *idTokenClaims) (User, error)
+
+	ListViews(username string) ([]SavedView, error)
+	SaveView(username, name, filter string) (SavedView, bool, error)
+	DeleteView(username, key string) error
+}
+
+func init() {
+	registerUserStore("json", userStoreBackend{
+		defaultPath: "users.json",
+		open: func(path string, _ url.Values) (UserStore, error) {
+			store, err := newJSONUserStore(path)
+			if err != nil {
+				return nil, err
+			}
+			return store, nil
+		},
+	})
+	registerUserStore("memory", userStoreBackend{
+		open: func(string, url.Values) (UserStore, error) { return newMemoryUserStore(), nil },
+	})
 }
 
-func initializeUserStore() {
-	if _, err := os.Stat("users.json"); os.IsNotExist(err) {
-		if err := createEmptyJSONFile("users.json"); err != nil {
-			logger.Error("Failed to create empty users.json file", "error", err)
-			os.Exit(1)
+// jsonUserStore keeps all users in memory and saves them to a JSON file on every
+// change. Without a file path it is a memory-only store.
+type jsonUserStore struct {
+	filePath string
+	users    map[string]User
+	mutex    sync.Mutex
+	lock     *dataFileLock // Held until Close
+}
+
+func newMemoryUserStore() *jsonUserStore {
+	return &jsonUserStore{users: make(map[string]User)}
+}
+
+func newJSONUserStore(filePath string) (*jsonUserStore, error) {
+	lock, err := lockDataFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &jsonUserStore{filePath: filePath, users: make(map[string]User), lock: lock}
+
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		if err := createEmptyJSONFile(filePath, schemaKindUsers); err != nil {
+			_ = lock.Unlock()
+			return nil, fmt.Errorf("failed to create %s: %w", filePath, err)
 		}
-	} else {
-		if err := loadUsersFromFile(); err != nil {
-			logger.Error("Failed to load users from file", "error", err)
-			os.Exit(1)
+	} else if err := store.loadUsersFromFile(); err != nil {
+		_ = lock.Unlock()
+		return nil, fmt.Errorf("failed to load users from %s: %w", filePath, err)
+	}
+	return store, nil
+}
+
+func closeUserStore(store UserStore) {
+	if closer, ok := store.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logger.Error("Failed to close user store", "error", err)
 		}
 	}
 }
 
-func loadUsersFromFile() error {
-	file, err := os.Open("users.json")
+func initializeUserStore(dsn string) {
+	store, err := openUserStore(dsn)
 	if err != nil {
-		return err
+		logger.Error("Failed to open user store", "error", err)
+		os.Exit(1)
 	}
-	defer func(file *os.File) {
-		err := file.Close()
-		if err != nil {
-			logger.Error("Error closing file:", "error", err)
-		}
-	}(file)
+	userStore = store
+}
 
+func (store *jsonUserStore) loadUsersFromFile() error {
 	users := make(map[string]User)
-	if err := json.NewDecoder(file).Decode(&users); err != nil {
+	if err := loadJSONFileWithRecovery(store.filePath, schemaKindUsers, *storeBackupCount, &users); err != nil {
 		return err
 	}
+	if users == nil {
+		users = make(map[string]User)
+	}
 
-	userStore.users = users
+	store.users = users
 
 	return nil
 }
 
-func (store *UserStore) saveUsersToFile() error {
-	file, err := os.Create("users.json")
-	if err != nil {
-		return err
+func (store *jsonUserStore) saveUsersToFile() error {
+	if store.filePath == "" {
+		return nil
 	}
-	defer func(file *os.File) {
-		err := file.Close()
-		if err != nil {
-			logger.Error("Error closing file:", "error", err)
-		}
-	}(file)
-
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(store.users); err != nil {
-		logger.Error("Failed to encode users to file", "error", err)
+	if err := writeDataFile(store.filePath, schemaKindUsers, *storeBackupCount, store.users); err != nil {
+		logger.Error("Failed to save users to file", "error", err)
 		return err
 	}
-	logger.Info("Users saved to file", "users", store.users) // Log the saved users
+	logger.Info("Users saved to file", "count", len(store.users))
 	return nil
 }
 
-func (store *UserStore) AddUser(username, password string) error {
+// Close releases the lock on the users file.
+func (store *jsonUserStore) Close() error {
+	if store.lock == nil {
+		return nil
+	}
+	return store.lock.Unlock()
+}
+
+func (store *jsonUserStore) AddUser(username, password string) error {
+	username = normalizeUsername(username)
+	if err := validateCredentials(username, password); err != nil {
+		return err
+	}
+
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
-	if _, exists := store.users[username]; exists {
+	if store.nameTaken(username) {
 		return errors.New("user already exists")
 	}
 
+	if store.users == nil {
+		store.users = make(map[string]User)
+	}
+
 	store.users[username] = User{Username: username, Password: password}
 
 	if err := store.saveUsersToFile(); err != nil {
@@ -94,7 +194,32 @@ func (store *UserStore) AddUser(username, password string) error {
 	return nil
 }
 
-func (store *UserStore) ListUsers() []User {
+// nameTaken reports whether an account has the name, ignoring case. Accounts
+// registered before names were lower-cased may contain capitals.
+func (store *jsonUserStore) nameTaken(username string) bool {
+	for existing := range store.users {
+		if strings.EqualFold(existing, username) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveUsername matches the name exactly first, so accounts registered before names
+// were lower-cased keep working; otherwise it is normalized as at registration.
+func (store *jsonUserStore) ResolveUsername(username string) string {
+	username = strings.TrimSpace(username)
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, exists := store.users[username]; exists {
+		return username
+	}
+	return normalizeUsername(username)
+}
+
+func (store *jsonUserStore) ListUsers() []User {
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
@@ -105,8 +230,36 @@ func (store *UserStore) ListUsers() []User {
 	return users
 }
 
+// Snapshot returns a copy of all users, keyed by username.
+func (store *jsonUserStore) Snapshot() map[string]User {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	users := make(map[string]User, len(store.users))
+	for username, user := range store.users {
+		users[username] = user
+	}
+	return users
+}
+
+func (store *jsonUserStore) ImportUsers(users map[string]User) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for username := range users {
+		if _, exists := store.users[username]; exists {
+			return fmt.Errorf("%w: user %s already exists", ErrConflict, username)
+		}
+	}
+	for username, user := range users {
+		store.users[username] = user
+	}
+
+	return store.saveUsersToFile()
+}
+
 func handleListUsers() {
-	resp, err := http.Get("http://localhost:8080/users/list")
+	resp, err := http.Get(apiBaseURL + "/users/list")
 	if err != nil {
 		logger.Error("Failed to list users", "error", err)
 		return
@@ -159,6 +312,7 @@ func handleRegister(scanner *bufio.Scanner) {
 	scanner.Scan()
 	username := scanner.Text()
 
+	fmt.Println(passwordRules.Describe())
 	fmt.Print("Enter password: ")
 	scanner.Scan()
 	password := scanner.Text()
@@ -175,15 +329,18 @@ func handleRegister(scanner *bufio.Scanner) {
 func handleLogin(scanner *bufio.Scanner) {
 	fmt.Print("Enter username: ")
 	scanner.Scan()
-	username := scanner.Text()
+	username := userStore.ResolveUsername(scanner.Text())
 
 	fmt.Print("Enter password: ")
 	scanner.Scan()
 	password := scanner.Text()
 
-	if err := userStore.CheckPassword(username, password); err != nil {
+	if err := authenticate(username, password, "cli"); err != nil {
 		fmt.Println("Login failed:", err)
 		isLoggedIn = false
+	} else if userStore.TOTPEnabled(username) && promptSecondFactor(scanner, username) != nil {
+		fmt.Println("Login failed: invalid authentication code")
+		isLoggedIn = false
 	} else {
 		fmt.Println("Login successful!")
 		isLoggedIn = true
@@ -191,13 +348,18 @@ func handleLogin(scanner *bufio.Scanner) {
 	}
 }
 
-func (store *UserStore) CheckPassword(username, password string) error {
+func (store *jsonUserStore) CheckPassword(username, password string) error {
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
 	user, exists := store.users[username]
 	if !exists {
-		return errors.New("user not found")
+		return ErrUserNotFound
+	}
+
+	// Single sign-on accounts have no local password
+	if user.Password == "" {
+		return ErrNoPassword
 	}
 
 	if user.Password != password {
@@ -206,3 +368,247 @@ func (store *UserStore) CheckPassword(username, password string) error {
 
 	return nil
 }
+
+func (store *jsonUserStore) ChangePassword(username, oldPassword, newPassword string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	user, exists := store.users[username]
+	if !exists {
+		return ErrUserNotFound
+	}
+	if user.Password == "" {
+		return ErrNoPassword
+	}
+
+	if user.Password != oldPassword {
+		return errors.New("invalid password")
+	}
+
+	if errs := passwordRules.Validate(username, newPassword); len(errs) > 0 {
+		return &validationError{Errors: errs}
+	}
+
+	user.Password = newPassword
+	store.users[username] = user
+
+	return store.saveUsersToFile()
+}
+
+func (store *jsonUserStore) DeleteUser(username string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, exists := store.users[username]; !exists {
+		return ErrUserNotFound
+	}
+
+	delete(store.users, username)
+
+	return store.saveUsersToFile()
+}
+
+// confirmAccountDeletion checks that the caller may delete the account: with its
+// password, or for a single sign-on account, which has none, with a recent single
+// sign-on login.
+func confirmAccountDeletion(username, password, ip string) error {
+	if oidcProvider != nil && oidcProvider.RecentLogin(username) {
+		return nil
+	}
+
+	err := authenticate(username, password, ip)
+	if errors.Is(err, ErrNoPassword) {
+		return ErrSSOLoginRequired
+	}
+	return err
+}
+
+// deleteAccount removes a user together with every task they own. The caller confirms
+// the deletion first.
+func deleteAccount(ctx context.Context, username string) error {
+	if err := taskStore.RemoveUserTasks(ctx, username); err != nil {
+		return err
+	}
+
+	return userStore.DeleteUser(username)
+}
+
+// Account settings
+
+type passwordChangeRequest struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+type accountDeleteRequest struct {
+	Password string `json:"password"`
+}
+
+type totpEnrollRequest struct {
+	Password string `json:"password"`
+}
+
+type totpEnrollResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+type totpVerifyRequest struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+type totpVerifyResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+func handlePasswd(scanner *bufio.Scanner) {
+	userName := loggedInUsername
+
+	if userName == "" {
+		logger.Info("You must be logged in to change your password.")
+		return
+	}
+
+	fmt.Print("Enter current password: ")
+	scanner.Scan()
+	oldPassword := scanner.Text()
+
+	fmt.Print("Enter new password: ")
+	scanner.Scan()
+	newPassword := scanner.Text()
+
+	body, _ := json.Marshal(passwordChangeRequest{OldPassword: oldPassword, NewPassword: newPassword})
+	url := apiURL("/users/me/password", userName)
+
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.Error("Failed to change password", "error", err)
+		return
+	}
+	defer safeClose(resp.Body)
+
+	if resp.StatusCode == http.StatusOK {
+		fmt.Println("Password changed successfully.")
+	} else if resp.StatusCode == http.StatusForbidden {
+		body, _ := io.ReadAll(resp.Body)
+		fmt.Printf("Failed to change password: %s\n", strings.TrimSpace(string(body)))
+	} else {
+		fmt.Printf("Failed to change password: %s\n", resp.Status)
+	}
+}
+
+func handleDeleteAccount(scanner *bufio.Scanner) {
+	userName := loggedInUsername
+
+	if userName == "" {
+		logger.Info("You must be logged in to delete your account.")
+		return
+	}
+
+	fmt.Print("Enter password to confirm (empty for single sign-on accounts): ")
+	scanner.Scan()
+	password := scanner.Text()
+
+	fmt.Printf("This will permanently delete %s and all of their tasks. Type 'yes' to continue: ", userName)
+	scanner.Scan()
+	if scanner.Text() != "yes" {
+		fmt.Println("Account deletion cancelled.")
+		return
+	}
+
+	body, _ := json.Marshal(accountDeleteRequest{Password: password})
+	url := apiURL("/users/me", userName)
+
+	req, err := http.NewRequest(http.MethodDelete, url, bytes.NewReader(body))
+	if err != nil {
+		logger.Error("Error creating request:", "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		logger.Error("Failed to delete account", "error", err)
+		return
+	}
+	defer safeClose(resp.Body)
+
+	if resp.StatusCode == http.StatusOK {
+		fmt.Printf("Account %s deleted.\n", userName)
+		isLoggedIn = false
+		loggedInUsername = ""
+	} else if resp.StatusCode == http.StatusForbidden {
+		body, _ := io.ReadAll(resp.Body)
+		fmt.Printf("Failed to delete account: %s\n", strings.TrimSpace(string(body)))
+	} else {
+		fmt.Printf("Failed to delete account: %s\n", resp.Status)
+	}
+}
+
+func handleEnable2FA(scanner *bufio.Scanner) {
+	userName := loggedInUsername
+
+	if userName == "" {
+		logger.Info("You must be logged in to enable two-factor authentication.")
+		return
+	}
+
+	fmt.Print("Enter password: ")
+	scanner.Scan()
+	password := scanner.Text()
+
+	body, _ := json.Marshal(totpEnrollRequest{Password: password})
+	url := apiURL("/users/me/totp", userName)
+
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.Error("Failed to start two-factor enrollment", "error", err)
+		return
+	}
+	defer safeClose(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("Failed to start two-factor enrollment: %s\n", resp.Status)
+		return
+	}
+
+	var enrollment totpEnrollResponse
+	if err := json.NewDecoder(resp.Body).Decode(&enrollment); err != nil {
+		logger.Error("Failed to decode enrollment response", "error", err)
+		return
+	}
+
+	fmt.Println("Add this account to your authenticator app:")
+	fmt.Println(" ", enrollment.URI)
+	fmt.Println("Or enter the secret manually:", enrollment.Secret)
+	fmt.Print("Enter the code shown by the app: ")
+	scanner.Scan()
+
+	body, _ = json.Marshal(totpVerifyRequest{Password: password, Code: scanner.Text()})
+	url = apiURL("/users/me/totp/verify", userName)
+
+	verifyResp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.Error("Failed to verify authentication code", "error", err)
+		return
+	}
+	defer safeClose(verifyResp.Body)
+
+	if verifyResp.StatusCode != http.StatusOK {
+		fmt.Printf("Failed to enable two-factor authentication: %s\n", verifyResp.Status)
+		return
+	}
+
+	var verified totpVerifyResponse
+	if err := json.NewDecoder(verifyResp.Body).Decode(&verified); err != nil {
+		logger.Error("Failed to decode verification response", "error", err)
+		return
+	}
+
+	fmt.Println("Two-factor authentication enabled. Store these recovery codes somewhere safe:")
+	for _, code := range verified.RecoveryCodes {
+		fmt.Println(" ", code)
+	}
+}
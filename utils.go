@@ -3,32 +3,47 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/google/uuid"
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
+	"reflect"
+	"time"
 )
 
-func parseStoreType() string {
-	// Command-line argument to choose the task store type.
-	storeType := flag.String("store", "memory", "Specify the task store: 'memory' or 'json'")
+var storeBackupCount = flag.Int("backups", 3, "Number of rotating backups kept for each data file")
+
+// parseStoreFlags parses the command line and returns the DSNs of the task and user
+// stores. A DSN is a backend name, optionally with a path and options, as in
+// json:///var/lib/todo/tasks.json.
+func parseStoreFlags() (string, string) {
+	taskDSN := flag.String("store", "memory", "Task store: a backend name ("+schemeList(taskStoreBackends)+") or a DSN such as json:///var/lib/todo/tasks.json")
+	userDSN := flag.String("users", "json", "User store: a backend name ("+schemeList(userStoreBackends)+") or a DSN such as json:///var/lib/todo/users.json")
 	flag.Parse()
-	return *storeType
+	return *taskDSN, *userDSN
 }
 
-func initializeTaskStore(storeType string) {
-	// Initialize the task store based on the provided type.
-	switch storeType {
-	case "json":
-		taskStore = newJSONTaskStore("tasks.json")
-	case "memory":
-		taskStore = localTaskStore()
-	default:
-		fmt.Println("Invalid store type. Use 'memory' or 'json'.")
+func initializeTaskStore(dsn string) {
+	// Initialize the task store the DSN describes.
+	store, err := openTaskStore(dsn)
+	if err != nil {
+		fmt.Println(err)
 		os.Exit(1)
 	}
+
+	// Every successful mutation is published on taskEvents
+	store = newEventTaskStore(store, taskEvents)
+	if *cacheTasks {
+		if *jsonWatchInterval > 0 {
+			logger.Warn("The task cache does not see changes merged from the JSON file until the user's next change")
+		}
+		store = newCachingTaskStore(store, *cacheMaxUsers)
+	}
+	taskStore = store
 }
 
 func TraceMiddleware(next http.Handler) http.Handler {
@@ -51,22 +66,9 @@ func TraceMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func createEmptyJSONFile(filePath string) error {
-	// Create the file if it doesn't exist
-	file, err := os.Create(filePath)
-	if err != nil {
-		return err
-	}
-	defer func(file *os.File) {
-		err := file.Close()
-		if err != nil {
-			logger.Error("Error closing file:", "error", err)
-		}
-	}(file)
-
-	// Write an empty JSON object to the file
-	_, err = file.WriteString("{}")
-	return err
+// createEmptyJSONFile writes an empty data file of the given kind.
+func createEmptyJSONFile(filePath, kind string) error {
+	return writeDataFile(filePath, kind, 0, struct{}{})
 }
 
 func safeClose(c io.Closer) {
@@ -102,3 +104,174 @@ func parseJSONRequest(w http.ResponseWriter, r *http.Request, v interface{}) boo
 	}
 	return true
 }
+
+// writeFileAtomic replaces filePath with the output of write without ever leaving a
+// partially written file behind. The data goes to a temporary file in the same
+// directory which is synced and then renamed over the original. Up to backups
+// previous versions are kept as filePath.1 (newest) to filePath.N.
+func writeFileAtomic(filePath string, backups int, write func(w io.Writer) error) error {
+	dir := filepath.Dir(filePath)
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(filePath)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	committed := false
+	defer func() {
+		if !committed {
+			_ = os.Remove(tmpPath)
+		}
+	}()
+
+	if err := write(tmp); err != nil {
+		safeClose(tmp)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		safeClose(tmp)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := rotateBackups(filePath, backups); err != nil {
+		logger.Error("Failed to rotate backups", "file", filePath, "error", err)
+	}
+
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return err
+	}
+	committed = true
+
+	return syncDir(dir)
+}
+
+func backupPath(filePath string, n int) string {
+	return fmt.Sprintf("%s.%d", filePath, n)
+}
+
+// rotateBackups shifts filePath.1..N-1 up by one and links the current file as filePath.1.
+func rotateBackups(filePath string, backups int) error {
+	if backups <= 0 {
+		return nil
+	}
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		return nil
+	}
+
+	_ = os.Remove(backupPath(filePath, backups))
+	for n := backups - 1; n >= 1; n-- {
+		if err := os.Rename(backupPath(filePath, n), backupPath(filePath, n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// A hard link keeps the current file in place until the rename replaces it
+	if err := os.Link(filePath, backupPath(filePath, 1)); err != nil {
+		return copyFile(filePath, backupPath(filePath, 1))
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer safeClose(in)
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		safeClose(out)
+		return err
+	}
+	return out.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer safeClose(d)
+
+	// Not every platform supports syncing a directory; the rename has happened either way
+	if err := d.Sync(); err != nil {
+		logger.Warn("Failed to sync directory", "dir", dir, "error", err)
+	}
+	return nil
+}
+
+// loadJSONFileWithRecovery decodes the data file of the given kind into v, upgrading
+// it if it was written in an older format. If the file is corrupt it is moved aside
+// and the newest readable backup is restored in its place. When nothing can be
+// recovered, v is reset so the caller starts from an empty state. Files from a newer
+// version of the program are never replaced.
+func loadJSONFileWithRecovery(filePath, kind string, backups int, v interface{}) error {
+	removeStaleTempFiles(filePath)
+
+	version, err := decodeDataFile(filePath, kind, v)
+	if err == nil {
+		return upgradeDataFile(filePath, kind, version, backups, v)
+	}
+	if os.IsNotExist(err) {
+		return err
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if !errors.As(err, &syntaxErr) && !errors.As(err, &typeErr) && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, errDecryptionFailed) {
+		return err // An I/O problem, a wrong key or a newer format rather than a corrupt file
+	}
+
+	corruptPath := fmt.Sprintf("%s.corrupt-%s", filePath, time.Now().Format("20060102T150405"))
+	logger.Error("Data file is corrupt, moving it aside", "file", filePath, "movedTo", corruptPath, "error", err)
+	if err := os.Rename(filePath, corruptPath); err != nil {
+		return err
+	}
+
+	for n := 1; n <= backups; n++ {
+		candidate := backupPath(filePath, n)
+		resetValue(v)
+		version, err := decodeDataFile(candidate, kind, v)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				logger.Error("Backup is not readable", "file", candidate, "error", err)
+			}
+			continue
+		}
+
+		if err := copyFile(candidate, filePath); err != nil {
+			return err
+		}
+		logger.Warn("Recovered data file from backup", "file", filePath, "backup", candidate)
+		return upgradeDataFile(filePath, kind, version, backups, v)
+	}
+
+	resetValue(v)
+	logger.Error("No readable backup found, starting with empty data", "file", filePath)
+	return createEmptyJSONFile(filePath, kind)
+}
+
+// resetValue zeroes what v points to, discarding anything a failed decode filled in.
+func resetValue(v interface{}) {
+	target := reflect.ValueOf(v).Elem()
+	target.Set(reflect.Zero(target.Type()))
+}
+
+// removeStaleTempFiles cleans up temporary files left behind by an interrupted write.
+func removeStaleTempFiles(filePath string) {
+	matches, err := filepath.Glob(filePath + ".tmp-*")
+	if err != nil {
+		return
+	}
+	for _, match := range matches {
+		logger.Warn("Removing incomplete write", "file", match)
+		_ = os.Remove(match)
+	}
+}
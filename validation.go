@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+var (
+	passwordMinLength     = flag.Int("password-min-length", 8, "Minimum password length")
+	passwordRequireMixed  = flag.Bool("password-require-mixed-case", true, "Require both upper and lower case letters in passwords")
+	passwordRequireDigit  = flag.Bool("password-require-digit", true, "Require at least one digit in passwords")
+	passwordRequireSymbol = flag.Bool("password-require-symbol", false, "Require at least one symbol in passwords")
+)
+
+const (
+	usernameMinLength = 3
+	usernameMaxLength = 32
+	passwordMaxLength = 128
+)
+
+var passwordRules = defaultPasswordPolicy()
+
+type passwordPolicy struct {
+	MinLength        int
+	RequireMixedCase bool
+	RequireDigit     bool
+	RequireSymbol    bool
+}
+
+func defaultPasswordPolicy() passwordPolicy {
+	return passwordPolicy{
+		MinLength:        8,
+		RequireMixedCase: true,
+		RequireDigit:     true,
+	}
+}
+
+func initializePasswordPolicy() {
+	passwordRules = passwordPolicy{
+		MinLength:        *passwordMinLength,
+		RequireMixedCase: *passwordRequireMixed,
+		RequireDigit:     *passwordRequireDigit,
+		RequireSymbol:    *passwordRequireSymbol,
+	}
+}
+
+// fieldError describes why a single request field was rejected.
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type validationError struct {
+	Errors []fieldError
+}
+
+func (e *validationError) Error() string {
+	messages := make([]string, 0, len(e.Errors))
+	for _, fieldErr := range e.Errors {
+		messages = append(messages, fieldErr.Message)
+	}
+	return strings.Join(messages, "; ")
+}
+
+// errorResponse is the JSON body returned for rejected user requests.
+type errorResponse struct {
+	Error   string       `json:"error"`
+	Details []fieldError `json:"details,omitempty"`
+}
+
+// normalizeUsername trims surrounding whitespace and lower-cases the name of a new
+// account. Submitted names are mapped to accounts with UserStore.ResolveUsername.
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+func validateUsername(username string) []fieldError {
+	var errs []fieldError
+
+	if len(username) < usernameMinLength || len(username) > usernameMaxLength {
+		errs = append(errs, fieldError{"username", fmt.Sprintf("Username must be %d to %d characters long", usernameMinLength, usernameMaxLength)})
+	}
+
+	for _, r := range username {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-') {
+			errs = append(errs, fieldError{"username", "Username may only contain letters, digits, '.', '_' and '-'"})
+			break
+		}
+	}
+
+	return errs
+}
+
+func (policy passwordPolicy) Validate(username, password string) []fieldError {
+	var errs []fieldError
+
+	if len(password) < policy.MinLength {
+		errs = append(errs, fieldError{"password", fmt.Sprintf("Password must be at least %d characters long", policy.MinLength)})
+	}
+
+	if len(password) > passwordMaxLength {
+		errs = append(errs, fieldError{"password", fmt.Sprintf("Password must be at most %d characters long", passwordMaxLength)})
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			hasSymbol = true
+		}
+	}
+
+	if policy.RequireMixedCase && !(hasUpper && hasLower) {
+		errs = append(errs, fieldError{"password", "Password must contain upper and lower case letters"})
+	}
+	if policy.RequireDigit && !hasDigit {
+		errs = append(errs, fieldError{"password", "Password must contain a digit"})
+	}
+	if policy.RequireSymbol && !hasSymbol {
+		errs = append(errs, fieldError{"password", "Password must contain a symbol"})
+	}
+
+	if username != "" && strings.Contains(strings.ToLower(password), username) {
+		errs = append(errs, fieldError{"password", "Password must not contain the username"})
+	}
+
+	return errs
+}
+
+// Describe summarizes the policy for display next to password fields.
+func (policy passwordPolicy) Describe() string {
+	rules := []string{fmt.Sprintf("at least %d characters", policy.MinLength)}
+	if policy.RequireMixedCase {
+		rules = append(rules, "upper and lower case letters")
+	}
+	if policy.RequireDigit {
+		rules = append(rules, "a digit")
+	}
+	if policy.RequireSymbol {
+		rules = append(rules, "a symbol")
+	}
+	return "Password must contain " + strings.Join(rules, ", ")
+}
+
+// validateCredentials checks an already normalized username and a password against the rules.
+func validateCredentials(username, password string) error {
+	errs := append(validateUsername(username), passwordRules.Validate(username, password)...)
+	if len(errs) > 0 {
+		return &validationError{Errors: errs}
+	}
+	return nil
+}
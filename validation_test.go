@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateCredentials(t *testing.T) {
+	tests := []struct {
+		username string
+		password string
+		valid    bool
+	}{
+		{"alice", "Correct1Horse", true},
+		{"bob.smith_2", "Sup3rSecret", true},
+		{"", "Correct1Horse", false},
+		{"al", "Correct1Horse", false},
+		{"alice bob", "Correct1Horse", false},
+		{"alice&admin=1", "Correct1Horse", false},
+		{"alice", "", false},
+		{"alice", "short1A", false},
+		{"alice", "alllowercase1", false},
+		{"alice", "NoDigitsHere", false},
+		{"alice", "MyAlice2024", false},
+	}
+
+	for _, tt := range tests {
+		err := validateCredentials(tt.username, tt.password)
+		if tt.valid && err != nil {
+			t.Errorf("Expected %q/%q to be valid, got %v", tt.username, tt.password, err)
+		}
+
+		var invalid *validationError
+		if !tt.valid && !errors.As(err, &invalid) {
+			t.Errorf("Expected %q/%q to be rejected with a validation error, got %v", tt.username, tt.password, err)
+		}
+	}
+}
+
+func TestNormalizeUsername(t *testing.T) {
+	if got := normalizeUsername("  Alice "); got != "alice" {
+		t.Errorf("Expected \"alice\", got %q", got)
+	}
+}
+
+func TestResolveUsernameKeepsExistingNames(t *testing.T) {
+	users := newMemoryUserStore()
+	if err := users.ImportUsers(map[string]User{"Alice": {Username: "Alice", Password: "x"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.AddUser("Bob ", "Password123"); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]string{"Alice": "Alice", " Alice ": "Alice", "BOB": "bob", "bob": "bob", "carol": "carol"}
+	for submitted, expected := range cases {
+		if got := users.ResolveUsername(submitted); got != expected {
+			t.Errorf("ResolveUsername(%q): expected %q, got %q", submitted, expected, got)
+		}
+	}
+	if err := users.AddUser("alice", "Password123"); err == nil {
+		t.Error("Expected a name differing only in case from an existing account to be refused")
+	}
+}
+
+func TestOIDCUsernameIsNormalized(t *testing.T) {
+	cases := []struct {
+		claims   idTokenClaims
+		expected string
+	}{
+		{idTokenClaims{PreferredUsername: "Alice.Smith", Subject: "1"}, "alice.smith"},
+		{idTokenClaims{PreferredUsername: "Alice Smith", Email: "ASmith@example.com", Subject: "1"}, "asmith"},
+		{idTokenClaims{Subject: "user-4711"}, "user-4711"},
+	}
+	for _, c := range cases {
+		if got, err := oidcUsername(&c.claims); err != nil || got != c.expected {
+			t.Errorf("%+v: expected %q, got %q %v", c.claims, c.expected, got, err)
+		}
+	}
+	if _, err := oidcUsername(&idTokenClaims{Subject: "x"}); err == nil {
+		t.Error("Expected claims without a usable name to be refused")
+	}
+}
+
+func TestAPIURLEscapesUsername(t *testing.T) {
+	got := apiURL("/tasks", "a b&c=d")
+	want := "http://localhost:8080/api/v1/tasks?username=a+b%26c%3Dd"
+	if got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
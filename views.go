@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Limits on saved views, so a user record stays small
+const (
+	maxViewsPerUser   = 50
+	viewNameMaxLength = 50
+)
+
+// ErrViewNotFound is returned for a view the user has not saved.
+var ErrViewNotFound = errors.New("view not found")
+
+// SavedView is a named filter a user keeps, such as "Today" for status:open created:<1d.
+// It is referred to by its key, which is derived from the name: @today, or
+// @waiting-on-others for "Waiting on others".
+type SavedView struct {
+	Key    string `json:"key"`
+	Name   string `json:"name"`
+	Filter string `json:"filter"`
+}
+
+// viewKey derives the key of a view from its name: lower case, with every run of other
+// characters than letters and digits replaced by a dash.
+func viewKey(name string) string {
+	var key strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && key.Len() > 0 {
+				key.WriteByte('-')
+			}
+			key.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return key.String()
+}
+
+// newSavedView checks the name and filter of a view to be saved.
+func newSavedView(name, filter string) (SavedView, error) {
+	name = strings.TrimSpace(name)
+	filter = strings.TrimSpace(filter)
+
+	var errs []fieldError
+	switch {
+	case viewKey(name) == "":
+		errs = append(errs, fieldError{Field: "name", Message: "Name must contain a letter or digit"})
+	case utf8.RuneCountInString(name) > viewNameMaxLength:
+		errs = append(errs, fieldError{Field: "name", Message: fmt.Sprintf("Name must be at most %d characters", viewNameMaxLength)})
+	}
+	if _, err := parseTaskFilter(filter, time.Now()); err != nil {
+		errs = append(errs, fieldError{Field: "filter", Message: err.Error()})
+	}
+	if len(errs) > 0 {
+		return SavedView{}, &validationError{Errors: errs}
+	}
+	return SavedView{Key: viewKey(name), Name: name, Filter: filter}, nil
+}
+
+// findView returns the index of the view with key, or -1.
+func findView(views []SavedView, key string) int {
+	for i, view := range views {
+		if view.Key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func (store *jsonUserStore) ListViews(username string) ([]SavedView, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	user, exists := store.users[username]
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+	return append([]SavedView{}, user.Views...), nil
+}
+
+// SaveView adds a view, or replaces the one with the same key. It reports whether
+// a view was replaced.
+func (store *jsonUserStore) SaveView(username, name, filter string) (SavedView, bool, error) {
+	view, err := newSavedView(name, filter)
+	if err != nil {
+		return SavedView{}, false, err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	user, exists := store.users[username]
+	if !exists {
+		return SavedView{}, false, ErrUserNotFound
+	}
+
+	views := append([]SavedView(nil), user.Views...)
+	i := findView(views, view.Key)
+	if i >= 0 {
+		views[i] = view
+	} else {
+		if len(views) >= maxViewsPerUser {
+			return SavedView{}, false, &validationError{Errors: []fieldError{{Field: "name", Message: fmt.Sprintf("At most %d views can be saved", maxViewsPerUser)}}}
+		}
+		views = append(views, view)
+	}
+	user.Views = views
+	store.users[username] = user
+
+	if err := store.saveUsersToFile(); err != nil {
+		return SavedView{}, false, err
+	}
+	return view, i >= 0, nil
+}
+
+func (store *jsonUserStore) DeleteView(username, key string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	user, exists := store.users[username]
+	if !exists {
+		return ErrUserNotFound
+	}
+	i := findView(user.Views, key)
+	if i < 0 {
+		return ErrViewNotFound
+	}
+	user.Views = append(append([]SavedView(nil), user.Views[:i]...), user.Views[i+1:]...)
+	store.users[username] = user
+
+	return store.saveUsersToFile()
+}
+
+// viewFilter returns the filter of the user's view with key, which may start with @.
+func viewFilter(username, key string) (*TaskFilter, error) {
+	views, err := userStore.ListViews(username)
+	if err != nil {
+		return nil, err
+	}
+	i := findView(views, strings.TrimPrefix(key, "@"))
+	if i < 0 {
+		return nil, fmt.Errorf("%w: @%s", ErrViewNotFound, strings.TrimPrefix(key, "@"))
+	}
+	return parseTaskFilter(views[i].Filter, time.Now())
+}
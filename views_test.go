@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestViewKey(t *testing.T) {
+	cases := map[string]string{
+		"Today":              "today",
+		"Waiting on others!": "waiting-on-others",
+		"  Q3 -- Reports ":   "q3-reports",
+		"Émile's":            "émile-s",
+		"!!!":                "",
+	}
+	for name, key := range cases {
+		if got := viewKey(name); got != key {
+			t.Errorf("viewKey(%q): expected %q, got %q", name, key, got)
+		}
+	}
+}
+
+func TestJSONUserStoreSavesViews(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	users, err := newJSONUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.ImportUsers(map[string]User{"alice": {Username: "alice"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, replaced, err := users.SaveView("alice", "Today", "status:open created:<1d"); err != nil || replaced {
+		t.Fatalf("Expected a new view, got %v %v", replaced, err)
+	}
+	if _, _, err := users.SaveView("alice", "Waiting on others", "waiting"); err != nil {
+		t.Fatal(err)
+	}
+	if view, replaced, err := users.SaveView("alice", "TODAY", "status:open"); err != nil || !replaced || view.Key != "today" {
+		t.Fatalf("Expected the view to be replaced, got %+v %v %v", view, replaced, err)
+	}
+
+	var invalid *validationError
+	if _, _, err := users.SaveView("alice", "---", "priority:high"); !errors.As(err, &invalid) || len(invalid.Errors) != 2 {
+		t.Errorf("Expected the name and the filter to be rejected, got %v", err)
+	}
+	if _, _, err := users.SaveView("bob", "Today", ""); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected views of unknown users to be refused, got %v", err)
+	}
+	if err := users.DeleteView("alice", "waiting-on-others"); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.DeleteView("alice", "waiting-on-others"); !errors.Is(err, ErrViewNotFound) {
+		t.Errorf("Expected deleting a missing view to fail, got %v", err)
+	}
+	closeUserStore(users)
+
+	reopened, err := newJSONUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeUserStore(reopened)
+	views, err := reopened.ListViews("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []SavedView{{Key: "today", Name: "TODAY", Filter: "status:open"}}; !slices.Equal(views, expected) {
+		t.Errorf("Expected %v after reopening, got %v", expected, views)
+	}
+}
+
+func TestViewsHandlersAndTaskListing(t *testing.T) {
+	previousTasks, previousUsers := taskStore, userStore
+	taskStore, userStore = localTaskStore(), newMemoryUserStore()
+	defer func() { taskStore, userStore = previousTasks, previousUsers }()
+	if err := userStore.ImportUsers(map[string]User{"alice": {Username: "alice"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := taskStore.ImportTasks(context.Background(), "alice", queryTestTasks()); err != nil {
+		t.Fatal(err)
+	}
+	router := newRouter()
+
+	save := httptest.NewRecorder()
+	router.ServeHTTP(save, httptest.NewRequest(http.MethodPost, "/api/v1/views?username=alice", strings.NewReader(`{"name": "Open buys", "filter": "status:open buy"}`)))
+	if save.Code != http.StatusCreated || !strings.Contains(save.Body.String(), `"key":"open-buys"`) {
+		t.Fatalf("Expected the view to be created, got %d %q", save.Code, save.Body.String())
+	}
+
+	invalid := httptest.NewRecorder()
+	router.ServeHTTP(invalid, httptest.NewRequest(http.MethodPost, "/api/v1/views?username=alice", strings.NewReader(`{"name": "Bad", "filter": "due:<7d"}`)))
+	if invalid.Code != http.StatusBadRequest || !strings.Contains(invalid.Body.String(), `unknown field \"due\"`) {
+		t.Errorf("Expected the filter to be rejected, got %d %q", invalid.Code, invalid.Body.String())
+	}
+
+	list := httptest.NewRecorder()
+	router.ServeHTTP(list, httptest.NewRequest(http.MethodGet, "/api/v1/tasks?username=alice&view=open-buys&q=-milk", nil))
+	var tasks []Task
+	if err := json.NewDecoder(list.Body).Decode(&tasks); err != nil {
+		t.Fatal(err)
+	}
+	if ids := taskIDs(tasks); !slices.Equal(ids, []int{3}) {
+		t.Errorf("Expected the view and the filter to both apply, got %v", ids)
+	}
+
+	missing := httptest.NewRecorder()
+	router.ServeHTTP(missing, httptest.NewRequest(http.MethodGet, "/api/v1/tasks?username=alice&view=nope", nil))
+	if missing.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown view, got %d", missing.Code)
+	}
+
+	remove := httptest.NewRecorder()
+	router.ServeHTTP(remove, httptest.NewRequest(http.MethodDelete, "/api/v1/views/@open-buys?username=alice", nil))
+	get := httptest.NewRecorder()
+	router.ServeHTTP(get, httptest.NewRequest(http.MethodGet, "/api/v1/views?username=alice", nil))
+	if remove.Code != http.StatusNoContent || strings.TrimSpace(get.Body.String()) != "[]" {
+		t.Errorf("Expected the view to be deleted, got %d and %q", remove.Code, get.Body.String())
+	}
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var walSnapshotEvery = flag.Int("wal-snapshot-every", 1000, "Number of logged operations after which the WAL store writes a snapshot and truncates its log")
+
+func init() {
+	// The snapshot sits next to the log unless the DSN names it, as in wal:tasks.wal?snapshot=tasks.snap
+	registerTaskStore("wal", taskStoreBackend{
+		defaultPath: "tasks.wal",
+		options:     []string{"snapshot"},
+		open: func(path string, options url.Values) (TaskStore, error) {
+			snapshotPath := options.Get("snapshot")
+			if snapshotPath == "" {
+				snapshotPath = strings.TrimSuffix(path, ".wal") + ".snapshot.json"
+			}
+			return openWALTaskStore(path, snapshotPath)
+		},
+	})
+}
+
+// Operations recorded in the write-ahead log
+const (
+	walOpAdd        = "add"
+	walOpComplete   = "complete" // Written before tasks had versions; replayed only
+	walOpUpdate     = "update"
+	walOpRemove     = "remove"
+	walOpRemoveUser = "remove_user"
+	walOpBatch      = "batch" // Several records applied together
+)
+
+// walRecord is one line of the log. Seq increases monotonically across snapshots so
+// records already contained in a snapshot can be skipped on replay.
+type walRecord struct {
+	Seq      uint64      `json:"seq"`
+	Op       string      `json:"op"`
+	UserName string      `json:"user"`
+	ID       int         `json:"id,omitempty"`
+	Task     *Task       `json:"task,omitempty"`
+	Batch    []walRecord `json:"batch,omitempty"`
+}
+
+type walSnapshot struct {
+	Seq   uint64                  `json:"seq"`
+	Tasks map[string]map[int]Task `json:"tasks"`
+}
+
+// walTaskStore keeps all tasks in memory and makes every mutation durable by
+// appending a single record to a log file, instead of rewriting the whole data set.
+// The log is periodically compacted into a snapshot.
+type walTaskStore struct {
+	logPath       string
+	snapshotPath  string
+	snapshotEvery int
+	mutex         sync.Mutex
+	log           *os.File
+	lock          *dataFileLock
+	seq           uint64
+	sinceSnapshot int
+	tasks         map[string]map[int]Task // Map of userName to tasks
+	idSeq         int
+	reusableIds   []int
+}
+
+func openWALTaskStore(logPath, snapshotPath string) (*walTaskStore, error) {
+	// Only one process may append to the log, and the snapshot goes with it
+	lock, err := lockDataFile(logPath)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &walTaskStore{
+		logPath:       logPath,
+		snapshotPath:  snapshotPath,
+		snapshotEvery: *walSnapshotEvery,
+		tasks:         make(map[string]map[int]Task),
+		reusableIds:   []int{},
+		lock:          lock,
+	}
+
+	if err := store.load(); err != nil {
+		if store.log != nil {
+			_ = store.log.Close()
+		}
+		_ = lock.Unlock()
+		return nil, fmt.Errorf("failed to load WAL store %s: %w", logPath, err)
+	}
+
+	return store, nil
+}
+
+// load restores the snapshot, replays newer log records and opens the log for appending.
+func (store *walTaskStore) load() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var snapshot walSnapshot
+	if err := loadJSONFileWithRecovery(store.snapshotPath, "", *storeBackupCount, &snapshot); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if snapshot.Tasks != nil {
+		store.tasks = snapshot.Tasks
+	}
+	for userName, userTasks := range store.tasks {
+		for id, task := range userTasks {
+			if task.Version == 0 { // Snapshot written before tasks had versions
+				task.Version = 1
+				store.tasks[userName][id] = task
+			}
+		}
+	}
+	store.seq = snapshot.Seq
+
+	log, err := os.OpenFile(store.logPath, os.O_RDWR|os.O_CREATE, 0664)
+	if err != nil {
+		return err
+	}
+	store.log = log
+
+	replayed, err := store.replay()
+	if err != nil {
+		return err
+	}
+
+	store.idSeq, store.reusableIds = idStateFromTasks(store.tasks)
+	store.sinceSnapshot = replayed
+
+	logger.Info("WAL store loaded", "snapshotSeq", snapshot.Seq, "replayed", replayed, "seq", store.seq)
+	return nil
+}
+
+// replay applies log records newer than the snapshot. A torn record at the end of the
+// log (a crash during append) is cut off so later appends start on a clean line. Any
+// other record that cannot be read fails the replay, leaving the log untouched, since
+// cutting it off would also lose every record after it.
+func (store *walTaskStore) replay() (int, error) {
+	if _, err := store.log.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	reader := bufio.NewReader(store.log)
+	var offset int64
+	replayed := 0
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) && len(line) == 0 {
+			break
+		}
+
+		if err != nil {
+			logger.Warn("Discarding incomplete WAL record", "log", store.logPath, "offset", offset)
+			if err := store.log.Truncate(offset); err != nil {
+				return replayed, err
+			}
+			break
+		}
+
+		var record walRecord
+		plain, err := openLine(activeKey, line)
+		if isKeyError(err) {
+			return replayed, fmt.Errorf("%s: %w; set $%s or -encryption-key-file to the key it was written with", store.logPath, err, encryptionKeyEnv)
+		}
+		if err == nil {
+			err = json.Unmarshal(plain, &record)
+		}
+		if err != nil {
+			return replayed, fmt.Errorf("%s: unreadable record at offset %d: %w", store.logPath, offset, err)
+		}
+		offset += int64(len(line))
+
+		if record.Seq <= store.seq {
+			continue // Already part of the snapshot
+		}
+
+		store.apply(record)
+		store.seq = record.Seq
+		replayed++
+	}
+
+	_, err := store.log.Seek(0, io.SeekEnd)
+	return replayed, err
+}
+
+// apply changes the in-memory state for a record. Records are validated before they
+// are logged, so apply never fails.
+func (store *walTaskStore) apply(record walRecord) {
+	switch record.Op {
+	case walOpAdd:
+		task := *record.Task
+		if task.Version == 0 {
+			task.Version = 1
+		}
+		if store.tasks[record.UserName] == nil {
+			store.tasks[record.UserName] = make(map[int]Task)
+		}
+		store.tasks[record.UserName][task.ID] = task
+
+	case walOpComplete:
+		if task, exists := store.tasks[record.UserName][record.ID]; exists {
+			store.tasks[record.UserName][record.ID] = completeUpdate().apply(task)
+		}
+
+	case walOpUpdate:
+		if _, exists := store.tasks[record.UserName][record.Task.ID]; exists {
+			store.tasks[record.UserName][record.Task.ID] = *record.Task
+		}
+
+	case walOpRemove:
+		delete(store.tasks[record.UserName], record.ID)
+		if len(store.tasks[record.UserName]) == 0 {
+			delete(store.tasks, record.UserName)
+		}
+
+	case walOpRemoveUser:
+		delete(store.tasks, record.UserName)
+
+	case walOpBatch:
+		for _, nested := range record.Batch {
+			store.apply(nested)
+		}
+	}
+}
+
+// commit appends the record to the log, syncs it and then applies it in memory.
+func (store *walTaskStore) commit(record walRecord) error {
+	record.Seq = store.seq + 1
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if line, err = sealLine(activeKey, line); err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	offset, err := store.log.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	// A record that failed is cut off: a partial one could hide records appended after
+	// it, and a whole one would be replayed although the caller was told it failed
+	discard := func() {
+		_ = store.log.Truncate(offset)
+		_, _ = store.log.Seek(offset, io.SeekStart)
+	}
+	if _, err := store.log.Write(line); err != nil {
+		discard()
+		return err
+	}
+	if err := store.log.Sync(); err != nil {
+		discard()
+		return err
+	}
+
+	store.seq = record.Seq
+	store.apply(record)
+
+	store.sinceSnapshot++
+	if store.snapshotEvery > 0 && store.sinceSnapshot >= store.snapshotEvery {
+		if err := store.compact(); err != nil {
+			// The log still holds everything, so this only costs replay time
+			logger.Error("Failed to compact WAL", "log", store.logPath, "error", err)
+		}
+	}
+	return nil
+}
+
+// compact writes a snapshot of the current state and empties the log. If the process
+// dies between the two steps, replay skips the records the snapshot already covers.
+func (store *walTaskStore) compact() error {
+	snapshot := walSnapshot{Seq: store.seq, Tasks: store.tasks}
+	err := writeFileAtomic(store.snapshotPath, *storeBackupCount, encryptWith(activeKey, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(snapshot)
+	}))
+	if err != nil {
+		return err
+	}
+
+	if err := store.log.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := store.log.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	store.sinceSnapshot = 0
+	logger.Info("WAL compacted into snapshot", "snapshot", store.snapshotPath, "seq", store.seq)
+	return nil
+}
+
+// Close compacts the log, releases the file handle and then the lock.
+func (store *walTaskStore) Close() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if err := store.compact(); err != nil {
+		logger.Error("Failed to compact WAL on close", "error", err)
+	}
+	err := store.log.Close()
+	if unlockErr := store.lock.Unlock(); err == nil {
+		err = unlockErr
+	}
+	return err
+}
+
+func (store *walTaskStore) AddTask(ctx context.Context, userName, title string, description string) (Task, error) {
+	if err := ctx.Err(); err != nil {
+		return Task{}, err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var id int
+	if len(store.reusableIds) > 0 {
+		id = store.reusableIds[0]
+		store.reusableIds = store.reusableIds[1:]
+	} else {
+		store.idSeq++
+		id = store.idSeq
+	}
+
+	task := Task{
+		ID:          id,
+		Title:       title,
+		Description: description,
+		Completed:   false,
+		Version:     1,
+		CreatedAt:   time.Now().UTC(),
+	}
+
+	if err := store.commit(walRecord{Op: walOpAdd, UserName: userName, Task: &task}); err != nil {
+		logger.Error("Failed to append to WAL", "traceID", traceIDFrom(ctx), "error", err)
+		store.idSeq, store.reusableIds = idStateFromTasks(store.tasks)
+		return Task{}, err
+	}
+
+	return task, nil
+}
+
+func (store *walTaskStore) RemoveTask(ctx context.Context, userName string, id int, version int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	task, err := lookupUserTask(store.tasks, userName, id)
+	if err != nil {
+		return err
+	}
+	if err := checkVersion(task, version); err != nil {
+		return err
+	}
+
+	if err := store.commit(walRecord{Op: walOpRemove, UserName: userName, ID: id}); err != nil {
+		logger.Error("Failed to append to WAL", "traceID", traceIDFrom(ctx), "error", err)
+		return err
+	}
+
+	store.reusableIds = append(store.reusableIds, id)
+	sort.Ints(store.reusableIds)
+
+	logger.Info("Task deleted and logged", "traceID", traceIDFrom(ctx), "taskID", id, "userName", userName)
+	return nil
+}
+
+func (store *walTaskStore) ListTasks(ctx context.Context, userName string) ([]Task, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	taskList := make([]Task, 0, len(store.tasks[userName]))
+	for _, task := range store.tasks[userName] {
+		taskList = append(taskList, task)
+	}
+
+	return taskList, nil
+}
+
+func (store *walTaskStore) QueryTasks(ctx context.Context, userName string, query TaskQuery) (TaskPage, error) {
+	tasks, err := store.ListTasks(ctx, userName)
+	if err != nil {
+		return TaskPage{}, err
+	}
+	return queryTaskList(tasks, query)
+}
+
+func (store *walTaskStore) GetTask(ctx context.Context, userName string, id int) (Task, error) {
+	if err := ctx.Err(); err != nil {
+		return Task{}, err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return lookupUserTask(store.tasks, userName, id)
+}
+
+func (store *walTaskStore) CompleteTask(ctx context.Context, userName string, id int, version int) (Task, error) {
+	return store.UpdateTask(ctx, userName, id, version, completeUpdate())
+}
+
+// UpdateTask logs the whole updated task, so replay does not depend on how the update
+// was computed.
+func (store *walTaskStore) UpdateTask(ctx context.Context, userName string, id int, version int, update TaskUpdate) (Task, error) {
+	if err := ctx.Err(); err != nil {
+		return Task{}, err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	task, err := lookupUserTask(store.tasks, userName, id)
+	if err != nil {
+		return Task{}, err
+	}
+	if err := checkVersion(task, version); err != nil {
+		return Task{}, err
+	}
+
+	updated := update.apply(task)
+	if err := store.commit(walRecord{Op: walOpUpdate, UserName: userName, Task: &updated}); err != nil {
+		logger.Error("Failed to append to WAL", "traceID", traceIDFrom(ctx), "error", err)
+		return Task{}, err
+	}
+
+	logger.Info("Task updated and logged", "traceID", traceIDFrom(ctx), "taskID", id, "version", updated.Version, "userName", userName)
+	return updated, nil
+}
+
+func (store *walTaskStore) RemoveUserTasks(ctx context.Context, userName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	userTasks, exists := store.tasks[userName]
+	if !exists {
+		return nil
+	}
+
+	ids := make([]int, 0, len(userTasks))
+	for id := range userTasks {
+		ids = append(ids, id)
+	}
+
+	if err := store.commit(walRecord{Op: walOpRemoveUser, UserName: userName}); err != nil {
+		logger.Error("Failed to append to WAL", "traceID", traceIDFrom(ctx), "error", err)
+		return err
+	}
+
+	store.reusableIds = append(store.reusableIds, ids...)
+	sort.Ints(store.reusableIds)
+
+	logger.Info("All tasks removed for user", "traceID", traceIDFrom(ctx), "userName", userName)
+	return nil
+}
+
+func (store *walTaskStore) ListUserNames(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	userNames := make([]string, 0, len(store.tasks))
+	for userName := range store.tasks {
+		userNames = append(userNames, userName)
+	}
+	sort.Strings(userNames)
+	return userNames, nil
+}
+
+func (store *walTaskStore) SnapshotTasks(ctx context.Context) (map[string]map[int]Task, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return cloneTasks(store.tasks), nil
+}
+
+// ApplyBatch validates the batch against a copy of the tasks and logs all of its
+// changes as a single record, so replay applies either all of them or none.
+func (store *walTaskStore) ApplyBatch(ctx context.Context, userName string, ops []BatchOp) ([]Task, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	results, err := applyBatch(cloneTasks(store.tasks), userName, ops, newGapIDAllocator(store.tasks))
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]walRecord, len(ops))
+	for i, op := range ops {
+		task := results[i]
+		switch op.Op {
+		case batchOpAdd:
+			records[i] = walRecord{Op: walOpAdd, UserName: userName, Task: &task}
+		case batchOpDelete:
+			records[i] = walRecord{Op: walOpRemove, UserName: userName, ID: task.ID}
+		default:
+			records[i] = walRecord{Op: walOpUpdate, UserName: userName, Task: &task}
+		}
+	}
+
+	if err := store.commit(walRecord{Op: walOpBatch, UserName: userName, Batch: records}); err != nil {
+		logger.Error("Failed to append to WAL", "traceID", traceIDFrom(ctx), "error", err)
+		return nil, err
+	}
+
+	store.idSeq, store.reusableIds = idStateFromTasks(store.tasks)
+
+	logger.Info("Task batch applied and logged", "traceID", traceIDFrom(ctx), "operations", len(ops), "userName", userName)
+	return results, nil
+}
+
+// ImportTasks logs every task as an add record, keeping IDs and completion state.
+func (store *walTaskStore) ImportTasks(ctx context.Context, userName string, tasks []Task) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	tasks = importedTasks(tasks)
+	if err := checkImportIDs(store.tasks, tasks); err != nil {
+		return err
+	}
+
+	for _, task := range tasks {
+		task := task
+		if err := store.commit(walRecord{Op: walOpAdd, UserName: userName, Task: &task}); err != nil {
+			logger.Error("Failed to append to WAL", "traceID", traceIDFrom(ctx), "error", err)
+			store.idSeq, store.reusableIds = idStateFromTasks(store.tasks)
+			return err
+		}
+	}
+
+	store.idSeq, store.reusableIds = idStateFromTasks(store.tasks)
+	return nil
+}
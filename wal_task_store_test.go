@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func newTestWALStore(t *testing.T, dir string, snapshotEvery int) *walTaskStore {
+	t.Helper()
+	store, err := openWALTaskStore(filepath.Join(dir, "tasks.wal"), filepath.Join(dir, "tasks.snapshot.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.snapshotEvery = snapshotEvery
+	t.Cleanup(func() { crashWALStore(store) })
+	return store
+}
+
+// crashWALStore lets go of the store's files as a killed process would, without
+// compacting the log, so it can be opened again.
+func crashWALStore(store *walTaskStore) {
+	_ = store.log.Close()
+	_ = store.lock.Unlock()
+}
+
+func TestWALStoreReplaysLogOnStartup(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestWALStore(t, dir, 0)
+
+	first := mustAddTask(t, store, "alice", "First", "one")
+	second := mustAddTask(t, store, "alice", "Second", "two")
+	mustAddTask(t, store, "bob", "Third", "three")
+
+	if _, err := store.CompleteTask(context.Background(), "alice", first.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RemoveTask(context.Background(), "alice", second.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RemoveUserTasks(context.Background(), "bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	crashWALStore(store)
+	reopened := newTestWALStore(t, dir, 0)
+
+	tasks := mustListTasks(t, reopened, "alice")
+	if len(tasks) != 1 || tasks[0].ID != first.ID || !tasks[0].Completed {
+		t.Errorf("Unexpected tasks for alice after replay: %+v", tasks)
+	}
+	if tasks := mustListTasks(t, reopened, "bob"); len(tasks) != 0 {
+		t.Errorf("Expected no tasks for bob after replay, got %d", len(tasks))
+	}
+
+	if task := mustAddTask(t, reopened, "alice", "Reused", ""); task.ID != second.ID {
+		t.Errorf("Expected freed ID %d to be reused, got %d", second.ID, task.ID)
+	}
+}
+
+func TestWALStoreCompactsIntoSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestWALStore(t, dir, 10)
+
+	for j := 0; j < 25; j++ {
+		mustAddTask(t, store, "alice", fmt.Sprintf("Task %d", j), "")
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "tasks.wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() == 0 || store.sinceSnapshot != 5 {
+		t.Errorf("Expected 5 records after the last compaction, got %d (log size %d)", store.sinceSnapshot, info.Size())
+	}
+
+	crashWALStore(store)
+	reopened := newTestWALStore(t, dir, 10)
+	if tasks := mustListTasks(t, reopened, "alice"); len(tasks) != 25 {
+		t.Errorf("Expected 25 tasks from snapshot and log, got %d", len(tasks))
+	}
+	if reopened.sinceSnapshot != 5 {
+		t.Errorf("Expected only 5 records to be replayed, got %d", reopened.sinceSnapshot)
+	}
+}
+
+func TestWALStoreDiscardsTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestWALStore(t, dir, 0)
+	mustAddTask(t, store, "alice", "Durable", "")
+
+	// Simulate a crash in the middle of appending the next record
+	log, err := os.OpenFile(filepath.Join(dir, "tasks.wal"), os.O_APPEND|os.O_WRONLY, 0664)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := log.WriteString(`{"seq":2,"op":"add","user":"alice","task":{"id":2,"ti`); err != nil {
+		t.Fatal(err)
+	}
+	safeClose(log)
+
+	crashWALStore(store)
+	reopened := newTestWALStore(t, dir, 0)
+	if tasks := mustListTasks(t, reopened, "alice"); len(tasks) != 1 {
+		t.Fatalf("Expected only the durable task, got %d", len(tasks))
+	}
+
+	mustAddTask(t, reopened, "alice", "After crash", "")
+	crashWALStore(reopened)
+	again := newTestWALStore(t, dir, 0)
+	if tasks := mustListTasks(t, again, "alice"); len(tasks) != 2 {
+		t.Errorf("Expected appends after recovery to replay cleanly, got %d tasks", len(tasks))
+	}
+}
+
+func TestWALStoreRefusesCorruptRecordBeforeOthers(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestWALStore(t, dir, 0)
+	mustAddTask(t, store, "alice", "First", "")
+	mustAddTask(t, store, "alice", "Second", "")
+
+	crashWALStore(store)
+
+	logPath := filepath.Join(dir, "tasks.wal")
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := bytes.IndexByte(data, '\n') + 1
+	corrupt := append(append(append([]byte{}, data[:first]...), "{not a record\n"...), data[first:]...)
+	if err := os.WriteFile(logPath, corrupt, 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = openWALTaskStore(logPath, filepath.Join(dir, "tasks.snapshot.json"))
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("offset %d", first)) {
+		t.Fatalf("Expected loading to fail at offset %d, got %v", first, err)
+	}
+	if after, _ := os.ReadFile(logPath); !bytes.Equal(after, corrupt) {
+		t.Error("Expected the log to be left untouched")
+	}
+}
+
+func TestConcurrentAccessWALStore(t *testing.T) {
+	store := newTestWALStore(t, t.TempDir(), 100)
+	totalUsers := 10
+	tasksPerUser := 50
+	wg := &sync.WaitGroup{}
+
+	for i := 0; i < totalUsers; i++ {
+		userName := fmt.Sprintf("user%d", i)
+		wg.Add(1)
+
+		go func(userName string) {
+			defer wg.Done()
+			for j := 0; j < tasksPerUser; j++ {
+				task := mustAddTask(t, store, userName, fmt.Sprintf("Task %d", j), "")
+				if _, err := store.CompleteTask(context.Background(), userName, task.ID, 0); err != nil {
+					t.Errorf("Failed to complete task %d for user %s: %v", task.ID, userName, err)
+				}
+			}
+
+			if tasks := mustListTasks(t, store, userName); len(tasks) != tasksPerUser {
+				t.Errorf("Expected %d tasks for %s, got %d", tasksPerUser, userName, len(tasks))
+			}
+		}(userName)
+	}
+
+	wg.Wait()
+}